@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/go-couchbase"
+)
+
+// People commit, log in and get mail under more than one address.
+// Other addresses can be attached to a user as aliases, which are
+// turned into the user's own address wherever one comes in.
+
+const aliasCacheTime = 30 * time.Second
+
+var errMergeSelf = errors.New("can't merge a user into themselves")
+
+var aliasCache = struct {
+	sync.Mutex
+	aliases map[string]string
+	fetched time.Time
+}{}
+
+// Lower cased alias -> user.
+var loadAliases = func() (map[string]string, error) {
+	args := map[string]interface{}{
+		"stale": false,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Key   string
+			Value string
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "aliases", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]string{}
+	for _, row := range viewRes.Rows {
+		rv[row.Key] = row.Value
+	}
+	return rv, nil
+}
+
+func getAliases() map[string]string {
+	aliasCache.Lock()
+	defer aliasCache.Unlock()
+
+	if aliasCache.aliases != nil &&
+		time.Since(aliasCache.fetched) < aliasCacheTime {
+		return aliasCache.aliases
+	}
+
+	aliases, err := loadAliases()
+	if err != nil {
+		log.Printf("Error loading aliases: %v", err)
+		if aliasCache.aliases != nil {
+			return aliasCache.aliases
+		}
+		return map[string]string{}
+	}
+	aliasCache.aliases = aliases
+	aliasCache.fetched = time.Now()
+	return aliases
+}
+
+func forgetAliases() {
+	aliasCache.Lock()
+	defer aliasCache.Unlock()
+	aliasCache.aliases = nil
+}
+
+// The user an address belongs to: the address itself unless it's
+// someone's alias.
+func canonicalEmail(email string) string {
+	if c, ok := getAliases()[strings.ToLower(email)]; ok {
+		return c
+	}
+	return email
+}
+
+func isAlias(email string) bool {
+	_, ok := getAliases()[strings.ToLower(email)]
+	return ok
+}
+
+// Check that addresses can become aliases of a user.  An address that
+// has its own account should be merged instead.
+func checkAliases(email string, aliases []string) error {
+	current := getAliases()
+	for _, a := range aliases {
+		if !strings.Contains(a, "@") {
+			return fmt.Errorf("%q is not an address", a)
+		}
+		if strings.EqualFold(a, email) {
+			return fmt.Errorf("%v can't be an alias of itself", a)
+		}
+		if c, ok := current[strings.ToLower(a)]; ok && c != email {
+			return fmt.Errorf("%v is already an alias of %v", a, c)
+		}
+		u := User{}
+		if err := db.Get("u-"+a, &u); err == nil && u.Type == "user" {
+			return fmt.Errorf("%v has an account, merge it instead", a)
+		}
+	}
+	return nil
+}
+
+// Change every mention of from in a document to to.  Returns whether
+// anything changed.
+func replaceUserIn(doc map[string]interface{}, typ, from, to string) bool {
+	changed := false
+	for _, k := range userFields[typ] {
+		if maybenil(doc, k) == from {
+			doc[k] = to
+			changed = true
+		}
+	}
+	for _, k := range userListFields[typ] {
+		l, _ := doc[k].([]interface{})
+		found, has := false, false
+		kept := []interface{}{}
+		for _, v := range l {
+			switch v {
+			case from:
+				found = true
+				continue
+			case to:
+				has = true
+			}
+			kept = append(kept, v)
+		}
+		if found {
+			if !has {
+				kept = append(kept, to)
+			}
+			doc[k] = kept
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Fold the account at from into into.  Everything from owned, wrote,
+// or subscribed to becomes into's, and from (along with any aliases
+// of its own) becomes an alias of into.
+func mergeUsers(from, into string) (int, error) {
+	if strings.EqualFold(from, into) {
+		return 0, errMergeSelf
+	}
+
+	docs, err := findUserData(from)
+	if err != nil {
+		return 0, err
+	}
+
+	aliases := []string{from}
+	n := 0
+	for _, d := range docs {
+		switch d.Type {
+		case "session":
+			err = db.Delete(d.Id)
+		case "user":
+			l, _ := d.Doc["aliases"].([]interface{})
+			for _, a := range l {
+				if s, ok := a.(string); ok {
+					aliases = append(aliases, s)
+				}
+			}
+			err = db.Delete(d.Id)
+		default:
+			err = db.Update(d.Id, 0, func(current []byte) ([]byte, error) {
+				if len(current) == 0 {
+					return nil, couchbase.UpdateCancel
+				}
+				doc := map[string]interface{}{}
+				err := json.Unmarshal(current, &doc)
+				if err != nil {
+					return nil, err
+				}
+				if !replaceUserIn(doc, d.Type, from, into) {
+					return nil, couchbase.UpdateCancel
+				}
+				return json.Marshal(doc)
+			})
+			if err == couchbase.UpdateCancel {
+				err = nil
+			}
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	err = db.Update("u-"+into, 0, func(current []byte) ([]byte, error) {
+		user := User{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &user)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Common fields
+		user.Id = into
+		user.Type = "user"
+
+		for _, a := range aliases {
+			user.Aliases = removeFromList(user.Aliases, a)
+			user.Aliases = append(user.Aliases, a)
+		}
+
+		return json.Marshal(user)
+	})
+
+	forgetAliases()
+	forgetGroups()
+	forgetDisplayNames()
+	return n, err
+}
+
+func serveMergeUsers(w http.ResponseWriter, r *http.Request) {
+	from := r.FormValue("from")
+	into := resolvePrincipal(r.FormValue("into"))
+	if from == "" || into == "" ||
+		isGroupPrincipal(from) || isGroupPrincipal(into) {
+		showError(w, r, "from and into must both be addresses", 400)
+		return
+	}
+	if strings.EqualFold(from, into) {
+		showError(w, r, errMergeSelf.Error(), 400)
+		return
+	}
+
+	n, err := mergeUsers(from, into)
+	audit(r, whoami(r).Id, "user.merge", from,
+		map[string]interface{}{"into": into, "documents": n})
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	mustEncode(w, map[string]interface{}{
+		"from":      from,
+		"into":      into,
+		"documents": n,
+	})
+}
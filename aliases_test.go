@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func withAliases(aliases map[string]string) func() {
+	origLoad := loadAliases
+	loadAliases = func() (map[string]string, error) {
+		return aliases, nil
+	}
+	forgetAliases()
+	return func() {
+		loadAliases = origLoad
+		forgetAliases()
+	}
+}
+
+func TestCanonicalEmail(t *testing.T) {
+	defer withAliases(map[string]string{
+		"dustin@spy.net": "dustin@couchbase.com",
+	})()
+
+	tests := []struct {
+		in, exp string
+	}{
+		{"dustin@spy.net", "dustin@couchbase.com"},
+		{"Dustin@Spy.net", "dustin@couchbase.com"},
+		{"dustin@couchbase.com", "dustin@couchbase.com"},
+		{"aaron@crate.im", "aaron@crate.im"},
+		{"", ""},
+	}
+
+	for _, x := range tests {
+		if got := canonicalEmail(x.in); got != x.exp {
+			t.Errorf("canonicalEmail(%q) = %q, expected %q", x.in, got, x.exp)
+		}
+		if got := resolvePrincipal(x.in); got != x.exp {
+			t.Errorf("resolvePrincipal(%q) = %q, expected %q", x.in, got, x.exp)
+		}
+	}
+
+	users := []string{"aaron@crate.im", "dustin@couchbase.com"}
+	if got := resolveMention("dustin@spy.net", users); got != "dustin@couchbase.com" {
+		t.Errorf("Mentioning an alias found %q", got)
+	}
+}
+
+func TestReplaceUserIn(t *testing.T) {
+	tests := []struct {
+		typ, in, out string
+		changed      bool
+	}{
+		{"bug",
+			`{"creator":"old@x","owner":"old@x","subscribers":["old@x","b@x"]}`,
+			`{"creator":"new@x","owner":"new@x","subscribers":["b@x","new@x"]}`,
+			true},
+		{"bug",
+			`{"creator":"b@x","subscribers":["old@x","new@x"]}`,
+			`{"creator":"b@x","subscribers":["new@x"]}`,
+			true},
+		{"reminder",
+			`{"user":"old@x"}`,
+			`{"user":"new@x"}`,
+			true},
+		{"comment",
+			`{"user":"b@x"}`,
+			`{"user":"b@x"}`,
+			false},
+	}
+
+	for _, x := range tests {
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(x.in), &doc); err != nil {
+			t.Fatalf("Error parsing %v: %v", x.in, err)
+		}
+		exp := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(x.out), &exp); err != nil {
+			t.Fatalf("Error parsing %v: %v", x.out, err)
+		}
+
+		changed := replaceUserIn(doc, x.typ, "old@x", "new@x")
+		if changed != x.changed {
+			t.Errorf("Replacing in %v %v changed = %v, expected %v",
+				x.typ, x.in, changed, x.changed)
+		}
+		if !reflect.DeepEqual(doc, exp) {
+			t.Errorf("Replacing in %v %v = %v, expected %v",
+				x.typ, x.in, doc, exp)
+		}
+	}
+}
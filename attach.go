@@ -2,12 +2,17 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/couchbaselabs/cbfs/client"
@@ -58,81 +63,278 @@ func (c *countingReader) Read(b []byte) (int, error) {
 	return n, err
 }
 
-func serveFileUpload(w http.ResponseWriter, r *http.Request) {
-	if *cbfsUrl == "" {
-		showError(w, r, "attachment storage is not configured", 500)
-		return
+// Store the content of an attachment and record it.  The caller
+// fills in the bug, filename, content type, user and creation time;
+// the rest is filled in here.  If size isn't -1, content of any other
+// size is thrown away rather than recorded.
+func putAttachment(att *Attachment, r io.Reader, size int64) error {
+	attid := randstring(8)
+	dest := *cbfsUrl + att.BugId + "/" + attid + "/" + att.Filename
+
+	durl, err := url.Parse(dest)
+	if err != nil {
+		return err
 	}
 
-	bugid := mux.Vars(r)["bugid"]
-	me := whoami(r)
-	if _, err := getBugOrDisplayErr(bugid, me, w, r); err != nil {
-		return
+	cbfsc, err := cbfsclient.New(*cbfsUrl)
+	if err != nil {
+		return err
 	}
 
-	f, fh, err := r.FormFile("uploadedFile")
+	h := sha256.New()
+	cr := &countingReader{r: io.TeeReader(r, h)}
+
+	err = cbfsc.Put(att.Filename, durl.Path, cr,
+		cbfsclient.PutOptions{ContentType: att.ContentType})
 	if err != nil {
-		showError(w, r, err.Error(), 500)
-		return
+		return err
 	}
-	defer f.Close()
 
-	attid := randstring(8)
-	dest := *cbfsUrl + bugid + "/" + attid + "/" + fh.Filename
+	if size >= 0 && cr.n != size {
+		go deleteBlobFile(dest)
+		return fmt.Errorf("Stored %v bytes, expected %v", cr.n, size)
+	}
 
-	cr := &countingReader{r: f}
+	att.Id = att.BugId + "-" + attid
+	att.Type = "attachment"
+	att.Url = dest
+	att.Size = cr.n
+	att.Sha256 = hex.EncodeToString(h.Sum(nil))
 
-	durl, err := url.Parse(dest)
+	return recordAttachment(att)
+}
+
+var storeAttachment = func(att Attachment) error {
+	return db.Set("att-"+att.Id, 0, att)
+}
+
+// Record a stored attachment against its content's blob, sharing an
+// earlier file with the same content if there is one.
+func recordAttachment(att *Attachment) error {
+	dest := att.Url
+	blob, err := addBlobRef(*att)
 	if err != nil {
-		showError(w, r, err.Error(), 500)
-		return
+		go deleteBlobFile(dest)
+		return err
 	}
-	dpath := durl.Path
 
-	cbfsc, err := cbfsclient.New(*cbfsUrl)
+	if blob.Url != dest {
+		log.Printf("Attachment %v is a duplicate of %v", att.Id, blob.Url)
+		att.Url = blob.Url
+		go deleteBlobFile(dest)
+	}
+
+	err = storeAttachment(*att)
 	if err != nil {
-		showError(w, r, err.Error(), 500)
+		// Nothing else would ever release the reference.
+		maybeLog("releasing unrecorded attachment "+att.Id,
+			deleteAttachmentFile(*att))
+	}
+	return err
+}
+
+// Apply f to the blob for a hash, which is empty if there isn't one
+// yet, and save the result.
+var updateBlob = func(sha string, f func(blob *Blob) error) (Blob, error) {
+	blob := Blob{}
+	err := db.Update("blob-"+sha, 0, func(current []byte) ([]byte, error) {
+		blob = Blob{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &blob)
+			if err != nil {
+				return nil, err
+			}
+			if blob.Type != "blob" {
+				return nil, fmt.Errorf("Expected a blob, got %v",
+					blob.Type)
+			}
+		}
+
+		if err := f(&blob); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(blob)
+	})
+	return blob, err
+}
+
+func addBlobRef(att Attachment) (Blob, error) {
+	return updateBlob(att.Sha256, func(blob *Blob) error {
+		blob.Id = att.Sha256
+		blob.Type = "blob"
+
+		// An empty url means the last reference went away and
+		// the file is gone (or going), so this one takes over.
+		if blob.Url == "" {
+			blob.Url = att.Url
+			blob.Size = att.Size
+		}
+
+		blob.Refs = removeFromList(blob.Refs, "att-"+att.Id)
+		blob.Refs = append(blob.Refs, "att-"+att.Id)
+		return nil
+	})
+}
+
+// The raw documents for whichever of the keys exist.
+var getDocsBulk = func(keys []string) (map[string][]byte, error) {
+	rv := map[string][]byte{}
+	if len(keys) == 0 {
+		return rv, nil
+	}
+	res, err := db.GetBulk(keys)
+	if err != nil {
+		return nil, err
+	}
+	for k, mcr := range res {
+		rv[k] = mcr.Body
+	}
+	return rv, nil
+}
+
+// Find the other bugs (visible to the given user) that have the same
+// file attached.
+func alsoAttachedTo(att Attachment, me User) []string {
+	return alsoAttachedToAll([]Attachment{att}, me)[att.Id]
+}
+
+// alsoAttachedTo for each of a list of attachments, by id.  The blobs,
+// the attachments sharing them and their bugs are each fetched at
+// once, however many attachments there are.
+func alsoAttachedToAll(atts []Attachment, me User) map[string][]string {
+	rv := map[string][]string{}
+	blobKeys := []string{}
+	for _, att := range atts {
+		rv[att.Id] = []string{}
+		if att.Sha256 != "" && !contains(blobKeys, "blob-"+att.Sha256) {
+			blobKeys = append(blobKeys, "blob-"+att.Sha256)
+		}
+	}
+
+	docs, err := getDocsBulk(blobKeys)
+	if err != nil {
+		log.Printf("Error getting blobs: %v", err)
+		return rv
+	}
+	refs := map[string][]string{}
+	refKeys := []string{}
+	for k, d := range docs {
+		blob := Blob{}
+		if err := json.Unmarshal(d, &blob); err != nil || blob.Type != "blob" {
+			continue
+		}
+		refs[strings.TrimPrefix(k, "blob-")] = blob.Refs
+		for _, ref := range blob.Refs {
+			if !contains(refKeys, ref) {
+				refKeys = append(refKeys, ref)
+			}
+		}
+	}
+
+	docs, err = getDocsBulk(refKeys)
+	if err != nil {
+		log.Printf("Error getting attachments for blobs: %v", err)
+		return rv
+	}
+	bugOf := map[string]string{}
+	bugKeys := []string{}
+	for k, d := range docs {
+		other := Attachment{}
+		if err := json.Unmarshal(d, &other); err != nil ||
+			other.Type != "attachment" {
+			continue
+		}
+		bugOf[k] = other.BugId
+		if !contains(bugKeys, other.BugId) {
+			bugKeys = append(bugKeys, other.BugId)
+		}
+	}
+
+	docs, err = getDocsBulk(bugKeys)
+	if err != nil {
+		log.Printf("Error getting bugs for blobs: %v", err)
+		return rv
+	}
+	visible := map[string]bool{}
+	for k, d := range docs {
+		bug := Bug{}
+		if err := json.Unmarshal(d, &bug); err == nil {
+			visible[k] = isVisible(bug, me)
+		}
+	}
+
+	for _, att := range atts {
+		seen := map[string]bool{att.BugId: true}
+		for _, ref := range refs[att.Sha256] {
+			b, ok := bugOf[ref]
+			if !ok || seen[b] {
+				continue
+			}
+			seen[b] = true
+			if visible[b] {
+				rv[att.Id] = append(rv[att.Id], b)
+			}
+		}
+		sort.Strings(rv[att.Id])
+	}
+	return rv
+}
+
+func serveFileUpload(w http.ResponseWriter, r *http.Request) {
+	if *cbfsUrl == "" {
+		showError(w, r, "attachment storage is not configured", 500)
+		return
+	}
+
+	bugid := mux.Vars(r)["bugid"]
+	me := whoami(r)
+	if _, err := getBugOrDisplayErr(bugid, me, w, r); err != nil {
 		return
 	}
 
-	err = cbfsc.Put(fh.Filename, dpath, cr,
-		cbfsclient.PutOptions{ContentType: fh.Header.Get("Content-Type")})
+	f, fh, err := r.FormFile("uploadedFile")
 	if err != nil {
 		showError(w, r, err.Error(), 500)
 		return
 	}
+	defer f.Close()
 
 	att := Attachment{
-		Id:          bugid + "-" + attid,
 		BugId:       bugid,
-		Type:        "attachment",
-		Url:         dest,
-		Size:        cr.n,
 		ContentType: fh.Header.Get("Content-Type"),
 		Filename:    fh.Filename,
 		User:        me.Id,
 		CreatedAt:   time.Now().UTC(),
 	}
 
-	err = db.Set("att-"+bugid+"-"+attid, 0, &att)
+	err = putAttachment(&att, f, -1)
 	if err != nil {
 		showError(w, r, err.Error(), 500)
 		return
 	}
 
-	log.Printf("Attached %v -> %v", attid, dest)
+	log.Printf("Attached %v -> %v", att.Id, att.Url)
 
 	notifyAttachment(att)
 
+	rv := attachmentJSON(att)
+	rv["also_attached_to"] = alsoAttachedTo(att, me)
+
 	w.WriteHeader(200)
-	mustEncode(w, map[string]interface{}{
+	mustEncode(w, rv)
+}
+
+func attachmentJSON(att Attachment) map[string]interface{} {
+	return map[string]interface{}{
 		"id":           "att-" + att.Id,
 		"user":         Email(att.User),
 		"filename":     att.Filename,
 		"content_type": att.ContentType,
 		"created_at":   att.CreatedAt,
 		"size":         att.Size,
-	})
+		"sha256":       att.Sha256,
+	}
 }
 
 func serveAttachmentList(w http.ResponseWriter, r *http.Request) {
@@ -157,8 +359,9 @@ func serveAttachmentList(w http.ResponseWriter, r *http.Request) {
 				Json struct {
 					Filename    string
 					ContentType string `json:"content_type"`
-					User        Email
+					User        string
 					Size        int64
+					Sha256      string
 				}
 			}
 		}
@@ -171,24 +374,39 @@ func serveAttachmentList(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type outT struct {
-		Id          string `json:"id"`
-		User        Email  `json:"user"`
-		Filename    string `json:"filename"`
-		ContentType string `json:"content_type"`
-		Size        int64  `json:"size"`
-		Timestamp   string `json:"created_at"`
+		Id             string   `json:"id"`
+		User           Email    `json:"user"`
+		Filename       string   `json:"filename"`
+		ContentType    string   `json:"content_type"`
+		Size           int64    `json:"size"`
+		Timestamp      string   `json:"created_at"`
+		Sha256         string   `json:"sha256,omitempty"`
+		AlsoAttachedTo []string `json:"also_attached_to"`
+	}
+
+	atts := []Attachment{}
+	for _, r := range viewRes.Rows {
+		atts = append(atts, Attachment{
+			Id:     strings.TrimPrefix(r.Id, "att-"),
+			BugId:  bugid,
+			Sha256: r.Doc.Json.Sha256,
+		})
 	}
+	also := alsoAttachedToAll(atts, me)
 
 	out := []outT{}
 
-	for _, r := range viewRes.Rows {
+	for i, r := range viewRes.Rows {
+		j := r.Doc.Json
 		out = append(out, outT{
 			r.Id,
-			r.Doc.Json.User,
-			r.Doc.Json.Filename,
-			r.Doc.Json.ContentType,
-			r.Doc.Json.Size,
+			Email(j.User),
+			j.Filename,
+			j.ContentType,
+			j.Size,
 			r.Key[1],
+			j.Sha256,
+			also[atts[i].Id],
 		})
 	}
 
@@ -272,7 +490,7 @@ func serveHeadAttachment(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Disposition", "attachment")
 }
 
-func deleteAttachmentFile(url string) error {
+var deleteBlobFile = func(url string) error {
 	log.Printf("Deleting attachment file at %v", url)
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
@@ -293,6 +511,44 @@ func deleteAttachmentFile(url string) error {
 	return nil
 }
 
+// Drop an attachment's reference to its file, deleting the file once
+// nothing else refers to it.
+func deleteAttachmentFile(att Attachment) error {
+	if att.Sha256 == "" {
+		// From before content was hashed, so it's not shared.
+		return deleteBlobFile(att.Url)
+	}
+
+	gone := ""
+	_, err := updateBlob(att.Sha256, func(blob *Blob) error {
+		if blob.Type == "" {
+			return NotFound
+		}
+
+		gone = ""
+		blob.Refs = removeFromList(blob.Refs, "att-"+att.Id)
+		if len(blob.Refs) == 0 {
+			// Leave the empty doc behind rather than racing
+			// with someone adding a new reference.
+			gone = blob.Url
+			blob.Url = ""
+			blob.Size = 0
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error releasing blob %v for %v: %v",
+			att.Sha256, att.Id, err)
+		return err
+	}
+
+	if gone == "" {
+		log.Printf("Keeping attachment file %v, still referenced", att.Url)
+		return nil
+	}
+	return deleteBlobFile(gone)
+}
+
 func serveDeleteAttachment(w http.ResponseWriter, r *http.Request) {
 	attid := mux.Vars(r)["attid"]
 	me := whoami(r)
@@ -309,7 +565,7 @@ func serveDeleteAttachment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !(me.Admin || att.User == me.Id) {
+	if !(att.User == me.Id || userCan(me, permBugDelete)) {
 		showError(w, r, "not your attachment", 400)
 		return
 	}
@@ -321,9 +577,13 @@ func serveDeleteAttachment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit(r, me.Id, "attachment.delete", att.BugId,
+		map[string]interface{}{"attachment": attid, "filename": att.Filename,
+			"user": att.User})
+
 	// Nothing below is fatal.
 	w.WriteHeader(204)
 
 	// Then delete it from CBFS
-	go deleteAttachmentFile(att.Url)
+	go deleteAttachmentFile(att)
 }
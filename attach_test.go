@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Keep blobs in memory and record deleted files instead of talking
+// to the database and cbfs.
+func withBlobs(blobs map[string]Blob, deleted *[]string) func() {
+	origUpdate, origDelete := updateBlob, deleteBlobFile
+	updateBlob = func(sha string, f func(blob *Blob) error) (Blob, error) {
+		blob := blobs[sha]
+		if err := f(&blob); err != nil {
+			return Blob{}, err
+		}
+		blobs[sha] = blob
+		return blob, nil
+	}
+	deleteBlobFile = func(url string) error {
+		*deleted = append(*deleted, url)
+		return nil
+	}
+	return func() {
+		updateBlob, deleteBlobFile = origUpdate, origDelete
+	}
+}
+
+func TestBlobRefs(t *testing.T) {
+	blobs := map[string]Blob{}
+	deleted := []string{}
+	defer withBlobs(blobs, &deleted)()
+
+	a := Attachment{Id: "bug-1-a", Sha256: "abc", Url: "http://cbfs/a", Size: 3}
+	b := Attachment{Id: "bug-2-b", Sha256: "abc", Url: "http://cbfs/b", Size: 3}
+	c := Attachment{Id: "bug-3-c", Sha256: "abc", Url: "http://cbfs/c", Size: 3}
+
+	blob, err := addBlobRef(a)
+	if err != nil || blob.Url != a.Url || blob.Size != 3 {
+		t.Fatalf("Expected a to own the blob, got %+v, %v", blob, err)
+	}
+
+	// Duplicates share the first file.
+	blob, err = addBlobRef(b)
+	if err != nil || blob.Url != a.Url {
+		t.Fatalf("Expected b to share a's file, got %+v, %v", blob, err)
+	}
+	// Adding the same reference again doesn't count twice.
+	blob, err = addBlobRef(b)
+	exp := []string{"att-bug-1-a", "att-bug-2-b"}
+	if err != nil || !reflect.DeepEqual(blob.Refs, exp) {
+		t.Fatalf("Expected refs %v, got %+v, %v", exp, blob, err)
+	}
+
+	if err := deleteAttachmentFile(a); err != nil {
+		t.Fatalf("Error releasing a: %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Fatalf("Deleted %v while b still refers to it", deleted)
+	}
+	if blobs["abc"].Url != a.Url {
+		t.Fatalf("Expected the file to stay put, got %+v", blobs["abc"])
+	}
+
+	// The last reference going takes the file with it.
+	if err := deleteAttachmentFile(b); err != nil {
+		t.Fatalf("Error releasing b: %v", err)
+	}
+	if !reflect.DeepEqual(deleted, []string{a.Url}) {
+		t.Fatalf("Expected %v deleted, got %v", a.Url, deleted)
+	}
+	if blob := blobs["abc"]; blob.Url != "" || len(blob.Refs) != 0 {
+		t.Fatalf("Expected an empty blob, got %+v", blob)
+	}
+
+	// Whoever comes along next brings their own file.
+	blob, err = addBlobRef(c)
+	if err != nil || blob.Url != c.Url || !reflect.DeepEqual(blob.Refs,
+		[]string{"att-bug-3-c"}) {
+		t.Fatalf("Expected c to take over the blob, got %+v, %v", blob, err)
+	}
+}
+
+func TestDeleteAttachmentFileUnhashed(t *testing.T) {
+	blobs := map[string]Blob{}
+	deleted := []string{}
+	defer withBlobs(blobs, &deleted)()
+
+	old := Attachment{Id: "bug-1-old", Url: "http://cbfs/old"}
+	if err := deleteAttachmentFile(old); err != nil {
+		t.Fatalf("Error deleting old attachment: %v", err)
+	}
+	if !reflect.DeepEqual(deleted, []string{old.Url}) {
+		t.Fatalf("Expected %v deleted, got %v", old.Url, deleted)
+	}
+
+	missing := Attachment{Id: "bug-1-gone", Sha256: "def", Url: "http://cbfs/gone"}
+	if err := deleteAttachmentFile(missing); err != NotFound {
+		t.Errorf("Expected NotFound for a missing blob, got %v", err)
+	}
+	if len(blobs) != 0 {
+		t.Errorf("Expected no blobs created, got %v", blobs)
+	}
+}
+
+func TestRecordAttachmentReleasesOnFailure(t *testing.T) {
+	blobs := map[string]Blob{}
+	deleted := []string{}
+	defer withBlobs(blobs, &deleted)()
+
+	origStore := storeAttachment
+	defer func() { storeAttachment = origStore }()
+	storeAttachment = func(Attachment) error { return errors.New("no") }
+
+	att := Attachment{Id: "bug-1-a", Sha256: "abc", Url: "http://cbfs/a", Size: 3}
+	if err := recordAttachment(&att); err == nil {
+		t.Fatalf("Expected an error recording the attachment")
+	}
+	if blob := blobs["abc"]; len(blob.Refs) != 0 || blob.Url != "" {
+		t.Errorf("Expected the reference released, got %+v", blob)
+	}
+	if !reflect.DeepEqual(deleted, []string{att.Url}) {
+		t.Errorf("Expected %v deleted, got %v", att.Url, deleted)
+	}
+
+	// Content that's already stored stays for whoever has it.
+	storeAttachment = func(Attachment) error { return nil }
+	deleted = deleted[:0]
+	if err := recordAttachment(&att); err != nil {
+		t.Fatalf("Error recording the attachment: %v", err)
+	}
+	storeAttachment = func(Attachment) error { return errors.New("no") }
+	b := Attachment{Id: "bug-2-b", Sha256: "abc", Url: "http://cbfs/a", Size: 3}
+	if err := recordAttachment(&b); err == nil {
+		t.Fatalf("Expected an error recording the attachment")
+	}
+	exp := []string{"att-bug-1-a"}
+	if blob := blobs["abc"]; !reflect.DeepEqual(blob.Refs, exp) {
+		t.Errorf("Expected refs %v, got %+v", exp, blob)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("Deleted %v while a still refers to it", deleted)
+	}
+}
+
+func TestAlsoAttachedToAll(t *testing.T) {
+	defer withRoles(nil)()
+	defer withGroups()()
+
+	docs := map[string]interface{}{
+		"blob-abc": Blob{Id: "abc", Type: "blob",
+			Refs: []string{"att-bug-1-a", "att-bug-2-b", "att-bug-3-c",
+				"att-bug-1-d"}},
+		"blob-def":    Blob{Id: "def", Type: "blob", Refs: []string{"att-bug-1-e"}},
+		"att-bug-1-a": Attachment{Type: "attachment", BugId: "bug-1"},
+		"att-bug-2-b": Attachment{Type: "attachment", BugId: "bug-2"},
+		"att-bug-3-c": Attachment{Type: "attachment", BugId: "bug-3"},
+		"att-bug-1-d": Attachment{Type: "attachment", BugId: "bug-1"},
+		"att-bug-1-e": Attachment{Type: "attachment", BugId: "bug-1"},
+		"bug-1":       Bug{Id: "bug-1", Type: "bug"},
+		"bug-2":       Bug{Id: "bug-2", Type: "bug"},
+		"bug-3":       Bug{Id: "bug-3", Type: "bug", Private: true},
+	}
+	fetches := 0
+	origGet := getDocsBulk
+	defer func() { getDocsBulk = origGet }()
+	getDocsBulk = func(keys []string) (map[string][]byte, error) {
+		fetches++
+		rv := map[string][]byte{}
+		for _, k := range keys {
+			if d, ok := docs[k]; ok {
+				rv[k], _ = json.Marshal(d)
+			}
+		}
+		return rv, nil
+	}
+
+	atts := []Attachment{
+		{Id: "bug-1-a", BugId: "bug-1", Sha256: "abc"},
+		{Id: "bug-1-d", BugId: "bug-1", Sha256: "abc"},
+		{Id: "bug-1-e", BugId: "bug-1", Sha256: "def"},
+		{Id: "bug-1-old", BugId: "bug-1"},
+	}
+
+	got := alsoAttachedToAll(atts, User{Id: "plain@example.com"})
+	exp := map[string][]string{
+		"bug-1-a":   {"bug-2"},
+		"bug-1-d":   {"bug-2"},
+		"bug-1-e":   {},
+		"bug-1-old": {},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+	if fetches != 3 {
+		t.Errorf("Expected three bulk fetches, got %v", fetches)
+	}
+
+	got = alsoAttachedToAll(atts[:1], User{Id: "i@example.com", Internal: true})
+	if e := []string{"bug-2", "bug-3"}; !reflect.DeepEqual(got["bug-1-a"], e) {
+		t.Errorf("Expected %v for an internal user, got %v", e, got["bug-1-a"])
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultAuditLimit = 100
+
+var auditCollision = errors.New("audit entry id collision")
+
+// Record a security relevant or administrative action.  Entries are
+// only ever added, never changed or removed, so they outlive whatever
+// they describe (e.g. a deleted bug and its history).
+//
+// Actions are dotted names like "login", "token.create",
+// "bug.viewer.add" or "github.push".  The target is whatever was acted
+// on: a user's email, a bug id, a role or group name.
+func audit(r *http.Request, actor, action, target string,
+	detail map[string]interface{}) {
+
+	now := time.Now().UTC()
+	e := AuditEntry{
+		Id:     "audit-" + now.Format(time.RFC3339Nano) + "-" + randstring(6),
+		Type:   "audit",
+		Time:   now,
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+	if r != nil {
+		e.RemoteAddr = r.RemoteAddr
+	}
+
+	log.Printf("audit: %v %v %v %v", actor, action, target, detail)
+
+	maybeLog("recording audit entry", storeAuditEntry(e))
+}
+
+var storeAuditEntry = func(e AuditEntry) error {
+	added, err := db.Add(e.Id, 0, e)
+	if err == nil && !added {
+		err = auditCollision
+	}
+	return err
+}
+
+// View arguments for audit entries by actor or, failing that, target,
+// newest first, optionally bounded in time.
+func auditQueryArgs(actor, target string, since, until time.Time) map[string]interface{} {
+	kind, val := "*", ""
+	switch {
+	case actor != "":
+		kind, val = "actor", actor
+	case target != "":
+		kind, val = "target", target
+	}
+
+	var hi interface{} = map[string]string{}
+	if !until.IsZero() {
+		hi = until.UTC().Format(time.RFC3339Nano)
+	}
+	lo := ""
+	if !since.IsZero() {
+		lo = since.UTC().Format(time.RFC3339Nano)
+	}
+
+	return map[string]interface{}{
+		"stale":        false,
+		"descending":   true,
+		"include_docs": true,
+		"start_key":    []interface{}{kind, val, hi},
+		"end_key":      []interface{}{kind, val, lo},
+	}
+}
+
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func serveAuditLog(w http.ResponseWriter, r *http.Request) {
+	actor := r.FormValue("actor")
+	target := r.FormValue("target")
+
+	since, err := parseAuditTime(r.FormValue("since"))
+	if err != nil {
+		showError(w, r, "Invalid since: "+err.Error(), 400)
+		return
+	}
+	until, err := parseAuditTime(r.FormValue("until"))
+	if err != nil {
+		showError(w, r, "Invalid until: "+err.Error(), 400)
+		return
+	}
+
+	limit := defaultAuditLimit
+	if l := r.FormValue("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			showError(w, r, "Invalid limit: "+l, 400)
+			return
+		}
+	}
+
+	args := auditQueryArgs(actor, target, since, until)
+	// When filtering on both, the view gives us the actor's entries
+	// and we pick out the target's ourselves.
+	if actor == "" || target == "" {
+		args["limit"] = limit
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Doc struct {
+				Json AuditEntry
+			}
+		}
+	}{}
+
+	err = db.ViewCustom("cbugg", "audit", args, &viewRes)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	rv := []AuditEntry{}
+	for _, row := range viewRes.Rows {
+		e := row.Doc.Json
+		if target != "" && e.Target != target {
+			continue
+		}
+		rv = append(rv, e)
+		if len(rv) >= limit {
+			break
+		}
+	}
+
+	mustEncode(w, rv)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Collect audit entries in entries instead of storing them.
+func withAuditLog(entries *[]AuditEntry) func() {
+	origStore := storeAuditEntry
+	storeAuditEntry = func(e AuditEntry) error {
+		*entries = append(*entries, e)
+		return nil
+	}
+	return func() {
+		storeAuditEntry = origStore
+	}
+}
+
+func TestAuditQueryArgs(t *testing.T) {
+	since := time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2014, 3, 2, 12, 0, 0, 0, time.FixedZone("x", 3600))
+	open := map[string]string{}
+
+	tests := []struct {
+		actor, target string
+		since, until  time.Time
+		start, end    []interface{}
+	}{
+		{"", "", time.Time{}, time.Time{},
+			[]interface{}{"*", "", open}, []interface{}{"*", "", ""}},
+		{"a@example.com", "", time.Time{}, time.Time{},
+			[]interface{}{"actor", "a@example.com", open},
+			[]interface{}{"actor", "a@example.com", ""}},
+		{"a@example.com", "bug-1", since, time.Time{},
+			[]interface{}{"actor", "a@example.com", open},
+			[]interface{}{"actor", "a@example.com", "2014-03-01T00:00:00Z"}},
+		{"", "bug-1", since, until,
+			[]interface{}{"target", "bug-1", "2014-03-02T11:00:00Z"},
+			[]interface{}{"target", "bug-1", "2014-03-01T00:00:00Z"}},
+	}
+
+	for _, x := range tests {
+		args := auditQueryArgs(x.actor, x.target, x.since, x.until)
+		if !reflect.DeepEqual(args["start_key"], x.start) {
+			t.Errorf("start_key for %q/%q = %v, expected %v",
+				x.actor, x.target, args["start_key"], x.start)
+		}
+		if !reflect.DeepEqual(args["end_key"], x.end) {
+			t.Errorf("end_key for %q/%q = %v, expected %v",
+				x.actor, x.target, args["end_key"], x.end)
+		}
+		if args["descending"] != true {
+			t.Errorf("Expected newest first, got %v", args)
+		}
+	}
+}
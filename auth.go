@@ -1,24 +1,21 @@
 package main
 
 import (
-	"bytes"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"log"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/gorilla/securecookie"
 )
 
-const (
-	BROWSERID_ENDPOINT = "https://verifier.login.persona.org/verify"
-	AUTH_COOKIE        = "cbugger"
-)
+const AUTH_COOKIE = "cbugger"
 
+// The contents of the auth cookie.  This is named after the BrowserID
+// verifier response it originally held.  Only cookies naming a live
+// session are accepted.
 type browserIdData struct {
 	Status   string
 	Reason   string
@@ -26,6 +23,7 @@ type browserIdData struct {
 	Audience string
 	Expires  uint64
 	Issuer   string
+	Session  string
 }
 
 var secureCookie *securecookie.SecureCookie
@@ -38,9 +36,12 @@ func userFromCookie(cookie string) (User, error) {
 	val := browserIdData{}
 	err := secureCookie.Decode("user", cookie, &val)
 	if err == nil {
-		u, err := getUser(val.Email)
-		if err != nil {
-			u.Id = val.Email
+		err = checkSession(val.Session, val.Email)
+	}
+	if err == nil {
+		u := userForEmail(val.Email)
+		if u.Deactivated {
+			return User{}, accountDeactivated
 		}
 		return u, nil
 	} else {
@@ -57,145 +58,121 @@ func whoami(r *http.Request) User {
 			return u
 		}
 	}
-	if ahdr := r.Header.Get("Authorization"); ahdr != "" {
-		parts := strings.Split(ahdr, " ")
-		if len(parts) < 2 {
-			return User{}
-		}
-		decoded, err := base64.StdEncoding.DecodeString(parts[1])
-		if err != nil {
-			return User{}
-		}
-		userpass := strings.SplitN(string(decoded), ":", 2)
-
-		user, err := getUser(userpass[0])
-		if err != nil {
-			return User{}
-		}
-
-		if user.AuthToken == userpass[1] {
-			u, err := getUser(userpass[0])
-			if err != nil {
-				u.Id = userpass[0]
-				u.Type = "user"
-			}
+	if user, pass, ok := basicAuthCredentials(r); ok {
+		if u, ok := userFromToken(r, user, pass); ok {
 			return u
 		}
 	}
 	return User{}
 }
 
+func basicAuthCredentials(r *http.Request) (string, string, bool) {
+	ahdr := r.Header.Get("Authorization")
+	if ahdr == "" {
+		return "", "", false
+	}
+	parts := strings.Split(ahdr, " ")
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+	userpass := strings.SplitN(string(decoded), ":", 2)
+	if len(userpass) < 2 {
+		return "", "", false
+	}
+	return userpass[0], userpass[1], true
+}
+
 func md5string(i string) string {
 	h := md5.New()
 	h.Write([]byte(i))
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func performAuth(w http.ResponseWriter, r *http.Request) {
-	assertion := r.FormValue("assertion")
-	if assertion == "" {
-		showError(w, r, "No assertion requested.", 400)
-		return
-	}
-	data := map[string]string{
-		"assertion": assertion,
-		"audience":  r.FormValue("audience"),
-	}
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
 
-	body, err := json.Marshal(&data)
-	if err != nil {
-		showError(w, r, "Error encoding request: "+err.Error(), 500)
+	if r.Method == "GET" && me.Id != "" {
+		http.Redirect(w, r, safeReturnPath(r.FormValue("return")), 303)
 		return
 	}
 
-	req, err := http.NewRequest("POST", BROWSERID_ENDPOINT,
-		bytes.NewReader(body))
-	if err != nil {
-		panic(err)
-	}
-
-	req.ContentLength = int64(len(body))
-	req.Header.Set("Content-Type", "application/json")
-
-	res, err := http.DefaultClient.Do(req)
+	// A POST without credentials asks who is logged in.
+	if r.Method == "POST" && r.FormValue("username") == "" {
+		if me.Id == "" {
+			showError(w, r, "You are not logged in", 401)
+			return
+		}
 
-	if err != nil {
-		showError(w, r, "Error transmitting request: "+err.Error(), 500)
+		mustEncode(w, map[string]interface{}{
+			"email":  me.Id,
+			"handle": handleFor(me.Id),
+			"prefs":  me.Prefs,
+			"locale": me.Locale,
+		})
 		return
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode != 200 {
-		showError(w, r, "Invalid response code from browserid: "+res.Status, 500)
+	p, ok := findAuthProvider(r.FormValue("provider"))
+	if !ok {
+		showError(w, r, "No such login provider", 400)
 		return
 	}
 
-	resdata := browserIdData{}
-
-	d := json.NewDecoder(res.Body)
-	err = d.Decode(&resdata)
-	if err != nil {
-		showError(w, r, "Error decoding browserid response: "+err.Error(), 500)
+	username := r.FormValue("username")
+	if username != "" && !authAttemptAllowed(w, r, username) {
 		return
 	}
 
-	if resdata.Status != "okay" {
-		showError(w, r, "Browserid status was not OK: "+
-			resdata.Status+"/"+resdata.Reason, 500)
+	res, err := p.Login(w, r)
+	switch {
+	case err == badCredentials:
+		noteAuthFailure(r, username)
+		audit(r, r.FormValue("username"), "login.failed",
+			r.FormValue("username"),
+			map[string]interface{}{"provider": p.Name()})
+		showError(w, r, err.Error(), 401)
 		return
-	}
-
-	if time.Now().Unix()*1000 >= int64(resdata.Expires) {
-		log.Printf("browserId assertion had expired as of %v",
-			resdata.Expires)
-		showError(w, r, "Browserid assertion is expired", 500)
+	case err == passwordNotPosted:
+		showError(w, r, err.Error(), 405)
+		return
+	case err != nil:
+		log.Printf("Error logging in with %v: %v", p.Name(), err)
+		showError(w, r, err.Error(), 500)
+		return
+	case res.Email == "":
+		// The provider took care of the response.
 		return
 	}
 
-	encoded, err := secureCookie.Encode("user", resdata)
+	err = completeLogin(w, r, res)
 	if err != nil {
-		showError(w, r, "Couldn't encode cookie: "+err.Error(), 500)
+		showError(w, r, err.Error(), errorCode(err))
 		return
 	}
 
-	cookie := &http.Cookie{
-		Name:  AUTH_COOKIE,
-		Value: encoded,
-		Path:  "/",
+	u, err := getUser(res.Email)
+	if err != nil {
+		u.Id = res.Email
 	}
-	http.SetCookie(w, cookie)
-
-	log.Printf("Logged in %v", resdata.Email)
-
-	user, err := getUser(resdata.Email)
 	mustEncode(w, map[string]interface{}{
-		"email":    resdata.Email,
-		"emailmd5": md5string(resdata.Email),
-		"prefs":    user.Prefs,
+		"email":  u.Id,
+		"handle": handleFor(u.Id),
+		"prefs":  u.Prefs,
+		"locale": u.Locale,
 	})
 }
 
-func serveLogin(w http.ResponseWriter, r *http.Request) {
-	me := whoami(r)
-
-	if me.Id == "" {
-		performAuth(w, r)
-	} else {
-		log.Printf("Reusing existing thing: %v", me.Id)
-		mustEncode(w, map[string]interface{}{
-			"email":    me.Id,
-			"emailmd5": md5string(me.Id),
-			"prefs":    me.Prefs,
-		})
-	}
-}
-
 func serveLogout(w http.ResponseWriter, r *http.Request) {
-	cookie := &http.Cookie{
-		Name:  AUTH_COOKIE,
-		Value: "",
-		Path:  "/",
+	if id := currentSession(r); id != "" {
+		maybeLog("ending session", deleteSession(id))
+		me := whoami(r)
+		audit(r, me.Id, "logout", me.Id,
+			map[string]interface{}{"session": id})
 	}
 
-	http.SetCookie(w, cookie)
+	clearAuthCookie(w)
 }
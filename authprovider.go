@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var authProviders = flag.String("authProviders", "oidc",
+	"comma separated login providers to enable (oidc, local, ldap); "+
+		"the first is the default")
+
+var badCredentials = errors.New("Invalid username or password")
+var accountDeactivated = errors.New("This account has been deactivated")
+var passwordNotPosted = errors.New("Passwords must be sent in a POST")
+
+// The outcome of a successful login.  Internal and Admin are set when
+// the provider knows the user's group membership and should override
+// what's on the user document.
+type AuthResult struct {
+	Email    string
+	Internal *bool
+	Admin    *bool
+}
+
+// A way of logging users in.
+//
+// Login either authenticates the request and returns who it is, or
+// takes over the response (e.g. redirecting to an external identity
+// provider) and returns a zero AuthResult and no error.
+type AuthProvider interface {
+	Name() string
+	Login(w http.ResponseWriter, r *http.Request) (AuthResult, error)
+}
+
+var knownAuthProviders = map[string]AuthProvider{
+	"oidc":  oidcProvider{},
+	"local": localProvider{},
+	"ldap":  ldapProvider{},
+}
+
+// Get the username and password from a login request, refusing any
+// that would have the password end up in a URL.
+func passwordCredentials(r *http.Request) (string, string, error) {
+	if r.Method != "POST" {
+		return "", "", passwordNotPosted
+	}
+	return r.PostFormValue("username"), r.PostFormValue("password"), nil
+}
+
+func enabledAuthProviders() []string {
+	rv := []string{}
+	for _, p := range strings.Split(*authProviders, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			rv = append(rv, p)
+		}
+	}
+	return rv
+}
+
+// Find the named enabled provider, or the default one if name is empty.
+func findAuthProvider(name string) (AuthProvider, bool) {
+	enabled := enabledAuthProviders()
+	if len(enabled) == 0 {
+		return nil, false
+	}
+	if name == "" {
+		name = enabled[0]
+	}
+	if !contains(enabled, name) {
+		return nil, false
+	}
+	p, ok := knownAuthProviders[name]
+	return p, ok
+}
+
+// Apply any group mapping to the user's document, start a session and
+// hand the browser its auth cookie.
+func completeLogin(w http.ResponseWriter, r *http.Request, res AuthResult) error {
+	res.Email = canonicalEmail(res.Email)
+	if userForEmail(res.Email).Deactivated {
+		audit(r, res.Email, "login.deactivated", res.Email, nil)
+		return accountDeactivated
+	}
+
+	if res.Internal != nil || res.Admin != nil {
+		err := db.Update("u-"+res.Email, 0, func(current []byte) ([]byte, error) {
+			user := User{}
+			if len(current) > 0 {
+				err := json.Unmarshal(current, &user)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// Common fields
+			user.Id = res.Email
+			user.Type = "user"
+
+			if res.Internal != nil {
+				user.Internal = *res.Internal
+			}
+			if res.Admin != nil {
+				user.Admin = *res.Admin
+			}
+
+			return json.Marshal(user)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	s, err := newSession(res.Email, r.UserAgent())
+	if err != nil {
+		return err
+	}
+
+	encoded, err := secureCookie.Encode("user", browserIdData{
+		Status:  "okay",
+		Email:   res.Email,
+		Expires: uint64(s.ExpiresAt.Unix() * 1000),
+		Session: s.Id,
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     AUTH_COOKIE,
+		Value:    encoded,
+		Path:     "/",
+		MaxAge:   int(s.ExpiresAt.Sub(s.CreatedAt).Seconds()),
+		HttpOnly: true,
+	})
+
+	detail := map[string]interface{}{"session": s.Id}
+	if res.Internal != nil {
+		detail["internal"] = *res.Internal
+	}
+	if res.Admin != nil {
+		detail["admin"] = *res.Admin
+	}
+	audit(r, res.Email, "login", res.Email, detail)
+
+	log.Printf("Logged in %v", res.Email)
+	return nil
+}
+
+func serveAuthProviders(w http.ResponseWriter, r *http.Request) {
+	mustEncode(w, enabledAuthProviders())
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+func (a Away) at(t time.Time) bool {
+	return !t.Before(a.From) && t.Before(a.Until)
+}
+
+const awayCacheTime = 30 * time.Second
+
+var (
+	invalidAwayPeriod = errors.New("away periods need an until after from")
+	invalidDelegate   = errors.New("invalid delegate")
+)
+
+var awayCache = struct {
+	sync.Mutex
+	away    map[string]Away
+	fetched time.Time
+}{}
+
+var loadAway = func() (map[string]Away, error) {
+	args := map[string]interface{}{
+		"stale": false,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Key   string
+			Value Away
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "away", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]Away{}
+	for _, row := range viewRes.Rows {
+		rv[row.Key] = row.Value
+	}
+	return rv, nil
+}
+
+func getAway() map[string]Away {
+	awayCache.Lock()
+	defer awayCache.Unlock()
+
+	if awayCache.away != nil &&
+		time.Since(awayCache.fetched) < awayCacheTime {
+		return awayCache.away
+	}
+
+	away, err := loadAway()
+	if err != nil {
+		log.Printf("Error loading away users: %v", err)
+		if awayCache.away != nil {
+			return awayCache.away
+		}
+		return map[string]Away{}
+	}
+	awayCache.away = away
+	awayCache.fetched = time.Now()
+	return away
+}
+
+func forgetAway() {
+	awayCache.Lock()
+	defer awayCache.Unlock()
+	awayCache.away = nil
+}
+
+// Whether someone is away right now, and if so, until when and who's
+// covering.
+func awayNow(email string) (Away, bool) {
+	a, ok := getAway()[email]
+	if !ok || !a.at(time.Now()) {
+		return Away{}, false
+	}
+	return a, true
+}
+
+// Delegates of anyone in emails who is away, mapped to who they're
+// covering for.  Delegates already in emails are left out, as they're
+// hearing about it anyway.
+func delegatesFor(emails []string) map[string][]string {
+	rv := map[string][]string{}
+	for _, e := range emails {
+		a, ok := awayNow(e)
+		if ok && a.Delegate != "" && !contains(emails, a.Delegate) &&
+			!contains(rv[a.Delegate], e) {
+			rv[a.Delegate] = append(rv[a.Delegate], e)
+		}
+	}
+	return rv
+}
+
+// A warning for the actor when they hand something to someone away.
+func awayWarning(email string) []string {
+	a, ok := awayNow(email)
+	if !ok {
+		return nil
+	}
+	msg := fmt.Sprintf("%v is away until %v", displayNameFor(email),
+		a.Until.Format("Mon 2 Jan"))
+	if a.Delegate != "" {
+		msg += ", " + displayNameFor(a.Delegate) + " is covering"
+	}
+	return []string{msg}
+}
+
+func parseAwayTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Build an away period from a form, checking it makes sense for email.
+func awayFromForm(email string, from, until, delegate string) (Away, error) {
+	a := Away{Delegate: resolvePrincipal(delegate)}
+
+	var err error
+	a.From, err = parseAwayTime(from, time.Now().UTC())
+	if err != nil {
+		return a, err
+	}
+	a.Until, err = parseAwayTime(until, time.Time{})
+	if err != nil {
+		return a, err
+	}
+	if !a.Until.After(a.From) {
+		return a, invalidAwayPeriod
+	}
+	// Delegates are people, and not the person going away.
+	if a.Delegate != "" && (a.Delegate == email ||
+		!strings.Contains(a.Delegate, "@") ||
+		userForEmail(a.Delegate).Deactivated) {
+		return a, invalidDelegate
+	}
+	return a, nil
+}
+
+func setMyAway(me User, a *Away) error {
+	err := db.Update("u-"+me.Id, 0, func(current []byte) ([]byte, error) {
+		user := User{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &user)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Common fields
+		user.Id = me.Id
+		user.Type = "user"
+
+		user.Away = a
+
+		return json.Marshal(user)
+	})
+	forgetAway()
+	return err
+}
+
+func awayJSON(email string) map[string]interface{} {
+	rv := map[string]interface{}{"away": false}
+	if a, ok := getAway()[email]; ok {
+		rv["from"] = a.From
+		rv["until"] = a.Until
+		rv["away"] = a.at(time.Now())
+		if a.Delegate != "" {
+			rv["delegate"] = Email(a.Delegate)
+		}
+	}
+	return rv
+}
+
+func serveMyAway(w http.ResponseWriter, r *http.Request) {
+	mustEncode(w, awayJSON(whoami(r).Id))
+}
+
+func serveSetMyAway(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
+	a, err := awayFromForm(me.Id, r.FormValue("from"),
+		r.FormValue("until"), r.FormValue("delegate"))
+	if err != nil {
+		showError(w, r, err.Error(), 400)
+		return
+	}
+
+	err = setMyAway(me, &a)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	mustEncode(w, awayJSON(me.Id))
+}
+
+func serveClearMyAway(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
+	err := setMyAway(me, nil)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	mustEncode(w, awayJSON(me.Id))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func withAway(away map[string]Away) func() {
+	origLoad := loadAway
+	loadAway = func() (map[string]Away, error) {
+		return away, nil
+	}
+	forgetAway()
+	return func() {
+		loadAway = origLoad
+		forgetAway()
+	}
+}
+
+func TestDelegatesFor(t *testing.T) {
+	defer withDisplayNames(map[string]string{})()
+
+	now := time.Now()
+	defer withAway(map[string]Away{
+		"a@x": {now.Add(-time.Hour), now.Add(time.Hour), "b@x"},
+		"c@x": {now.Add(time.Hour), now.Add(2 * time.Hour), "d@x"},
+		"e@x": {now.Add(-time.Hour), now.Add(time.Hour), ""},
+		"f@x": {now.Add(-time.Hour), now.Add(time.Hour), "a@x"},
+		"g@x": {now.Add(-time.Hour), now.Add(time.Hour), "b@x"},
+	})()
+
+	tests := []struct {
+		in  []string
+		exp map[string][]string
+	}{
+		{[]string{"a@x"}, map[string][]string{"b@x": {"a@x"}}},
+		// Not away yet.
+		{[]string{"c@x"}, map[string][]string{}},
+		// Away without a delegate.
+		{[]string{"e@x"}, map[string][]string{}},
+		// The delegate is getting it anyway.
+		{[]string{"a@x", "b@x"}, map[string][]string{}},
+		{[]string{"f@x", "a@x"}, map[string][]string{"b@x": {"a@x"}}},
+		// Covering for two people means hearing about both.
+		{[]string{"a@x", "g@x", "a@x"}, map[string][]string{"b@x": {"a@x", "g@x"}}},
+		{[]string{"z@x"}, map[string][]string{}},
+	}
+
+	for _, x := range tests {
+		got := delegatesFor(x.in)
+		if !reflect.DeepEqual(got, x.exp) {
+			t.Errorf("delegatesFor(%v) = %v, expected %v", x.in, got, x.exp)
+		}
+	}
+
+	if w := awayWarning("a@x"); len(w) != 1 {
+		t.Errorf("Expected a warning for a@x, got %v", w)
+	}
+	if w := awayWarning("c@x"); w != nil {
+		t.Errorf("Expected no warning for c@x, got %v", w)
+	}
+}
+
+func TestAwayFromForm(t *testing.T) {
+	defer withAliases(map[string]string{})()
+
+	tests := []struct {
+		from, until, delegate string
+		err                   bool
+	}{
+		{"", "", "", true},
+		{"2014-01-02", "2014-01-01", "", true},
+		{"2014-01-02", "2014-01-02", "", true},
+		{"bogus", "2014-01-03", "", true},
+		{"2014-01-02", "2014-01-03T12:00:00Z", "", false},
+		{"2014-01-02", "2014-01-03", "a@x", true},
+		{"2014-01-02", "2014-01-03", "group:devs", true},
+	}
+
+	for _, x := range tests {
+		_, err := awayFromForm("a@x", x.from, x.until, x.delegate)
+		if (err != nil) != x.err {
+			t.Errorf("awayFromForm(%q, %q, %q) = %v, expected error: %v",
+				x.from, x.until, x.delegate, err, x.err)
+		}
+	}
+}
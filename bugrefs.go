@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/couchbaselabs/go-couchbase"
+	"github.com/dustin/gomemcached"
+)
+
+var bugMentionRE = regexp.MustCompile(`\bbug-\d+\b`)
+
+// Find the distinct bug ids referenced in some text.
+func findBugRefs(text string) []string {
+	rv := []string{}
+	seen := map[string]bool{}
+	for _, b := range bugMentionRE.FindAllString(text, -1) {
+		if !seen[b] {
+			seen[b] = true
+			rv = append(rv, b)
+		}
+	}
+	return rv
+}
+
+// Record that the bugs referenced in text are referenced from bugid.
+// A reference from private text stays private until the same bug is
+// referenced publicly.
+func recordBugRefs(bugid, text string, private bool) {
+	for _, target := range findBugRefs(text) {
+		if target == bugid {
+			continue
+		}
+		maybeLog("recording reference from "+bugid+" to "+target,
+			addBugRef(target, bugid, private))
+	}
+}
+
+var addBugRef = func(target, from string, private bool) error {
+	b, err := getBug(target)
+	if err != nil {
+		return err
+	}
+	if b.Type != "bug" {
+		return fmt.Errorf("Expected a bug, got %v", b.Type)
+	}
+
+	return db.Update("bugref-"+target+"-"+from, 0, func(current []byte) ([]byte, error) {
+		ref := BugRef{
+			BugId:     target,
+			From:      from,
+			Type:      "bugref",
+			Private:   private,
+			CreatedAt: time.Now().UTC(),
+		}
+		if len(current) > 0 {
+			old := BugRef{}
+			err := json.Unmarshal(current, &old)
+			if err != nil {
+				return nil, err
+			}
+			ref.CreatedAt = old.CreatedAt
+			ref.Private = old.Private && private
+		}
+
+		return json.Marshal(ref)
+	})
+}
+
+// Some text on a bug, and whether it's private.
+type bugText struct {
+	Text    string
+	Private bool
+}
+
+// The description and comments of a bug.
+var loadBugTexts = func(bugid string) ([]bugText, error) {
+	b, err := getBug(bugid)
+	if err != nil {
+		return nil, err
+	}
+
+	args := map[string]interface{}{
+		"stale":        false,
+		"start_key":    []interface{}{bugid},
+		"end_key":      []interface{}{bugid, map[string]string{}},
+		"include_docs": true,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Doc struct {
+				Json Comment
+			}
+		}
+	}{}
+
+	err = db.ViewCustom("cbugg", "comments", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []bugText{{b.Description, false}}
+	for _, row := range viewRes.Rows {
+		c := row.Doc.Json
+		if c.Type == "comment" {
+			rv = append(rv, bugText{c.Text, c.Private})
+		}
+	}
+	return rv, nil
+}
+
+// Bring a reference up to date with what mentions it: gone if nothing
+// does, and private if only private text does.
+var refreshBugRef = func(target, from string, mentioned, private bool) error {
+	k := "bugref-" + target + "-" + from
+	if !mentioned {
+		err := db.Delete(k)
+		if gomemcached.IsNotFound(err) {
+			err = nil
+		}
+		return err
+	}
+	err := db.Update(k, 0, func(current []byte) ([]byte, error) {
+		if len(current) == 0 {
+			return nil, couchbase.UpdateCancel
+		}
+		ref := BugRef{}
+		err := json.Unmarshal(current, &ref)
+		if err != nil {
+			return nil, err
+		}
+		if ref.Private == private {
+			return nil, couchbase.UpdateCancel
+		}
+		ref.Private = private
+		return json.Marshal(ref)
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+// Update the references from bugid after some text on it changed from
+// oldText to text.  Bugs that were mentioned before but not now lose
+// their reference unless something else on bugid still mentions them.
+func updateBugRefs(bugid, oldText, text string, private bool) {
+	recordBugRefs(bugid, text, private)
+
+	mentions := findBugRefs(text)
+	dropped := []string{}
+	for _, target := range findBugRefs(oldText) {
+		if target != bugid && !contains(mentions, target) {
+			dropped = append(dropped, target)
+		}
+	}
+	if len(dropped) == 0 {
+		return
+	}
+
+	texts, err := loadBugTexts(bugid)
+	if err != nil {
+		log.Printf("Error getting text of %v to update references: %v",
+			bugid, err)
+		return
+	}
+
+	for _, target := range dropped {
+		mentioned, onlyPrivate := false, true
+		for _, t := range texts {
+			if contains(findBugRefs(t.Text), target) {
+				mentioned = true
+				onlyPrivate = onlyPrivate && t.Private
+			}
+		}
+		maybeLog("updating reference from "+bugid+" to "+target,
+			refreshBugRef(target, bugid, mentioned, onlyPrivate))
+	}
+}
+
+// Get the bugs referring to the given bug that the user can see,
+// along with the time of the most recent one.
+func getBugReferences(bugid string, u User) ([]map[string]interface{}, time.Time, error) {
+	args := map[string]interface{}{
+		"stale":     false,
+		"start_key": []interface{}{bugid},
+		"end_key":   []interface{}{bugid, map[string]string{}},
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Value BugRef
+		}
+	}{}
+
+	rv := []map[string]interface{}{}
+	latest := time.Time{}
+
+	err := db.ViewCustom("cbugg", "bug_refs", args, &viewRes)
+	if err != nil {
+		return rv, latest, err
+	}
+
+	for _, row := range viewRes.Rows {
+		ref := row.Value
+		if !isVisible(ref, u) {
+			continue
+		}
+		from, err := getBugFor(ref.From, u)
+		if err != nil {
+			continue
+		}
+		rv = append(rv, map[string]interface{}{
+			"id":     from.Id,
+			"title":  from.Title,
+			"status": from.Status,
+		})
+		if ref.CreatedAt.After(latest) {
+			latest = ref.CreatedAt
+		}
+	}
+
+	return rv, latest, nil
+}
+
+type APIBugDetail struct {
+	APIBug
+	ReferencedBy []map[string]interface{}
+}
+
+func (b APIBugDetail) MarshalJSON() ([]byte, error) {
+	d, err := json.Marshal(b.APIBug)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	err = json.Unmarshal(d, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	m["referenced_by"] = b.ReferencedBy
+	return json.Marshal(m)
+}
+
+func bugDetailFor(bug Bug, u User) (APIBugDetail, time.Time) {
+	refs, latest, err := getBugReferences(bug.Id, u)
+	if err != nil {
+		log.Printf("Error getting references to %v: %v", bug.Id, err)
+	}
+	if bug.ModifiedAt.After(latest) {
+		latest = bug.ModifiedAt
+	}
+	return APIBugDetail{APIBug(bug), refs}, latest
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFindBugRefs(t *testing.T) {
+	tests := []struct {
+		In  string
+		Exp []string
+	}{
+		{"", []string{}},
+		{"see bug-12", []string{"bug-12"}},
+		{"bug-12, bug-3 and bug-12 again", []string{"bug-12", "bug-3"}},
+		{"/bug/bug-7.", []string{"bug-7"}},
+		{"debug-12 isn't one", []string{}},
+		{"bug-12x isn't either", []string{}},
+		{"bug- nope", []string{}},
+	}
+
+	for _, x := range tests {
+		got := findBugRefs(x.In)
+		if !reflect.DeepEqual(got, x.Exp) {
+			t.Errorf("On %q, expected %v, got %v", x.In, x.Exp, got)
+		}
+	}
+}
+
+func TestBugRefVisibility(t *testing.T) {
+	defer withRoles(nil)()
+	defer withGroups()()
+
+	internalUser := User{Id: "internal user", Internal: true}
+	externalUser := User{Id: "external user"}
+
+	tests := []struct {
+		u      User
+		ob     BugRef
+		result bool
+	}{
+		{internalUser, BugRef{Private: true}, true},
+		{internalUser, BugRef{}, true},
+		{externalUser, BugRef{Private: true}, false},
+		{externalUser, BugRef{}, true},
+	}
+
+	for _, x := range tests {
+		if isVisible(x.ob, x.u) != x.result {
+			t.Errorf("isVisible(%+v, %+v), expected %v, got %v",
+				x.ob, x.u, x.result, isVisible(x.ob, x.u))
+		}
+	}
+}
+
+// Keep references in refs, by target and from, and take a bug's text
+// from texts, instead of using the database.
+func withBugRefs(refs map[string]BugRef, texts map[string][]bugText) func() {
+	origAdd, origLoad, origRefresh := addBugRef, loadBugTexts, refreshBugRef
+	addBugRef = func(target, from string, private bool) error {
+		ref, ok := refs[target+"-"+from]
+		if ok {
+			private = ref.Private && private
+		}
+		refs[target+"-"+from] = BugRef{BugId: target, From: from,
+			Type: "bugref", Private: private}
+		return nil
+	}
+	loadBugTexts = func(bugid string) ([]bugText, error) {
+		return texts[bugid], nil
+	}
+	refreshBugRef = func(target, from string, mentioned, private bool) error {
+		k := target + "-" + from
+		if _, ok := refs[k]; !ok {
+			return nil
+		}
+		if !mentioned {
+			delete(refs, k)
+			return nil
+		}
+		ref := refs[k]
+		ref.Private = private
+		refs[k] = ref
+		return nil
+	}
+	return func() {
+		addBugRef, loadBugTexts, refreshBugRef = origAdd, origLoad, origRefresh
+	}
+}
+
+func TestUpdateBugRefs(t *testing.T) {
+	refs := map[string]BugRef{}
+	texts := map[string][]bugText{}
+	defer withBugRefs(refs, texts)()
+
+	keys := func() []string {
+		rv := []string{}
+		for k := range refs {
+			rv = append(rv, k)
+		}
+		sort.Strings(rv)
+		return rv
+	}
+
+	// The description mentions bug-2 and bug-3; a private comment
+	// mentions bug-3 and bug-4.
+	recordBugRefs("bug-1", "see bug-2 and bug-3", false)
+	recordBugRefs("bug-1", "also bug-3 and bug-4", true)
+
+	// The description is edited to drop bug-2 and bug-3.
+	texts["bug-1"] = []bugText{{"see bug-5", false},
+		{"also bug-3 and bug-4", true}}
+	updateBugRefs("bug-1", "see bug-2 and bug-3", "see bug-5", false)
+
+	exp := []string{"bug-3-bug-1", "bug-4-bug-1", "bug-5-bug-1"}
+	if got := keys(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Expected refs %v, got %v", exp, got)
+	}
+	// Only private text mentions bug-3 now.
+	if !refs["bug-3-bug-1"].Private || refs["bug-5-bug-1"].Private {
+		t.Errorf("Unexpected privacy: %+v", refs)
+	}
+
+	// The comment is edited to drop everything.
+	texts["bug-1"] = []bugText{{"see bug-5", false}, {"never mind", true}}
+	updateBugRefs("bug-1", "also bug-3 and bug-4", "never mind", true)
+	exp = []string{"bug-5-bug-1"}
+	if got := keys(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected refs %v, got %v", exp, got)
+	}
+}
@@ -30,6 +30,15 @@ func serveNewBug(w http.ResponseWriter, r *http.Request) {
 
 	me := whoami(r)
 
+	if err := checkTags(r.Form["tag"]); err != nil {
+		showError(w, r, err.Error(), 400)
+		return
+	}
+	if err := checkDeprecatedTags(r.Form["tag"]); err != nil {
+		showError(w, r, err.Error(), 400)
+		return
+	}
+
 	id, err := newBugId()
 	if err != nil {
 		showError(w, r, err.Error(), 500)
@@ -69,10 +78,16 @@ func serveNewBug(w http.ResponseWriter, r *http.Request) {
 
 	notifyBugChange(bug.Id, "", me.Id)
 
+	recordBugRefs(bug.Id, bug.Description, false)
+
+	addWarnings(w, notifyMentions(bug, bug, bug.Description, "",
+		me.Id, "bug"))
+	addWarnings(w, autoAssign(bug, bug.Tags, me))
+
 	http.Redirect(w, r, bug.Url(), 303)
 }
 
-func getBug(bugid string) (Bug, error) {
+var getBug = func(bugid string) (Bug, error) {
 	bug := Bug{}
 	err := db.Get(bugid, &bug)
 	return bug, err
@@ -113,13 +128,15 @@ func serveBugHistory(w http.ResponseWriter, r *http.Request) {
 }
 
 func serveBug(w http.ResponseWriter, r *http.Request) {
-	bug, err := getBugOrDisplayErr(mux.Vars(r)["bugid"], whoami(r), w, r)
+	me := whoami(r)
+	bug, err := getBugOrDisplayErr(mux.Vars(r)["bugid"], me, w, r)
 	if err != nil {
 		return
 	}
 
-	if !checkLastModified(w, r, bug.ModifiedAt) {
-		mustEncode(w, APIBug(bug))
+	detail, modtime := bugDetailFor(bug, me)
+	if !checkLastModified(w, r, modtime) {
+		mustEncode(w, detail)
 	}
 }
 
@@ -179,10 +196,12 @@ func newTags(o, n string) []string {
 	return out
 }
 
-func updateBug(id, field, val string, me User) ([]byte, error) {
+func updateBug(id, field, val string, me User) ([]byte, []string, error) {
 	now := time.Now().UTC()
 	rval := []byte{}
 	var oldval string
+	var updated Bug
+	var warnings []string
 
 	historyKey := id + "-" + now.Format(time.RFC3339Nano)
 
@@ -237,21 +256,20 @@ func updateBug(id, field, val string, me User) ([]byte, error) {
 			bug.Owner = val
 
 			// Ensure the owner is subscribed
-			if strings.Contains(val, "@") {
+			if strings.Contains(val, "@") || isGroupPrincipal(val) {
 				bug.Subscribers = removeFromList(bug.Subscribers, val)
 				bug.Subscribers = append(bug.Subscribers, val)
 			}
 		case "tags":
 			history.Tags = bug.Tags
 			oldval = strings.Join(bug.Tags, ",")
-			bug.Tags = strings.FieldsFunc(val,
-				func(r rune) bool {
-					switch r {
-					case ',', ' ':
-						return true
-					}
-					return false
-				})
+			tags := splitTags(val)
+			err := checkDeprecatedTags(
+				newTags(oldval, strings.Join(tags, ",")))
+			if err != nil {
+				return nil, err
+			}
+			bug.Tags = tags
 		default:
 			return nil, fmt.Errorf("Unhandled id: %v", field)
 		}
@@ -291,6 +309,7 @@ func updateBug(id, field, val string, me User) ([]byte, error) {
 		}
 
 		rval, err = json.Marshal(APIBug(bug))
+		updated = bug
 
 		return dbval, err
 	})
@@ -302,31 +321,83 @@ func updateBug(id, field, val string, me User) ([]byte, error) {
 			if val != me.Id {
 				notifyBugAssignment(id, val)
 			}
+			warnings = awayWarning(val)
 		} else if field == "tags" {
-			for _, newtag := range newTags(oldval, val) {
+			added := newTags(oldval, strings.Join(updated.Tags, ","))
+			for _, newtag := range added {
 				notifyTagAssigned(id, newtag, me.Id)
 			}
+			warnings = autoAssign(updated, added, me)
+		} else if field == "description" {
+			updateBugRefs(id, oldval, val, false)
+			warnings = notifyMentions(updated, updated,
+				val, oldval, me.Id, "bug")
 		}
 	case couchbase.UpdateCancel:
 		log.Printf("Ignoring identical update of %v", field)
 	default:
-		return nil, err
+		return nil, nil, err
 	}
 
-	return rval, nil
+	return rval, warnings, nil
+}
+
+// The permission needed to change a bug field.
+func bugFieldPermission(field string) string {
+	switch field {
+	case "status", "owner":
+		return permBugTriage
+	case "private":
+		return permPrivateManage
+	}
+	return permBugEdit
 }
 
 func serveBugUpdate(w http.ResponseWriter, r *http.Request) {
-	rval, err := updateBug(mux.Vars(r)["bugid"],
-		r.FormValue("id"),
-		r.FormValue("value"),
-		whoami(r))
+	me := whoami(r)
+	field := r.FormValue("id")
+
+	if !mayUpdateBugField(me, mux.Vars(r)["bugid"], field) {
+		showError(w, r, "You are not allowed to change the "+field, 403)
+		return
+	}
+
+	value := r.FormValue("value")
+	if field == "owner" {
+		value = resolvePrincipal(value)
+		if value != "" && userForEmail(value).Deactivated {
+			showError(w, r, value+" has been deactivated", 400)
+			return
+		}
+	}
+
+	if field == "tags" {
+		if err := checkTags(splitTags(value)); err != nil {
+			showError(w, r, err.Error(), 400)
+			return
+		}
+	}
+
+	rval, warnings, err := updateBug(mux.Vars(r)["bugid"],
+		field,
+		value,
+		me)
 
 	if err != nil {
-		showError(w, r, err.Error(), 500)
+		code := 500
+		if err == deprecatedTag {
+			code = 400
+		}
+		showError(w, r, err.Error(), code)
 		return
 	}
 
+	if field == "private" {
+		audit(r, me.Id, "bug.private", mux.Vars(r)["bugid"],
+			map[string]interface{}{"value": r.FormValue("value")})
+	}
+
+	addWarnings(w, warnings)
 	w.Write([]byte(rval))
 }
 
@@ -370,7 +441,7 @@ func serveBugList(w http.ResponseWriter, r *http.Request) {
 
 	if r.FormValue("user") != "" {
 		viewName = "owners"
-		u := r.FormValue("user")
+		u := resolvePrincipal(r.FormValue("user"))
 		startPre = []interface{}{u}
 	}
 
@@ -424,9 +495,20 @@ func serveBugList(w http.ResponseWriter, r *http.Request) {
 	mustEncode(w, results)
 }
 
-func serveSubscribeBug(w http.ResponseWriter, r *http.Request) {
-	err := updateSubscription(mux.Vars(r)["bugid"],
-		whoami(r).Id, true)
+// Subscribe or unsubscribe yourself or, with the group parameter, a
+// group you belong to.
+func serveBugSubscription(w http.ResponseWriter, r *http.Request, add bool) {
+	me := whoami(r)
+	who := me.Id
+	if g := r.FormValue("group"); g != "" {
+		who = groupPrincipal(g)
+		if !maySubscribeAs(me, who) {
+			showError(w, r, "You can't change this group's subscription", 403)
+			return
+		}
+	}
+
+	err := updateSubscription(mux.Vars(r)["bugid"], who, add)
 	if err != nil {
 		showError(w, r, err.Error(), 500)
 		return
@@ -435,15 +517,12 @@ func serveSubscribeBug(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(204)
 }
 
-func serveUnsubscribeBug(w http.ResponseWriter, r *http.Request) {
-	err := updateSubscription(mux.Vars(r)["bugid"],
-		whoami(r).Id, false)
-	if err != nil {
-		showError(w, r, err.Error(), 500)
-		return
-	}
+func serveSubscribeBug(w http.ResponseWriter, r *http.Request) {
+	serveBugSubscription(w, r, true)
+}
 
-	w.WriteHeader(204)
+func serveUnsubscribeBug(w http.ResponseWriter, r *http.Request) {
+	serveBugSubscription(w, r, false)
 }
 
 func updateBugAlsoVisible(bugid string, me User, email string, add bool) error {
@@ -485,9 +564,7 @@ func updateBugAlsoVisible(bugid string, me User, email string, add bool) error {
 			old := bug.AlsoVisibleTo
 			bug.AlsoVisibleTo = []string{}
 			for _, e := range old {
-				log.Printf("Checking %v (%v) = %v",
-					e, md5string(e), email)
-				if md5string(e) != email {
+				if e != email {
 					bug.AlsoVisibleTo = append(bug.AlsoVisibleTo, e)
 				}
 			}
@@ -509,13 +586,23 @@ func updateBugAlsoVisible(bugid string, me User, email string, add bool) error {
 
 func doBugVisibleUpdate(w http.ResponseWriter, r *http.Request, add bool) {
 	bugid := mux.Vars(r)["bugid"]
-	err := updateBugAlsoVisible(bugid, whoami(r),
-		r.FormValue("email"), add)
+	me := whoami(r)
+	email := resolvePrincipal(r.FormValue("email"))
+	err := updateBugAlsoVisible(bugid, me, email, add)
 	if err != nil && err != couchbase.UpdateCancel {
 		showError(w, r, err.Error(), 500)
 		return
 	}
 
+	if err == nil {
+		action := "bug.viewer.remove"
+		if add {
+			action = "bug.viewer.add"
+		}
+		audit(r, me.Id, action, bugid,
+			map[string]interface{}{"email": email})
+	}
+
 	bug, err := getBug(bugid)
 	if err != nil {
 		showError(w, r, err.Error(), 500)
@@ -542,7 +629,7 @@ func serveBugPing(w http.ResponseWriter, r *http.Request) {
 	}
 
 	from := me.Id
-	to := r.FormValue("to")
+	to := resolvePrincipal(r.FormValue("to"))
 	if !strings.Contains(to, "@") {
 		showError(w, r, "Invalid 'to' parameter", 400)
 		return
@@ -559,6 +646,7 @@ func serveBugPing(w http.ResponseWriter, r *http.Request) {
 	}
 
 	notifyBugPing(bug, from, to)
+	addWarnings(w, awayWarning(to))
 
 	now := time.Now().UTC()
 	pingid := "ping-" + id + "-" + now.Format(time.RFC3339Nano)
@@ -595,11 +683,15 @@ func deleteDocsMatching(ddoc, view string, args map[string]interface{},
 func serveBugDeletion(w http.ResponseWriter, r *http.Request) {
 	me := whoami(r)
 	bugid := mux.Vars(r)["bugid"]
-	_, err := getBugOrDisplayErr(bugid, me, w, r)
+	bug, err := getBugOrDisplayErr(bugid, me, w, r)
 	if err != nil {
 		return
 	}
 
+	// The bug's history goes with it, so this is all that's left.
+	audit(r, me.Id, "bug.delete", bugid, map[string]interface{}{
+		"title": bug.Title, "creator": bug.Creator, "private": bug.Private})
+
 	cherr := make(chan error)
 	deleted := make(chan couchbase.ViewRow)
 	delatt := make(chan couchbase.ViewRow)
@@ -625,6 +717,32 @@ func serveBugDeletion(w http.ResponseWriter, r *http.Request) {
 			"include_docs": true,
 		}, delatt, cherr, wg)
 
+	wg.Add(1)
+	go deleteDocsMatching("cbugg", "bug_refs",
+		map[string]interface{}{
+			"stale":     false,
+			"reduce":    false,
+			"start_key": []interface{}{bugid},
+			"end_key":   []interface{}{bugid, map[string]string{}},
+		}, deleted, cherr, wg)
+	wg.Add(1)
+	go deleteDocsMatching("cbugg", "bug_refs_from",
+		map[string]interface{}{
+			"stale":     false,
+			"reduce":    false,
+			"start_key": []interface{}{bugid},
+			"end_key":   []interface{}{bugid, map[string]string{}},
+		}, deleted, cherr, wg)
+
+	wg.Add(1)
+	go deleteDocsMatching("cbugg", "comment_history",
+		map[string]interface{}{
+			"stale":     false,
+			"reduce":    false,
+			"start_key": []interface{}{bugid},
+			"end_key":   []interface{}{bugid, map[string]string{}},
+		}, deleted, cherr, wg)
+
 	wg.Add(1)
 	go deleteDocsMatching("cbugg", "bug_history",
 		map[string]interface{}{
@@ -647,12 +765,17 @@ func serveBugDeletion(w http.ResponseWriter, r *http.Request) {
 		case del := <-delatt:
 			log.Printf("Deleted attachment %v", del.ID)
 			mo := (*del.Doc).(map[string]interface{})
-			mi := mo["json"].(map[string]interface{})
-			u := mi["url"].(string)
-			err := deleteAttachmentFile(u)
+			att := Attachment{}
+			j, err := json.Marshal(mo["json"])
+			if err == nil {
+				err = json.Unmarshal(j, &att)
+			}
+			if err == nil {
+				err = deleteAttachmentFile(att)
+			}
 			if err != nil {
 				log.Printf("Error deleting attachment %v: %v",
-					u, err)
+					del.ID, err)
 			}
 		case err, ok := <-cherr:
 			if !ok {
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func withBugs(bugs map[string]Bug) func() {
+	origGet := getBug
+	getBug = func(bugid string) (Bug, error) {
+		bug, ok := bugs[bugid]
+		if !ok {
+			return Bug{}, NotFound
+		}
+		return bug, nil
+	}
+	return func() {
+		getBug = origGet
+	}
+}
+
+func TestGetBugFor(t *testing.T) {
+	defer withRoles(nil)()
+	defer withGroups()()
+	defer withBugs(map[string]Bug{
+		"bug-1": {Id: "bug-1", Type: "bug"},
+		"bug-2": {Id: "bug-2", Type: "bug", Private: true},
+	})()
+
+	plain := User{Id: "plain@example.com"}
+	internal := User{Id: "i@example.com", Internal: true}
+
+	tests := []struct {
+		id  string
+		u   User
+		exp error
+	}{
+		{"bug-1", plain, nil},
+		{"bug-2", plain, bugNotVisible},
+		{"bug-2", internal, nil},
+		{"bug-3", internal, NotFound},
+	}
+
+	for _, x := range tests {
+		if _, err := getBugFor(x.id, x.u); err != x.exp {
+			t.Errorf("getBugFor(%v, %v) = %v, expected %v",
+				x.id, x.u.Id, err, x.exp)
+		}
+	}
+}
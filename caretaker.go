@@ -29,7 +29,7 @@ func moveOldInboxItems(t time.Time) error {
 
 	for _, row := range viewRes.Rows {
 		log.Printf("Moving %v from inbox to new", row.ID)
-		_, err = updateBug(row.ID, "status", "new",
+		_, _, err = updateBug(row.ID, "status", "new",
 			User{Id: *mailFrom, Internal: true, Admin: true})
 		if err != nil {
 			return err
@@ -95,6 +95,7 @@ func maybeLog(name string, err error) {
 func doPeriodicStuff(t time.Time) {
 	maybeLog("move inbox items", moveOldInboxItems(t))
 	maybeLog("process reminders", processReminders(t))
+	maybeLog("expire uploads", expireUploads(t))
 }
 
 func janitorize() {
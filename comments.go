@@ -2,19 +2,27 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
 
+	"github.com/couchbaselabs/go-couchbase"
 	"github.com/gorilla/mux"
 )
 
+var (
+	commentNotYours = errors.New("You can't change this comment")
+	commentDeleted  = errors.New("Deleted comments can't be changed")
+)
+
 func serveNewComment(w http.ResponseWriter, r *http.Request) {
 	me := whoami(r)
 	bugid := mux.Vars(r)["bugid"]
 
-	if _, err := getBugOrDisplayErr(bugid, me, w, r); err != nil {
+	bug, err := getBugOrDisplayErr(bugid, me, w, r)
+	if err != nil {
 		return
 	}
 
@@ -27,9 +35,21 @@ func serveNewComment(w http.ResponseWriter, r *http.Request) {
 		User:      me.Id,
 		Text:      r.FormValue("body"),
 		CreatedAt: time.Now().UTC(),
+		InReplyTo: r.FormValue("in_reply_to"),
 		Private:   r.FormValue("private") == "true",
 	}
 
+	if c.InReplyTo != "" {
+		parent, err := getComment(c.InReplyTo)
+		if err != nil || parent.Type != "comment" ||
+			parent.BugId != bugid || !isVisible(parent, me) {
+			showError(w, r, "Invalid in_reply_to: "+c.InReplyTo, 400)
+			return
+		}
+		// Don't let a reply expose a private conversation.
+		c.Private = c.Private || parent.Private
+	}
+
 	added, err := db.Add(c.Id, 0, c)
 	if err != nil {
 		showError(w, r, err.Error(), 500)
@@ -43,12 +63,16 @@ func serveNewComment(w http.ResponseWriter, r *http.Request) {
 
 	notifyComment(c)
 
+	recordBugRefs(bugid, c.Text, c.Private)
+
 	err = updateSubscription(bugid, me.Id, true)
 	if err != nil {
 		log.Printf("Error subscribing commenter %v to bug %v: %v",
 			me.Id, bugid, err)
 	}
 
+	addWarnings(w, notifyMentions(bug, c, c.Text, "", me.Id, "comment"))
+
 	mustEncode(w, APIComment(c))
 }
 
@@ -82,11 +106,6 @@ func serveCommentList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	type innerThing struct {
-		Type    string `json:"type"`
-		Private bool   `json:"private"`
-	}
-
 	// Below we mix comments and pings together for the "comment"
 	// UI, but we can't just pass the document body straight to
 	// the client because we want gravatars calculated and
@@ -94,34 +113,102 @@ func serveCommentList(w http.ResponseWriter, r *http.Request) {
 	// the type and then parse it into the correct target type.
 	rv := []interface{}{}
 	for _, row := range viewRes.Rows {
-		t := innerThing{}
-		err := json.Unmarshal([]byte(*row.Doc.Json), &t)
+		item, err := commentListItem([]byte(*row.Doc.Json), me)
 		if err != nil {
 			showError(w, r, err.Error(), 500)
 			return
 		}
+		if item != nil {
+			rv = append(rv, item)
+		}
+	}
 
-		var parseTo interface{}
+	if r.FormValue("threaded") == "true" {
+		mustEncode(w, threadComments(rv))
+		return
+	}
+
+	mustEncode(w, rv)
+}
+
+// Parse a comment or ping for the comment list, or return nil if it's
+// neither or the user can't see it.  Whether it's visible depends on
+// what's in it, so it's checked after the second parse.
+func commentListItem(doc []byte, me User) (interface{}, error) {
+	t := struct {
+		Type string `json:"type"`
+	}{}
+	err := json.Unmarshal(doc, &t)
+	if err != nil {
+		return nil, err
+	}
 
-		switch t.Type {
-		case "comment":
-			parseTo = &APIComment{}
-		case "ping":
-			parseTo = &APIPing{}
+	var parseTo interface{}
+
+	switch t.Type {
+	case "comment":
+		parseTo = &APIComment{}
+	case "ping":
+		parseTo = &APIPing{}
+	default:
+		return nil, nil
+	}
+
+	err = json.Unmarshal(doc, parseTo)
+	if err != nil || !isVisible(parseTo, me) {
+		return nil, err
+	}
+	return parseTo, nil
+}
+
+type commentThread struct {
+	Item    interface{}
+	Replies []*commentThread
+}
+
+func (t commentThread) MarshalJSON() ([]byte, error) {
+	d, err := json.Marshal(t.Item)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	err = json.Unmarshal(d, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	m["replies"] = t.Replies
+	return json.Marshal(m)
+}
+
+// Arrange a time ordered list of comments and pings into threads.
+// Replies to things that aren't in the list (e.g. not visible) are
+// moved to the top level.
+func threadComments(items []interface{}) []*commentThread {
+	nodes := map[string]*commentThread{}
+	for _, i := range items {
+		if c, ok := i.(*APIComment); ok {
+			nodes[c.Id] = &commentThread{i, []*commentThread{}}
 		}
+	}
 
-		if isVisible(parseTo, me) {
-			err = json.Unmarshal([]byte(*row.Doc.Json), parseTo)
-			if err != nil {
-				showError(w, r, err.Error(), 500)
-				return
-			}
+	rv := []*commentThread{}
+	for _, i := range items {
+		node := &commentThread{i, []*commentThread{}}
+		parent := ""
+		if c, ok := i.(*APIComment); ok {
+			node = nodes[c.Id]
+			parent = c.InReplyTo
+		}
 
-			rv = append(rv, parseTo)
+		if p, ok := nodes[parent]; ok && p != node {
+			p.Replies = append(p.Replies, node)
+		} else {
+			rv = append(rv, node)
 		}
 	}
 
-	mustEncode(w, rv)
+	return rv
 }
 
 func updateCommentDeleted(w http.ResponseWriter, r *http.Request, to bool) {
@@ -142,7 +229,7 @@ func updateCommentDeleted(w http.ResponseWriter, r *http.Request, to bool) {
 				comment.Type)
 		}
 
-		if !(me.Admin || comment.User == me.Id) {
+		if !(comment.User == me.Id || userCan(me, permBugDelete)) {
 			return nil, fmt.Errorf("You can only delete your own comments")
 		}
 
@@ -156,6 +243,13 @@ func updateCommentDeleted(w http.ResponseWriter, r *http.Request, to bool) {
 		return
 	}
 
+	action := "comment.undelete"
+	if to {
+		action = "comment.delete"
+	}
+	audit(r, me.Id, action, mux.Vars(r)["bugid"],
+		map[string]interface{}{"comment": mux.Vars(r)["commid"]})
+
 	w.WriteHeader(204)
 }
 
@@ -165,31 +259,146 @@ func getComment(commid string) (Comment, error) {
 	return comment, err
 }
 
+// Only the author of a comment may edit it, and only while it's not
+// deleted, or the edit would go out to everyone on the bug.
+func checkCommentEdit(c Comment, bugid string, me User) error {
+	if c.Type != "comment" || c.BugId != bugid || c.User != me.Id {
+		return commentNotYours
+	}
+	if c.Deleted {
+		return commentDeleted
+	}
+	return nil
+}
+
 func serveCommentUpdate(w http.ResponseWriter, r *http.Request) {
 	me := whoami(r)
+	bugid := mux.Vars(r)["bugid"]
 	commid := mux.Vars(r)["commid"]
 
+	bug, err := getBugOrDisplayErr(bugid, me, w, r)
+	if err != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	historyKey := commid + "-" + now.Format(time.RFC3339Nano)
+	text := r.FormValue("body")
+
 	c := Comment{}
-	err := db.Get(commid, &c)
+	oldText := ""
+	err = db.Update(commid, 0, func(current []byte) ([]byte, error) {
+		if len(current) == 0 {
+			return nil, NotFound
+		}
+		c = Comment{}
+		err := json.Unmarshal(current, &c)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkCommentEdit(c, bugid, me); err != nil {
+			return nil, err
+		}
+
+		if c.Text == text {
+			return nil, couchbase.UpdateCancel
+		}
+
+		history := c
+		history.Type = "commenthistory"
+
+		// Same trick as bug history: the side effect is only
+		// meaningful relative to the value that wins the CAS.
+		err = db.Set(historyKey, 0, &history)
+		if err != nil {
+			return nil, err
+		}
+
+		oldText = c.Text
+		c.Text = text
+		c.EditedAt = &now
+
+		return json.Marshal(c)
+	})
+
+	switch err {
+	case nil:
+		notifyCommentEdit(c)
+		updateBugRefs(bugid, oldText, c.Text, c.Private)
+		addWarnings(w, notifyMentions(bug, c, c.Text, oldText,
+			me.Id, "comment"))
+	case couchbase.UpdateCancel:
+		log.Printf("Ignoring identical update of %v", commid)
+	case commentNotYours:
+		showError(w, r, err.Error(), 403)
+		return
+	case commentDeleted:
+		showError(w, r, err.Error(), 409)
+		return
+	default:
+		showError(w, r, err.Error(), errorCode(err))
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func getCommentHistory(bugid, commid string) ([]APIComment, error) {
+	args := map[string]interface{}{
+		"stale":        false,
+		"start_key":    []interface{}{bugid, commid},
+		"end_key":      []interface{}{bugid, commid, map[string]string{}},
+		"include_docs": true,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Doc struct {
+				Json APIComment
+			}
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "comment_history", args, &viewRes)
 	if err != nil {
-		showError(w, r, err.Error(), 500)
+		return nil, err
+	}
+
+	rv := []APIComment{}
+	for _, row := range viewRes.Rows {
+		rv = append(rv, row.Doc.Json)
+	}
+	return rv, nil
+}
+
+func serveCommentHistory(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
+	bugid := mux.Vars(r)["bugid"]
+	commid := mux.Vars(r)["commid"]
+
+	if _, err := getBugOrDisplayErr(bugid, me, w, r); err != nil {
 		return
 	}
 
-	if c.Type != "comment" || c.User != me.Id {
-		showError(w, r, "You can't change this comment", 403)
+	c, err := getComment(commid)
+	if err != nil {
+		showError(w, r, err.Error(), errorCode(err))
 		return
 	}
 
-	c.Text = r.FormValue("body")
+	if c.Type != "comment" || c.BugId != bugid || !isVisible(c, me) {
+		showError(w, r, "No such comment", 404)
+		return
+	}
 
-	err = db.Set(commid, 0, &c)
+	hist, err := getCommentHistory(bugid, commid)
 	if err != nil {
 		showError(w, r, err.Error(), 500)
 		return
 	}
 
-	w.WriteHeader(204)
+	mustEncode(w, hist)
 }
 
 func serveDelComment(w http.ResponseWriter, r *http.Request) {
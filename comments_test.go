@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestThreadComments(t *testing.T) {
+	items := []interface{}{
+		&APIComment{Id: "c1"},
+		&APIPing{From: "a@example.com", To: "b@example.com"},
+		&APIComment{Id: "c2", InReplyTo: "c1"},
+		&APIComment{Id: "c3", InReplyTo: "c2"},
+		&APIComment{Id: "c4", InReplyTo: "c1"},
+		&APIComment{Id: "c5", InReplyTo: "hidden"},
+	}
+
+	threads := threadComments(items)
+
+	ids := func(ts []*commentThread) []string {
+		rv := []string{}
+		for _, t := range ts {
+			switch i := t.Item.(type) {
+			case *APIComment:
+				rv = append(rv, i.Id)
+			case *APIPing:
+				rv = append(rv, "ping")
+			}
+		}
+		return rv
+	}
+
+	check := func(name string, got []*commentThread, exp ...string) {
+		gotids := ids(got)
+		if len(gotids) != len(exp) {
+			t.Fatalf("Expected %v %v, got %v", name, exp, gotids)
+		}
+		for i := range exp {
+			if gotids[i] != exp[i] {
+				t.Fatalf("Expected %v %v, got %v", name, exp, gotids)
+			}
+		}
+	}
+
+	check("top level", threads, "c1", "ping", "c5")
+	check("replies to c1", threads[0].Replies, "c2", "c4")
+	check("replies to c2", threads[0].Replies[0].Replies, "c3")
+	check("replies to ping", threads[1].Replies)
+	check("replies to c5", threads[2].Replies)
+}
+
+func TestErrorCodeNotFound(t *testing.T) {
+	if code := errorCode(NotFound); code != 404 {
+		t.Errorf("Expected 404 for a missing doc, got %v", code)
+	}
+}
+
+func TestCheckCommentEdit(t *testing.T) {
+	me := User{Id: "me@example.com"}
+	mine := Comment{Type: "comment", BugId: "bug-1", User: me.Id}
+	deleted := mine
+	deleted.Deleted = true
+	theirs := mine
+	theirs.User = "them@example.com"
+
+	tests := []struct {
+		c     Comment
+		bugid string
+		exp   error
+	}{
+		{mine, "bug-1", nil},
+		{mine, "bug-2", commentNotYours},
+		{theirs, "bug-1", commentNotYours},
+		{deleted, "bug-1", commentDeleted},
+		{Comment{Type: "commenthistory", BugId: "bug-1", User: me.Id},
+			"bug-1", commentNotYours},
+	}
+
+	for _, x := range tests {
+		if err := checkCommentEdit(x.c, x.bugid, me); err != x.exp {
+			t.Errorf("checkCommentEdit(%+v, %v) = %v, expected %v",
+				x.c, x.bugid, err, x.exp)
+		}
+	}
+}
+
+func TestCommentListItem(t *testing.T) {
+	defer withRoles(nil)()
+	defer withGroups()()
+
+	internal := User{Id: "i@example.com", Internal: true}
+	external := User{Id: "e@example.com"}
+
+	private := []byte(`{"type": "comment", "id": "c1", "private": true, "text": "sekrit"}`)
+	public := []byte(`{"type": "comment", "id": "c2", "text": "hi"}`)
+	ping := []byte(`{"type": "ping", "from": "a@example.com", "to": "b@example.com"}`)
+	other := []byte(`{"type": "bug", "id": "bug-1"}`)
+
+	tests := []struct {
+		doc []byte
+		u   User
+		exp bool
+	}{
+		{private, internal, true},
+		{private, external, false},
+		{private, User{}, false},
+		{public, external, true},
+		{ping, external, true},
+		{other, internal, false},
+	}
+
+	for _, x := range tests {
+		item, err := commentListItem(x.doc, x.u)
+		if err != nil {
+			t.Errorf("Error parsing %s: %v", x.doc, err)
+		}
+		if (item != nil) != x.exp {
+			t.Errorf("%s for %v: got %v, expected shown=%v",
+				x.doc, x.u.Id, item, x.exp)
+		}
+	}
+
+	if _, err := commentListItem([]byte(`{`), internal); err == nil {
+		t.Errorf("Expected an error parsing garbage")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Double submit CSRF protection.  Browsers are handed a random token
+// in a cookie script can read, and anything changing state with the
+// auth cookie must echo it back in a header (which angular's $http
+// does by itself given these names) or, for plain forms, a form field.
+// Another site can make the browser send our cookies, but can't read
+// them to fill in the header.
+const (
+	xsrfCookie = "XSRF-TOKEN"
+	xsrfHeader = "X-XSRF-TOKEN"
+	xsrfField  = "xsrf_token"
+)
+
+func csrfSafeMethod(m string) bool {
+	switch m {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+func xsrfTokenFrom(r *http.Request) string {
+	if t := r.Header.Get(xsrfHeader); t != "" {
+		return t
+	}
+	// Only look in urlencoded bodies so we don't slurp up uploads.
+	if strings.HasPrefix(r.Header.Get("Content-Type"),
+		"application/x-www-form-urlencoded") {
+		return r.PostFormValue(xsrfField)
+	}
+	return ""
+}
+
+func csrfProtect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := ""
+		if c, err := r.Cookie(xsrfCookie); err == nil {
+			expected = c.Value
+		}
+		if expected == "" {
+			http.SetCookie(w, &http.Cookie{
+				Name:  xsrfCookie,
+				Value: randstring(32),
+				Path:  "/",
+			})
+		}
+
+		// Only cookie authentication is at risk.  API clients
+		// using basic auth (cbugg-cli) and the github hooks send
+		// no cookies and are left alone.
+		_, err := r.Cookie(AUTH_COOKIE)
+		if err == nil && !csrfSafeMethod(r.Method) {
+			got := xsrfTokenFrom(r)
+			if expected == "" ||
+				subtle.ConstantTimeCompare([]byte(got), []byte(expected)) != 1 {
+				showError(w, r, "Missing or invalid CSRF token", 403)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	h := csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+
+	auth := &http.Cookie{Name: AUTH_COOKIE, Value: "whatever"}
+	tok := &http.Cookie{Name: xsrfCookie, Value: "sekrit"}
+	form := url.Values{xsrfField: {"sekrit"}}.Encode()
+
+	tests := []struct {
+		name    string
+		method  string
+		cookies []*http.Cookie
+		header  string
+		body    string
+		exp     int
+	}{
+		{"get", "GET", []*http.Cookie{auth}, "", "", 204},
+		{"anonymous post", "POST", nil, "", "", 204},
+		{"basic auth post", "POST", []*http.Cookie{tok}, "", "", 204},
+		{"cookie without token", "POST", []*http.Cookie{auth, tok}, "", "", 403},
+		{"cookie with no xsrf cookie", "POST", []*http.Cookie{auth}, "sekrit", "", 403},
+		{"wrong token", "DELETE", []*http.Cookie{auth, tok}, "nope", "", 403},
+		{"header token", "DELETE", []*http.Cookie{auth, tok}, "sekrit", "", 204},
+		{"form token", "POST", []*http.Cookie{auth, tok}, "", form, 204},
+	}
+
+	for _, x := range tests {
+		req, err := http.NewRequest(x.method, "/api/bug/", strings.NewReader(x.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x.body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for _, c := range x.cookies {
+			req.AddCookie(c)
+		}
+		if x.header != "" {
+			req.Header.Set(xsrfHeader, x.header)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != x.exp {
+			t.Errorf("%v: got %v, expected %v", x.name, w.Code, x.exp)
+		}
+	}
+}
+
+func TestCSRFCookieIssued(t *testing.T) {
+	h := csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if !strings.HasPrefix(w.Header().Get("Set-Cookie"), xsrfCookie+"=") {
+		t.Errorf("Expected a new token cookie, got %v", w.HeaderMap)
+	}
+
+	req.AddCookie(&http.Cookie{Name: xsrfCookie, Value: "sekrit"})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("Expected to keep the existing token, got %v", c)
+	}
+}
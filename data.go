@@ -28,17 +28,23 @@ type Bug struct {
 }
 
 type Comment struct {
-	Id        string    `json:"id"`
-	BugId     string    `json:"bugId"`
-	Type      string    `json:"type"`
-	Deleted   bool      `json:"deleted"`
-	User      string    `json:"user"`
-	Text      string    `json:"text"`
-	CreatedAt time.Time `json:"created_at"`
-	Private   bool      `json:"private"`
+	Id        string     `json:"id"`
+	BugId     string     `json:"bugId"`
+	Type      string     `json:"type"`
+	Deleted   bool       `json:"deleted"`
+	User      string     `json:"user"`
+	Text      string     `json:"text"`
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	InReplyTo string     `json:"in_reply_to,omitempty"`
+	Private   bool       `json:"private"`
 }
 
 func (c Comment) changeObjectFor(u User) (Change, error) {
+	if !c.IsVisibleTo(u) {
+		return Change{}, bugNotVisible
+	}
+
 	bug, err := getBugFor(c.BugId, u)
 	if err != nil {
 		return Change{}, err
@@ -57,12 +63,29 @@ func (c Comment) changeObjectFor(u User) (Change, error) {
 	return rv, nil
 }
 
+type commentEdit struct {
+	Comment
+}
+
+func (c commentEdit) changeObjectFor(u User) (Change, error) {
+	if !c.IsVisibleTo(u) {
+		return Change{}, bugNotVisible
+	}
+
+	rv, err := c.Comment.changeObjectFor(u)
+	if err == nil {
+		rv.Action = "edited a comment on"
+		rv.Time = *c.EditedAt
+	}
+	return rv, err
+}
+
 func (c Comment) IsVisibleTo(u User) bool {
-	return u.Internal || (!c.Private)
+	return !c.Private || userCan(u, permPrivateRead)
 }
 
 func (c APIComment) IsVisibleTo(u User) bool {
-	return u.Internal || (!c.Private)
+	return !c.Private || userCan(u, permPrivateRead)
 }
 
 type Attachment struct {
@@ -73,10 +96,48 @@ type Attachment struct {
 	ContentType string    `json:"content_type"`
 	Size        int64     `json:"size"`
 	Filename    string    `json:"filename"`
+	Sha256      string    `json:"sha256,omitempty"`
 	User        string    `json:"user"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
+// A Blob is a stored file shared by every attachment with the same
+// content.
+type Blob struct {
+	Id   string   `json:"id"`
+	Type string   `json:"type"`
+	Url  string   `json:"url"`
+	Size int64    `json:"size"`
+	Refs []string `json:"refs"`
+}
+
+type Upload struct {
+	Id          string    `json:"id"`
+	BugId       string    `json:"bugId"`
+	Type        string    `json:"type"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Received    int64     `json:"received"`
+	Chunks      []string  `json:"chunks,omitempty"`
+	Finalizing  bool      `json:"finalizing,omitempty"`
+	User        string    `json:"user"`
+	CreatedAt   time.Time `json:"created_at"`
+	ModifiedAt  time.Time `json:"modified_at"`
+}
+
+type BugRef struct {
+	BugId     string    `json:"bugId"`
+	From      string    `json:"from"`
+	Type      string    `json:"type"`
+	Private   bool      `json:"private"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (r BugRef) IsVisibleTo(u User) bool {
+	return !r.Private || userCan(u, permPrivateRead)
+}
+
 type Ping struct {
 	BugId     string    `json:"bugId"`
 	Type      string    `json:"type"`
@@ -98,6 +159,79 @@ type User struct {
 	AuthToken string                 `json:"auth_token,omitmepty"`
 	Internal  bool                   `json:"internal"`
 	Prefs     map[string]interface{} `json:"prefs"`
+
+	PasswordHash string   `json:"password_hash,omitempty"`
+	Roles        []string `json:"roles,omitempty"`
+	Deactivated  bool     `json:"deactivated,omitempty"`
+	// Other addresses that are also this user.
+	Aliases []string `json:"aliases,omitempty"`
+	Away    *Away    `json:"away,omitempty"`
+
+	Profile
+}
+
+// Someone on leave.  While they're away, pings and assignments also
+// go to their delegate, if they named one.
+type Away struct {
+	From     time.Time `json:"from"`
+	Until    time.Time `json:"until"`
+	Delegate string    `json:"delegate,omitempty"`
+}
+
+// How someone presents themselves to everyone else.
+type Profile struct {
+	DisplayName string `json:"display_name,omitempty"`
+	TimeZone    string `json:"time_zone,omitempty"`
+	Locale      string `json:"locale,omitempty"`
+	// Where an uploaded avatar is stored, if they've uploaded one.
+	Avatar string `json:"avatar,omitempty"`
+}
+
+type Group struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Members   []string  `json:"members"`
+	Roles     []string  `json:"roles,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Role struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Permissions []string `json:"permissions"`
+}
+
+type APIToken struct {
+	Id        string     `json:"id"`
+	Type      string     `json:"type"`
+	User      string     `json:"user"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Scope     string     `json:"scope"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+type Session struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	User      string    `json:"user"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type AuditEntry struct {
+	Id         string                 `json:"id"`
+	Type       string                 `json:"type"`
+	Time       time.Time              `json:"time"`
+	Actor      string                 `json:"actor"`
+	Action     string                 `json:"action"`
+	Target     string                 `json:"target,omitempty"`
+	Detail     map[string]interface{} `json:"detail,omitempty"`
+	RemoteAddr string                 `json:"remote_addr,omitempty"`
 }
 
 type Reminder struct {
@@ -114,6 +248,18 @@ type Tag struct {
 	Subscribers []string `json:"subscribers,omitempty"`
 	FGColor     string   `json:"fgcolor,omitempty"`
 	BGColor     string   `json:"bgcolor,omitempty"`
+	// Tags can sit under another, whose subscribers and counts
+	// take them in.
+	Parent string `json:"parent,omitempty"`
+	// Deprecated tags stay on the bugs they're on, but can't be
+	// applied to any more.
+	Deprecated bool `json:"deprecated,omitempty"`
+
+	Description string `json:"description,omitempty"`
+	// People and groups who may edit the tag and triage its bugs.
+	Maintainers []string `json:"maintainers,omitempty"`
+	// Who untriaged bugs given the tag are assigned to.
+	DefaultOwner string `json:"default_owner,omitempty"`
 }
 
 type APIComment Comment
@@ -132,8 +278,12 @@ func (u Email) shortEmail() string {
 
 func (u Email) MarshalJSON() ([]byte, error) {
 	m := map[string]string{
-		"email": u.shortEmail(),
-		"md5":   md5string(string(u)),
+		"email":  displayNameFor(string(u)),
+		"handle": handleFor(string(u)),
+	}
+	// So pickers and bug pages can show who's out.
+	if a, ok := awayNow(string(u)); ok {
+		m["away_until"] = a.Until.Format(time.RFC3339)
 	}
 
 	return json.Marshal(m)
@@ -212,7 +362,8 @@ func contains(hay []string, need string) bool {
 }
 
 func (b Bug) IsVisibleTo(u User) bool {
-	return u.Internal || !(b.Private && !contains(b.AlsoVisibleTo, u.Id))
+	return !b.Private || principalsInclude(b.AlsoVisibleTo, u.Id) ||
+		userCan(u, permPrivateRead)
 }
 
 func (b APIBug) IsVisibleTo(u User) bool {
@@ -9,6 +9,9 @@ import (
 )
 
 func TestAPIBugMarshaling(t *testing.T) {
+	defer withDisplayNames(map[string]string{})()
+	defer withAway(map[string]Away{})()
+
 	now := time.Now()
 
 	bug := Bug{
@@ -42,30 +45,30 @@ func TestAPIBugMarshaling(t *testing.T) {
 	}
 
 	checks := map[string]interface{}{
-		"/id":                      bug.Id,
-		"/type":                    bug.Type,
-		"/parent":                  bug.Parent,
-		"/title":                   bug.Title,
-		"/description":             bug.Description,
-		"/status":                  bug.Status,
-		"/creator/md5":             md5string(bug.Creator),
-		"/creator/email":           Email(bug.Creator).shortEmail(),
-		"/owner/md5":               md5string(bug.Owner),
-		"/owner/email":             Email(bug.Owner).shortEmail(),
-		"/tags/0":                  "a",
-		"/tags/1":                  "b",
-		"/created_at":              bug.CreatedAt.Format(time.RFC3339Nano),
-		"/modified_at":             bug.ModifiedAt.Format(time.RFC3339Nano),
-		"/modify_type":             bug.ModType,
-		"/modified_by/md5":         md5string(bug.ModBy),
-		"/modified_by/email":       Email(bug.ModBy).shortEmail(),
-		"/subscribers/0/md5":       md5string("dustin@spy.net"),
-		"/subscribers/0/email":     "dustin",
-		"/subscribers/1/md5":       md5string("aaron@crate.im"),
-		"/subscribers/1/email":     "aaron",
-		"/also_visible_to/0/md5":   md5string("user@example.com"),
-		"/also_visible_to/0/email": "user",
-		"/private":                 bug.Private,
+		"/id":                       bug.Id,
+		"/type":                     bug.Type,
+		"/parent":                   bug.Parent,
+		"/title":                    bug.Title,
+		"/description":              bug.Description,
+		"/status":                   bug.Status,
+		"/creator/handle":           handleFor(bug.Creator),
+		"/creator/email":            Email(bug.Creator).shortEmail(),
+		"/owner/handle":             handleFor(bug.Owner),
+		"/owner/email":              Email(bug.Owner).shortEmail(),
+		"/tags/0":                   "a",
+		"/tags/1":                   "b",
+		"/created_at":               bug.CreatedAt.Format(time.RFC3339Nano),
+		"/modified_at":              bug.ModifiedAt.Format(time.RFC3339Nano),
+		"/modify_type":              bug.ModType,
+		"/modified_by/handle":       handleFor(bug.ModBy),
+		"/modified_by/email":        Email(bug.ModBy).shortEmail(),
+		"/subscribers/0/handle":     handleFor("dustin@spy.net"),
+		"/subscribers/0/email":      "dustin",
+		"/subscribers/1/handle":     handleFor("aaron@crate.im"),
+		"/subscribers/1/email":      "aaron",
+		"/also_visible_to/0/handle": handleFor("user@example.com"),
+		"/also_visible_to/0/email":  "user",
+		"/private":                  bug.Private,
 	}
 
 	for p, v := range checks {
@@ -75,4 +78,8 @@ func TestAPIBugMarshaling(t *testing.T) {
 				p, v, got)
 		}
 	}
+
+	if got := jsonpointer.Get(m, "/creator/md5"); got != nil {
+		t.Errorf("Expected no md5 of the creator, got %v", got)
+	}
 }
@@ -15,7 +15,7 @@ type viewMarker struct {
 }
 
 const ddocKey = "/@cbuggddocVersion"
-const ddocVersion = 38
+const ddocVersion = 53
 const designDoc = `
 {
     "spatialInfos": [],
@@ -89,12 +89,30 @@ const designDoc = `
         "aging": {
             "map": "function (doc, meta) {\n  if (doc.type === \"bug\") {\n    emit([doc.status, doc.modified_at], null);\n  }\n}"
         },
+        "aliases": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"user\" && doc.aliases) {\n    for (var i = 0; i < doc.aliases.length; i++) {\n      emit(doc.aliases[i].toLowerCase(), doc.id);\n    }\n  }\n}"
+        },
+        "api_tokens": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"apitoken\") {\n    emit(doc.user, null);\n  }\n}"
+        },
+        "audit": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"audit\") {\n    emit([\"*\", \"\", doc.time], null);\n    emit([\"actor\", doc.actor, doc.time], null);\n    if (doc.target) {\n      emit([\"target\", doc.target, doc.time], null);\n    }\n  }\n}"
+        },
         "attachments": {
             "map": "function (doc, meta) {\n  if (doc.type === \"attachment\") {\n    emit([doc.bugId, doc.created_at], {url: doc.url,\n                                       type: doc.content_type,\n                                       user: doc.user,\n                                       size: doc.size});\n  }\n}"
         },
+        "away": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"user\" && doc.away) {\n    emit(doc.id, doc.away);\n  }\n}"
+        },
         "bug_history": {
             "map": "function (doc, meta) {\n  if (doc.type === 'bughistory' || doc.type === 'bug') {\n    emit([doc.id, doc.modified_at], {\"type\": doc.modify_type || \"created\",\n                                     \"by\": doc.modified_by});\n  }\n}"
         },
+        "bug_refs": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"bugref\") {\n    emit([doc.bugId, doc.created_at], {from: doc.from,\n                                       private: doc.private,\n                                       created_at: doc.created_at});\n  }\n}"
+        },
+        "bug_refs_from": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"bugref\") {\n    emit([doc.from, doc.created_at], null);\n  }\n}"
+        },
         "by_state": {
             "map": "function (doc, meta) {\n  if (doc.type === 'bug') {\n    emit([doc.status, doc.created_at], {title: doc.title,\n                                        owner: doc.owner,\n                                        status: doc.status,\n                                        tags:doc.tags});\n  }\n}",
             "reduce": "_count"
@@ -102,9 +120,18 @@ const designDoc = `
         "changes": {
             "map": "function (doc, meta) {\n  if ((doc.type === 'bughistory' || doc.type === \"bug\") && doc.modify_type) {\n    var ob = {actor: doc.modified_by,\n              action: \"changed \" + doc.modify_type + ' of',\n              bugid: doc.id,\n              type: doc.type};\n    if (doc.modify_type === 'created') {\n      ob.action = 'created';\n    }\n    emit(doc.modified_at, ob);\n  } else if (doc.type === 'comment') {\n    emit(doc.created_at, {actor: doc.user, action: \"commented on\", type: doc.type, bugid: doc.bugId});\n  }\n}"
         },
+        "comment_history": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"commenthistory\") {\n    emit([doc.bugId, doc.id, doc.edited_at || doc.created_at], null);\n  }\n}"
+        },
         "comments": {
             "map": "function (doc, meta) {\n  if (doc.type === \"comment\" || doc.type === \"ping\") {\n    emit([doc.bugId, doc.created_at], doc.type);\n  }\n}"
         },
+        "display_names": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"user\" && doc.display_name) {\n    emit(doc.id, doc.display_name);\n  }\n}"
+        },
+        "groups": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"group\") {\n    emit(doc.name, null);\n  }\n}"
+        },
         "owners": {
             "map": "function (doc, meta) {\n  if (doc.type === 'bug' && doc.owner) {\n    emit([doc.owner, doc.status, doc.created_at], {title: doc.title,\n                                                   owner: doc.owner,\n                                                   status: doc.status,\n                                                   tags: doc.tags,\n                                                   mod: doc.modified_at});\n  }\n}",
             "reduce": "_count"
@@ -112,6 +139,12 @@ const designDoc = `
         "reminders": {
             "map": "function (doc, meta) {\n  if (doc.type === \"reminder\") {\n    emit(doc.when, null);\n  }\n}"
         },
+        "roles": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"role\") {\n    emit(doc.name, null);\n  }\n}"
+        },
+        "sessions": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"session\") {\n    emit(doc.user, null);\n  }\n}"
+        },
         "special_users": {
             "map": "function (doc, meta) {\n  if (doc.type === 'user') {\n    if (doc.admin) {\n      emit(\"admin\", doc.id);\n    }\n    if (doc.internal) {\n      emit(\"internal\", doc.id);\n    }\n  }\n}",
             "reduce": "_count"
@@ -119,10 +152,19 @@ const designDoc = `
         "tag_info": {
             "map": "function (doc, meta) {\n  if (doc.type === 'tag') {\n    emit(doc.name, null);\n  }\n}"
         },
+        "tag_parents": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"tag\" && doc.parent) {\n    emit(doc.name, doc.parent);\n  }\n}"
+        },
         "tags": {
             "map": "function (doc, meta) {\n  if (doc.type === 'bug' && doc.tags) {\n    for (var i = 0; i < doc.tags.length; i++) {\n      emit([doc.tags[i], doc.status], 1);\n    }\n  } else if(doc.type === 'tag') {\n    emit([doc.name, \"inbox\"], 0);\n  }\n}",
             "reduce": "_sum"
         },
+        "uploads": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"upload\") {\n    emit(doc.modified_at, null);\n  }\n}"
+        },
+        "user_data": {
+            "map": "function (doc, meta) {\n  var people = {\n    bug: [\"creator\", \"owner\", \"modified_by\", \"subscribers\", \"also_visible_to\"],\n    bughistory: [\"creator\", \"owner\", \"modified_by\", \"subscribers\", \"also_visible_to\"],\n    comment: [\"user\"],\n    commenthistory: [\"user\"],\n    attachment: [\"user\"],\n    upload: [\"user\"],\n    ping: [\"from\", \"to\"],\n    reminder: [\"user\"],\n    tag: [\"subscribers\", \"maintainers\", \"default_owner\"],\n    group: [\"members\"],\n    user: [\"id\"],\n    apitoken: [\"user\"],\n    session: [\"user\"]\n  }[doc.type] || [];\n  var seen = {};\n  for (var i = 0; i < people.length; i++) {\n    var v = [].concat(doc[people[i]] || []);\n    for (var j = 0; j < v.length; j++) {\n      if (!seen[v[j]]) {\n        seen[v[j]] = true;\n        emit([v[j], doc.type], null);\n      }\n    }\n  }\n}"
+        },
         "users": {
             "map": "function (doc, meta) {\n  if (doc.type === 'bug') {\n    if (doc.creator) {\n      emit(doc.creator, null);\n    } else if(doc.modified_by && doc.modified_by != doc.creator) {\n      emit(doc.modified_by, null);\n    }\n  } else if(doc.type === \"user\") {\n    emit(doc.id, null);\n  } else if(doc.type === \"ping\") {\n    emit(doc.from, null);\n    emit(doc.to, null);\n  }\n}",
             "reduce": "_count"
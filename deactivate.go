@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+var successorDeactivated = errors.New("the successor has been deactivated")
+
+// Successor meaning each bug goes to the default owner of its tags.
+const tagDefaultSuccessor = "tag-default"
+
+type ownedBug struct {
+	Id     string `json:"id"`
+	Title  string `json:"title"`
+	Status string `json:"status"`
+}
+
+func bugIsOpen(status string) bool {
+	return status != "resolved" && status != "closed"
+}
+
+// Bugs someone owns that are yet to be resolved.
+func openBugsOwnedBy(email string) ([]ownedBug, error) {
+	args := map[string]interface{}{
+		"stale":     false,
+		"start_key": []interface{}{email},
+		"end_key":   []interface{}{email, map[string]string{}},
+	}
+
+	viewRes := struct {
+		Rows []bugListResult
+	}{}
+
+	err := db.ViewCustom("cbugg", "owners", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []ownedBug{}
+	for _, row := range viewRes.Rows {
+		if bugIsOpen(row.Value.Status) {
+			rv = append(rv, ownedBug{row.ID, row.Value.Title, row.Value.Status})
+		}
+	}
+	return rv, nil
+}
+
+func setUserDeactivated(email string, to bool) error {
+	return db.Update("u-"+email, 0, func(current []byte) ([]byte, error) {
+		user := User{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &user)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Common fields
+		user.Id = email
+		user.Type = "user"
+
+		user.Deactivated = to
+
+		return json.Marshal(user)
+	})
+}
+
+// Take someone off every bug and tag they're subscribed to.
+func unsubscribeEverywhere(email string) (int, error) {
+	docs, err := findUserData(email)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, d := range docs {
+		subs, _ := d.Doc["subscribers"].([]interface{})
+		subscribed := false
+		for _, s := range subs {
+			subscribed = subscribed || s == email
+		}
+		if !subscribed {
+			continue
+		}
+
+		switch d.Type {
+		case "bug":
+			err = updateSubscription(d.Id, email, false)
+		case "tag":
+			err = updateTagSubscription(maybenil(d.Doc, "name"), email, false)
+		default:
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Who a deactivated user's bugs go to, as given in a form.  Nobody
+// deactivated may take them.
+func deactivationSuccessor(s string) (string, error) {
+	if s != tagDefaultSuccessor {
+		s = resolvePrincipal(s)
+	}
+	if s != "" && s != tagDefaultSuccessor && userForEmail(s).Deactivated {
+		return "", successorDeactivated
+	}
+	return s, nil
+}
+
+// Hand a bug to someone else, as an edit by me would.
+var reassignBug = func(id, to string, me User) error {
+	_, _, err := updateBug(id, "owner", to, me)
+	return err
+}
+
+// Give email's open bugs to the successor, returning the ids of those
+// that were.  Bugs with no default owner other than email are left
+// where they are.
+func reassignBugs(bugs []ownedBug, email, successor string, me User) []string {
+	reassigned := []string{}
+	if successor == "" {
+		return reassigned
+	}
+	for _, b := range bugs {
+		to := successor
+		if to == tagDefaultSuccessor {
+			bug, err := getBug(b.Id)
+			if err != nil {
+				log.Printf("Error getting %v to reassign: %v", b.Id, err)
+				continue
+			}
+			to = defaultOwnerFor(bug.Tags, email)
+			if to == "" {
+				continue
+			}
+		}
+		err := reassignBug(b.Id, to, me)
+		if err != nil {
+			log.Printf("Error reassigning %v to %v: %v", b.Id, to, err)
+			continue
+		}
+		reassigned = append(reassigned, b.Id)
+	}
+	return reassigned
+}
+
+// See what a deactivation would leave behind.
+func serveDeactivationReport(w http.ResponseWriter, r *http.Request) {
+	email := resolvePrincipal(r.FormValue("email"))
+	if email == "" {
+		showError(w, r, "no email given", 400)
+		return
+	}
+
+	bugs, err := openBugsOwnedBy(email)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	mustEncode(w, map[string]interface{}{
+		"email":       email,
+		"deactivated": userForEmail(email).Deactivated,
+		"open_bugs":   bugs,
+	})
+}
+
+// Deactivate someone: they can no longer log in or use their tokens,
+// they're taken off everything they subscribed to and, given a
+// successor, their open bugs are reassigned.  The tag-default
+// successor hands each bug to the default owner of its tags.
+func serveDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
+	email := resolvePrincipal(r.FormValue("email"))
+	if email == "" || isGroupPrincipal(email) {
+		showError(w, r, "no email given", 400)
+		return
+	}
+	successor, err := deactivationSuccessor(r.FormValue("successor"))
+	if err != nil {
+		showError(w, r, err.Error(), 400)
+		return
+	}
+
+	err = setUserDeactivated(email, true)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+	maybeLog("revoking sessions of "+email, revokeSessions(email))
+
+	unsubscribed, err := unsubscribeEverywhere(email)
+	if err != nil {
+		log.Printf("Error unsubscribing %v: %v", email, err)
+	}
+
+	bugs, err := openBugsOwnedBy(email)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	reassigned := reassignBugs(bugs, email, successor, me)
+
+	audit(r, me.Id, "user.deactivate", email, map[string]interface{}{
+		"successor":    successor,
+		"reassigned":   reassigned,
+		"unsubscribed": unsubscribed,
+	})
+
+	mustEncode(w, map[string]interface{}{
+		"email":        email,
+		"deactivated":  true,
+		"open_bugs":    bugs,
+		"successor":    successor,
+		"reassigned":   reassigned,
+		"unsubscribed": unsubscribed,
+	})
+}
+
+func serveReactivateUser(w http.ResponseWriter, r *http.Request) {
+	email := resolvePrincipal(r.FormValue("email"))
+	if email == "" {
+		showError(w, r, "no email given", 400)
+		return
+	}
+
+	err := setUserDeactivated(email, false)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	audit(r, whoami(r).Id, "user.reactivate", email, nil)
+
+	mustEncode(w, Email(email))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBugIsOpen(t *testing.T) {
+	tests := map[string]bool{
+		"inbox":      true,
+		"new":        true,
+		"open":       true,
+		"inprogress": true,
+		"resolved":   false,
+		"closed":     false,
+	}
+
+	for status, exp := range tests {
+		if got := bugIsOpen(status); got != exp {
+			t.Errorf("bugIsOpen(%q) = %v, expected %v", status, got, exp)
+		}
+	}
+}
+
+func TestDeactivatedIsForbidden(t *testing.T) {
+	if code := errorCode(accountDeactivated); code != 403 {
+		t.Errorf("Deactivated account gave %v, expected 403", code)
+	}
+}
+
+func TestUnsubscribeEverywhere(t *testing.T) {
+	defer withUserData(map[string][]userDataDoc{
+		"a@example.com": {
+			{"bug-1", "bug", map[string]interface{}{
+				"subscribers": []interface{}{"b@example.com", "a@example.com"}}},
+			{"bug-2", "bug", map[string]interface{}{
+				"owner": "a@example.com", "subscribers": []interface{}{}}},
+			{"tag-ui", "tag", map[string]interface{}{
+				"name": "ui", "subscribers": []interface{}{"a@example.com"}}},
+			{"tag-db", "tag", map[string]interface{}{
+				"name": "db", "maintainers": []interface{}{"a@example.com"}}},
+			{"c-bug-1-x", "comment", map[string]interface{}{
+				"user": "a@example.com"}},
+		},
+	})()
+
+	updates := []string{}
+	origBug, origTag := updateSubscription, updateTagSubscription
+	defer func() { updateSubscription, updateTagSubscription = origBug, origTag }()
+	updateSubscription = func(bugid, email string, add bool) error {
+		updates = append(updates, fmt.Sprintf("%v %v %v", bugid, email, add))
+		return nil
+	}
+	updateTagSubscription = func(tagname, email string, add bool) error {
+		updates = append(updates, fmt.Sprintf("tag %v %v %v", tagname, email, add))
+		return nil
+	}
+
+	n, err := unsubscribeEverywhere("a@example.com")
+	exp := []string{"bug-1 a@example.com false", "tag ui a@example.com false"}
+	if err != nil || n != 2 || !reflect.DeepEqual(updates, exp) {
+		t.Errorf("Expected %v, got %v, %v, %v", exp, n, err, updates)
+	}
+
+	updates = updates[:0]
+	if n, err := unsubscribeEverywhere("b@example.com"); err != nil || n != 0 ||
+		len(updates) != 0 {
+		t.Errorf("Expected nothing for someone with no data, got %v, %v, %v",
+			n, err, updates)
+	}
+}
+
+func TestDeactivationSuccessor(t *testing.T) {
+	defer withAliases(map[string]string{})()
+	defer withUsers(map[string]User{
+		"gone@example.com": {Id: "gone@example.com", Type: "user",
+			Deactivated: true},
+		"here@example.com": {Id: "here@example.com", Type: "user"},
+	})()
+
+	tests := []struct {
+		in, exp string
+		err     error
+	}{
+		{"", "", nil},
+		{"here@example.com", "here@example.com", nil},
+		{tagDefaultSuccessor, tagDefaultSuccessor, nil},
+		{"gone@example.com", "", successorDeactivated},
+	}
+
+	for _, x := range tests {
+		got, err := deactivationSuccessor(x.in)
+		if got != x.exp || err != x.err {
+			t.Errorf("deactivationSuccessor(%q) = %q, %v, expected %q, %v",
+				x.in, got, err, x.exp, x.err)
+		}
+	}
+}
+
+func TestReassignBugs(t *testing.T) {
+	defer withAliases(map[string]string{})()
+	defer withTagParents(map[string]string{"ui:menus": "ui"})()
+	defer withUsers(map[string]User{
+		"gone@example.com": {Id: "gone@example.com", Type: "user",
+			Deactivated: true},
+	})()
+	defer withTags(map[string]Tag{
+		"ui":  {Name: "ui", Type: "tag", DefaultOwner: "ui@example.com"},
+		"old": {Name: "old", Type: "tag", DefaultOwner: "gone@example.com"},
+		"db":  {Name: "db", Type: "tag", DefaultOwner: "a@example.com"},
+	})()
+	defer withBugs(map[string]Bug{
+		"bug-1": {Id: "bug-1", Tags: []string{"ui:menus"}},
+		"bug-2": {Id: "bug-2", Tags: []string{"old", "db"}},
+		"bug-3": {Id: "bug-3", Tags: []string{"old"}},
+		"bug-4": {Id: "bug-4"},
+	})()
+
+	assigned := map[string]string{}
+	origReassign := reassignBug
+	defer func() { reassignBug = origReassign }()
+	reassignBug = func(id, to string, me User) error {
+		if id == "bug-5" {
+			return errors.New("no")
+		}
+		assigned[id] = to
+		return nil
+	}
+
+	me := User{Id: "admin@example.com", Admin: true}
+	bugs := []ownedBug{{Id: "bug-1"}, {Id: "bug-2"}, {Id: "bug-3"},
+		{Id: "bug-4"}, {Id: "bug-5"}}
+
+	got := reassignBugs(bugs, "a@example.com", "b@example.com", me)
+	exp := []string{"bug-1", "bug-2", "bug-3", "bug-4"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v reassigned, got %v", exp, got)
+	}
+	for _, id := range exp {
+		if assigned[id] != "b@example.com" {
+			t.Errorf("Expected %v to go to b@example.com, got %q",
+				id, assigned[id])
+		}
+	}
+
+	// Each bug goes to its tags' default owner, if there's anyone
+	// else still around.
+	assigned = map[string]string{}
+	got = reassignBugs(bugs, "a@example.com", tagDefaultSuccessor, me)
+	if exp := []string{"bug-1"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v reassigned by tag, got %v", exp, got)
+	}
+	if assigned["bug-1"] != "ui@example.com" || len(assigned) != 1 {
+		t.Errorf("Expected bug-1 to go to ui@example.com, got %v", assigned)
+	}
+
+	if got := reassignBugs(bugs, "a@example.com", "", me); len(got) != 0 {
+		t.Errorf("Expected nothing reassigned without a successor, got %v", got)
+	}
+}
+
+func TestDeactivatedCantLogIn(t *testing.T) {
+	defer withAliases(map[string]string{})()
+	defer withUsers(map[string]User{
+		"gone@example.com": {Id: "gone@example.com", Type: "user",
+			Deactivated: true},
+	})()
+	now := time.Now().UTC()
+	defer withSessions(map[string]Session{
+		"s": {Id: "s", Type: "session", User: "gone@example.com",
+			CreatedAt: now, LastSeen: now, ExpiresAt: now.Add(time.Hour)},
+	})()
+
+	c := sessionCookie(t, "gone@example.com", "s")
+	if _, err := userFromCookie(c.Value); err != accountDeactivated {
+		t.Errorf("Expected a deactivated user's cookie refused, got %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/me/", nil)
+	if _, ok := userFromToken(req, "gone@example.com", "tok.secret"); ok {
+		t.Errorf("Expected a deactivated user's token refused")
+	}
+
+	req.AddCookie(c)
+	if u := whoami(req); u.Id != "" {
+		t.Errorf("Expected nobody, got %v", u.Id)
+	}
+}
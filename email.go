@@ -39,9 +39,8 @@ func initTemplates() (*template.Template, error) {
 		"bytes": func(i int64) string {
 			return humanize.Bytes(uint64(i))
 		},
-		"shortName": func(s string) string {
-			return Email(s).shortEmail()
-		},
+		"shortName": displayNameFor,
+		"inZone":    inZone,
 	})
 
 	files, err := filepath.Glob("templates/*")
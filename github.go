@@ -189,45 +189,17 @@ func getGithubPatch(bug Bug, url, email string) {
 		return
 	}
 
-	filename := "0001-" + cleanupPatchTitle(bug.Title) + ".patch"
-
-	attid := randstring(8)
-	dest := *cbfsUrl + bug.Id + "/" + attid + "/" + filename
-
-	cr := &countingReader{r: gres.Body}
-
-	req, err := http.NewRequest("PUT", dest, cr)
-	if err != nil {
-		log.Printf("Error storing patch in CBFS: %v", err)
-		return
-	}
-
-	pres, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Printf("Error sending to CBFS: %v", err)
-		return
-	}
-	defer pres.Body.Close()
-	if pres.StatusCode != 201 {
-		log.Printf("Error sending to CBFS: %v", err)
-		return
-	}
-
 	att := Attachment{
-		Id:          bug.Id + "-" + attid,
 		BugId:       bug.Id,
-		Type:        "attachment",
-		Url:         dest,
-		Size:        cr.n,
 		ContentType: "text/plain",
-		Filename:    filename,
+		Filename:    "0001-" + cleanupPatchTitle(bug.Title) + ".patch",
 		User:        email,
 		CreatedAt:   time.Now().UTC(),
 	}
 
-	err = db.Set("att-"+bug.Id+"-"+attid, 0, &att)
+	err = putAttachment(&att, gres.Body, -1)
 	if err != nil {
-		log.Printf("Error storing attachment ref: %v", err)
+		log.Printf("Error storing patch for bug %v: %v", bug.Id, err)
 		return
 	}
 }
@@ -326,6 +298,7 @@ func makeIssueFromGithub(issue GithubIssue, repository GithubRepository) (Bug, e
 	for _, t := range tags {
 		notifyTagAssigned(bug.Id, t, bug.Creator)
 	}
+	autoAssign(bug, tags, userForEmail(bug.Creator))
 
 	if issue.Pull.PatchURL != nil {
 		go getGithubPatch(bug, *issue.Pull.PatchURL, originator)
@@ -360,12 +333,15 @@ func serveGithubIssue(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = makeIssueFromGithub(hookdata.Issue, hookdata.Repository)
+	bug, err := makeIssueFromGithub(hookdata.Issue, hookdata.Repository)
 	if err != nil {
 		showError(w, r, err.Error(), 500)
 		return
 	}
 
+	audit(r, "github", "github.issue", bug.Id, map[string]interface{}{
+		"repo": hookdata.Repository.Name, "creator": bug.Creator})
+
 	w.WriteHeader(204)
 }
 
@@ -392,6 +368,9 @@ func getGithubObject(path string, ob interface{}) error {
 
 func serveGithubIssueFetch(w http.ResponseWriter, r *http.Request) {
 	repoName := r.FormValue("repo")
+	audit(r, whoami(r).Id, "github.fetch", repoName,
+		map[string]interface{}{"issue": r.FormValue("issue")})
+
 	repo := GithubRepository{}
 	err := getGithubObject("repos/"+repoName, &repo)
 	if err != nil {
@@ -506,6 +485,10 @@ func serveGithubPullRequest(w http.ResponseWriter, r *http.Request) {
 	for _, t := range tags {
 		notifyTagAssigned(bug.Id, t, bug.Creator)
 	}
+	autoAssign(bug, tags, userForEmail(bug.Creator))
+
+	audit(r, "github", "github.pull", bug.Id, map[string]interface{}{
+		"repo": hookdata.Repository.Name, "creator": bug.Creator})
 
 	go getGithubPatch(bug, hookdata.PullRequest.PatchURL, originator)
 
@@ -558,8 +541,7 @@ func refBug(hookdata githubPushHook, commit githubCommit, ref githubCBRef) {
 		return
 	}
 
-	me, _ := getUser(commit.Author.Email)
-	me.Id = commit.Author.Email // Update the author for when getUser fails
+	me := userForEmail(commit.Author.Email)
 
 	if _, err := getBugFor(bugid, me); err != nil {
 		return
@@ -591,6 +573,11 @@ func refBug(hookdata githubPushHook, commit githubCommit, ref githubCBRef) {
 
 	notifyComment(c)
 
+	recordBugRefs(bugid, c.Text, false)
+
+	audit(nil, "github", "github.ref", bugid, map[string]interface{}{
+		"commit": commit.Id, "author": me.Id, "closed": ref.closed})
+
 	if ref.closed {
 		updateBug(bugid, "status", "resolved", me)
 	}
@@ -615,6 +602,9 @@ func serveGithubPush(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Got push hook: %+v", hookdata)
 
+	audit(r, "github", "github.push", hookdata.Repository.Name,
+		map[string]interface{}{"commits": len(hookdata.Commits)})
+
 	go processPushHook(hookdata)
 
 	w.WriteHeader(204)
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/gorilla/mux"
+)
+
+// Groups stand in for their members wherever an email address would
+// otherwise go (owners, subscribers, viewers of private bugs), written
+// as groupPrefix followed by the group name.
+const groupPrefix = "group:"
+
+const groupCacheTime = 30 * time.Second
+
+var groupNameRE = regexp.MustCompile(`^[a-z0-9][-a-z0-9_.]*$`)
+
+var errNotAGroup = errors.New("not a group")
+
+var groupCache = struct {
+	sync.Mutex
+	groups  map[string]Group
+	fetched time.Time
+}{}
+
+func isGroupPrincipal(p string) bool {
+	return strings.HasPrefix(p, groupPrefix)
+}
+
+func groupPrincipal(name string) string {
+	return groupPrefix + name
+}
+
+var loadGroups = func() (map[string]Group, error) {
+	args := map[string]interface{}{
+		"stale":        false,
+		"include_docs": true,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Doc struct {
+				Json Group
+			}
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "groups", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]Group{}
+	for _, row := range viewRes.Rows {
+		rv[row.Doc.Json.Name] = row.Doc.Json
+	}
+	return rv, nil
+}
+
+func getGroups() map[string]Group {
+	groupCache.Lock()
+	defer groupCache.Unlock()
+
+	if groupCache.groups != nil && time.Since(groupCache.fetched) < groupCacheTime {
+		return groupCache.groups
+	}
+
+	groups, err := loadGroups()
+	if err != nil {
+		log.Printf("Error loading groups: %v", err)
+		if groupCache.groups != nil {
+			return groupCache.groups
+		}
+		return map[string]Group{}
+	}
+	groupCache.groups = groups
+	groupCache.fetched = time.Now()
+	return groups
+}
+
+func forgetGroups() {
+	groupCache.Lock()
+	defer groupCache.Unlock()
+	groupCache.groups = nil
+}
+
+// The groups the given email address belongs to.
+func groupsOf(email string) []Group {
+	rv := []Group{}
+	if email == "" {
+		return rv
+	}
+	for _, g := range getGroups() {
+		if contains(g.Members, email) {
+			rv = append(rv, g)
+		}
+	}
+	sort.Sort(groupsByName(rv))
+	return rv
+}
+
+type groupsByName []Group
+
+func (g groupsByName) Len() int           { return len(g) }
+func (g groupsByName) Less(i, j int) bool { return g[i].Name < g[j].Name }
+func (g groupsByName) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+
+// Everything that stands for the email address: itself and its groups.
+func principalsOf(email string) []string {
+	rv := []string{email}
+	for _, g := range groupsOf(email) {
+		rv = append(rv, groupPrincipal(g.Name))
+	}
+	return rv
+}
+
+// Whether the email address is, or is a member of, the principal.
+func principalIncludes(p, email string) bool {
+	if email == "" {
+		return false
+	}
+	if p == email {
+		return true
+	}
+	if isGroupPrincipal(p) {
+		g, ok := getGroups()[strings.TrimPrefix(p, groupPrefix)]
+		return ok && contains(g.Members, email)
+	}
+	return false
+}
+
+func principalsInclude(ps []string, email string) bool {
+	for _, p := range ps {
+		if principalIncludes(p, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace groups in a list of principals with their members.
+func expandPrincipals(ps []string) []string {
+	groups := getGroups()
+	rv := []string{}
+	seen := map[string]bool{}
+	add := func(e string) {
+		if !seen[e] {
+			seen[e] = true
+			rv = append(rv, e)
+		}
+	}
+	for _, p := range ps {
+		if !isGroupPrincipal(p) {
+			add(p)
+			continue
+		}
+		for _, m := range groups[strings.TrimPrefix(p, groupPrefix)].Members {
+			add(m)
+		}
+	}
+	return rv
+}
+
+// Whether u may change subscriptions on behalf of the principal.
+// Members act for their groups; tag maintainers act for anyone.
+func maySubscribeAs(u User, p string) bool {
+	if p == u.Id || (isGroupPrincipal(p) && principalIncludes(p, u.Id)) {
+		return userCan(u, permBugSubscribe)
+	}
+	return userCan(u, permTagSubscribers)
+}
+
+func getGroup(name string) (Group, error) {
+	rv := Group{}
+	err := db.Get("group-"+name, &rv)
+	if err == nil && rv.Type != "group" {
+		return Group{}, errNotAGroup
+	}
+	return rv, err
+}
+
+func updateGroup(name string, f func(*Group)) (Group, error) {
+	g := Group{}
+	err := db.Update("group-"+name, 0, func(current []byte) ([]byte, error) {
+		g = Group{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &g)
+			if err != nil {
+				return nil, err
+			}
+			if g.Type != "group" {
+				return nil, errNotAGroup
+			}
+		} else {
+			g.CreatedAt = time.Now().UTC()
+		}
+
+		g.Name = name
+		g.Type = "group"
+		f(&g)
+
+		return json.Marshal(g)
+	})
+	forgetGroups()
+	return g, err
+}
+
+func serveGroupList(w http.ResponseWriter, r *http.Request) {
+	groups := getGroups()
+	rv := []Group{}
+	for _, g := range groups {
+		rv = append(rv, g)
+	}
+	sort.Sort(groupsByName(rv))
+	mustEncode(w, rv)
+}
+
+func serveGroup(w http.ResponseWriter, r *http.Request) {
+	g, err := getGroup(mux.Vars(r)["group"])
+	if err != nil {
+		showError(w, r, err.Error(), errorCode(err))
+		return
+	}
+	mustEncode(w, g)
+}
+
+func serveSetGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["group"]
+	if !groupNameRE.MatchString(name) {
+		showError(w, r, "Invalid group name: "+name, 400)
+		return
+	}
+
+	r.ParseForm()
+	g, err := updateGroup(name, func(g *Group) {
+		if _, ok := r.Form["members"]; ok {
+			g.Members = splitList(r.FormValue("members"))
+		}
+		if _, ok := r.Form["roles"]; ok {
+			g.Roles = splitList(r.FormValue("roles"))
+		}
+	})
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	audit(r, whoami(r).Id, "group.set", name,
+		map[string]interface{}{"members": g.Members, "roles": g.Roles})
+
+	mustEncode(w, g)
+}
+
+func serveDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	err := db.Delete("group-" + mux.Vars(r)["group"])
+	forgetGroups()
+	if err != nil && !gomemcached.IsNotFound(err) {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	audit(r, whoami(r).Id, "group.delete", mux.Vars(r)["group"], nil)
+
+	w.WriteHeader(204)
+}
+
+func serveGroupMembership(w http.ResponseWriter, r *http.Request, add bool) {
+	name := mux.Vars(r)["group"]
+	email := r.FormValue("email")
+	if !strings.Contains(email, "@") {
+		showError(w, r, "Invalid email: "+email, 400)
+		return
+	}
+
+	if _, err := getGroup(name); err != nil {
+		showError(w, r, err.Error(), errorCode(err))
+		return
+	}
+
+	g, err := updateGroup(name, func(g *Group) {
+		g.Members = removeFromList(g.Members, email)
+		if add {
+			g.Members = append(g.Members, email)
+		}
+	})
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	action := "group.member.remove"
+	if add {
+		action = "group.member.add"
+	}
+	audit(r, whoami(r).Id, action, name,
+		map[string]interface{}{"email": email})
+
+	mustEncode(w, g)
+}
+
+func serveAddGroupMember(w http.ResponseWriter, r *http.Request) {
+	serveGroupMembership(w, r, true)
+}
+
+func serveRemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	serveGroupMembership(w, r, false)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func withGroups(groups ...Group) func() {
+	origLoad := loadGroups
+	loadGroups = func() (map[string]Group, error) {
+		rv := map[string]Group{}
+		for _, g := range groups {
+			rv[g.Name] = g
+		}
+		return rv, nil
+	}
+	forgetGroups()
+	return func() {
+		loadGroups = origLoad
+		forgetGroups()
+	}
+}
+
+func TestPrincipals(t *testing.T) {
+	defer withGroups(
+		Group{Name: "qa", Members: []string{"a@example.com", "b@example.com"}},
+		Group{Name: "docs", Members: []string{"b@example.com", "c@example.com"}},
+	)()
+
+	tests := []struct {
+		P, Email string
+		Exp      bool
+	}{
+		{"a@example.com", "a@example.com", true},
+		{"a@example.com", "b@example.com", false},
+		{"group:qa", "a@example.com", true},
+		{"group:qa", "c@example.com", false},
+		{"group:nope", "a@example.com", false},
+		{"group:qa", "", false},
+		{"", "", false},
+	}
+
+	for _, x := range tests {
+		if got := principalIncludes(x.P, x.Email); got != x.Exp {
+			t.Errorf("principalIncludes(%q, %q) = %v, expected %v",
+				x.P, x.Email, got, x.Exp)
+		}
+	}
+
+	got := expandPrincipals([]string{"group:qa", "c@example.com",
+		"group:docs", "group:nope"})
+	exp := []string{"a@example.com", "b@example.com", "c@example.com"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expandPrincipals = %v, expected %v", got, exp)
+	}
+
+	names := []string{}
+	for _, g := range groupsOf("b@example.com") {
+		names = append(names, g.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"docs", "qa"}) {
+		t.Errorf("groupsOf(b) = %v", names)
+	}
+}
+
+func TestGroupsGrantAccess(t *testing.T) {
+	defer withGroups(
+		Group{Name: "qa", Members: []string{"q@example.com"}},
+		Group{Name: "audit", Members: []string{"a@example.com"},
+			Roles: []string{"auditor"}},
+	)()
+	defer withRoles(nil)()
+
+	b := Bug{Private: true, AlsoVisibleTo: []string{"group:qa"}}
+
+	tests := []struct {
+		U   User
+		Exp bool
+	}{
+		{User{Id: "q@example.com"}, true},
+		{User{Id: "a@example.com"}, true},
+		{User{Id: "x@example.com"}, false},
+	}
+
+	for _, x := range tests {
+		if got := b.IsVisibleTo(x.U); got != x.Exp {
+			t.Errorf("Private bug visible to %v = %v, expected %v",
+				x.U.Id, got, x.Exp)
+		}
+	}
+
+	// Group roles add to the defaults rather than replacing them.
+	a := User{Id: "a@example.com"}
+	if !userCan(a, permBugCreate) || !userCan(a, permPrivateRead) {
+		t.Errorf("auditor group member lost default roles: %v", rolesFor(a))
+	}
+	// And to any roles of the member's own.
+	own := User{Id: "a@example.com", Roles: []string{"reporter"}}
+	exp := []string{"reporter", "auditor"}
+	if got := rolesFor(own); !reflect.DeepEqual(got, exp) {
+		t.Errorf("rolesFor(%v) = %v, expected %v", own.Id, got, exp)
+	}
+	if !userCan(User{Id: "q@example.com"}, permBugCreate) {
+		t.Errorf("roleless group member lost default roles")
+	}
+}
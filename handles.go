@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// People are identified to browsers by an opaque handle rather than
+// their address (or an md5 of it, which is easily reversed).  Handles
+// are keyed hashes, so they're stable without being stored, and only
+// we can turn one back into an address.
+var handleKey = flag.String("handleKey", "",
+	"secret for user handles (generated and kept in the bucket if not given)")
+
+// Where the generated handle key is kept, so every instance agrees.
+const handleKeyKey = "/@cbugghandlekey"
+
+// Don't go looking through every user for unknown handles more often
+// than this.
+const handleCacheTime = 30 * time.Second
+
+var handleSecret []byte
+
+var handleCache = struct {
+	sync.Mutex
+	emails  map[string]string
+	scanned time.Time
+}{emails: map[string]string{}}
+
+type handleKeyDoc struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+}
+
+// Use the given handle key, or the one in the bucket, making one up
+// the first time.  It mustn't be anything guessable (like a default
+// cookie key), or handles could be reversed as easily as md5s.
+func initHandleKey() error {
+	if *handleKey != "" {
+		handleSecret = []byte(*handleKey)
+		return nil
+	}
+
+	doc := handleKeyDoc{Type: "handlekey", Key: randstring(32)}
+	_, err := db.Add(handleKeyKey, 0, doc)
+	if err == nil {
+		// Whoever got there first wins.
+		err = db.Get(handleKeyKey, &doc)
+	}
+	if err == nil && doc.Key == "" {
+		err = errors.New("empty handle key in " + handleKeyKey)
+	}
+	handleSecret = []byte(doc.Key)
+	return err
+}
+
+func computeHandle(email string) string {
+	mac := hmac.New(sha256.New, handleSecret)
+	mac.Write([]byte(strings.ToLower(email)))
+	return "u" + hex.EncodeToString(mac.Sum(nil))[:20]
+}
+
+func handleFor(email string) string {
+	if email == "" {
+		return ""
+	}
+	// Group names aren't personal.
+	if isGroupPrincipal(email) {
+		return email
+	}
+
+	h := computeHandle(email)
+
+	handleCache.Lock()
+	if _, ok := handleCache.emails[h]; !ok {
+		handleCache.emails[h] = email
+	}
+	handleCache.Unlock()
+
+	return h
+}
+
+// Every known user's handle -> address.
+var loadHandles = func() (map[string]string, error) {
+	ul, err := listUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]string{}
+	for _, e := range ul {
+		rv[computeHandle(e)] = e
+	}
+	return rv, nil
+}
+
+// The address behind a handle, or "" if we don't know of one.  Handles
+// we haven't handed out are looked for among all users at most once
+// per handleCacheTime, so made up handles can't make us scan them
+// on every request.
+func emailForHandle(h string) string {
+	if isGroupPrincipal(h) {
+		return h
+	}
+
+	handleCache.Lock()
+	defer handleCache.Unlock()
+
+	if e, ok := handleCache.emails[h]; ok {
+		return e
+	}
+	if time.Since(handleCache.scanned) < handleCacheTime {
+		return ""
+	}
+
+	handles, err := loadHandles()
+	handleCache.scanned = time.Now()
+	if err != nil {
+		log.Printf("Error loading user handles: %v", err)
+		return ""
+	}
+	for k, e := range handles {
+		if _, ok := handleCache.emails[k]; !ok {
+			handleCache.emails[k] = e
+		}
+	}
+	return handleCache.emails[h]
+}
+
+var nameAndAddrRE = regexp.MustCompile(`<([^>]+)>\s*$`)
+
+// Turn what a client gave us to name someone into an address or
+// group.  We accept addresses, groups, handles, and the
+// "Name <handle or address>" form the user list hands out.
+func resolvePrincipal(s string) string {
+	s = strings.TrimSpace(s)
+	if m := nameAndAddrRE.FindStringSubmatch(s); m != nil {
+		s = strings.TrimSpace(m[1])
+	}
+	if strings.Contains(s, "@") {
+		return canonicalEmail(s)
+	}
+	if s == "" || isGroupPrincipal(s) {
+		return s
+	}
+	if e := emailForHandle(s); e != "" {
+		return e
+	}
+	return s
+}
+
+// How someone is shown to other users.
+func displayNameFor(email string) string {
+	if n := getDisplayNames()[email]; n != "" {
+		return n
+	}
+	return Email(email).shortEmail()
+}
+
+const displayNameCacheTime = 30 * time.Second
+
+var displayNameCache = struct {
+	sync.Mutex
+	names   map[string]string
+	fetched time.Time
+}{}
+
+var loadDisplayNames = func() (map[string]string, error) {
+	args := map[string]interface{}{
+		"stale": false,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Key   string
+			Value string
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "display_names", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]string{}
+	for _, row := range viewRes.Rows {
+		rv[row.Key] = row.Value
+	}
+	return rv, nil
+}
+
+func getDisplayNames() map[string]string {
+	displayNameCache.Lock()
+	defer displayNameCache.Unlock()
+
+	if displayNameCache.names != nil &&
+		time.Since(displayNameCache.fetched) < displayNameCacheTime {
+		return displayNameCache.names
+	}
+
+	names, err := loadDisplayNames()
+	if err != nil {
+		log.Printf("Error loading display names: %v", err)
+		if displayNameCache.names != nil {
+			return displayNameCache.names
+		}
+		return map[string]string{}
+	}
+	displayNameCache.names = names
+	displayNameCache.fetched = time.Now()
+	return names
+}
+
+func forgetDisplayNames() {
+	displayNameCache.Lock()
+	defer displayNameCache.Unlock()
+	displayNameCache.names = nil
+}
+
+// A response along with the request it's for, so mustEncode can tell
+// who'll see it.
+type viewerWriter struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+func withViewer(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(viewerWriter{w, r}, r)
+	})
+}
+
+// Whether what's written to w may include people's full addresses.
+func showsAddresses(w io.Writer) bool {
+	vw, ok := w.(viewerWriter)
+	return ok && userCan(whoami(vw.r), permUsersView)
+}
+
+// Add the address behind each handle an Email was marshaled with.
+func addAddresses(v interface{}) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		h, ok := x["handle"].(string)
+		if _, named := x["email"]; ok && named && !isGroupPrincipal(h) {
+			if e := emailForHandle(h); e != "" {
+				x["address"] = e
+			}
+		}
+		for _, c := range x {
+			addAddresses(c)
+		}
+	case []interface{}:
+		for _, c := range x {
+			addAddresses(c)
+		}
+	}
+}
+
+// Look someone up by handle.  Only those who may see user details get
+// the address.
+func serveUserByHandle(w http.ResponseWriter, r *http.Request) {
+	h := mux.Vars(r)["handle"]
+	email := emailForHandle(h)
+	if email == "" {
+		showError(w, r, "No such user", 404)
+		return
+	}
+
+	rv := map[string]interface{}{
+		"handle": h,
+		"name":   displayNameFor(email),
+		"away":   awayJSON(email),
+	}
+	if userCan(whoami(r), permUsersView) {
+		rv["address"] = email
+	}
+	mustEncode(w, rv)
+}
+
+var avatarClient = &http.Client{Timeout: 10 * time.Second}
+
+// Serve someone's uploaded avatar or, failing that, their gravatar
+// without telling the browser the md5 it's fetched by.
+func serveAvatar(w http.ResponseWriter, r *http.Request) {
+	email := emailForHandle(mux.Vars(r)["handle"])
+	if serveUploadedAvatar(w, r, email) {
+		return
+	}
+
+	size, err := strconv.Atoi(r.FormValue("s"))
+	if err != nil || size <= 0 || size > 512 {
+		size = 32
+	}
+
+	res, err := avatarClient.Get("https://www.gravatar.com/avatar/" +
+		md5string(strings.ToLower(email)) + "?d=identicon&s=" +
+		strconv.Itoa(size))
+	if err != nil {
+		showError(w, r, err.Error(), 502)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		showError(w, r, "Error fetching avatar: "+res.Status, 502)
+		return
+	}
+
+	w.Header().Set("Content-Type", res.Header.Get("Content-Type"))
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	io.Copy(w, res.Body)
+}
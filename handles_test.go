@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func withDisplayNames(names map[string]string) func() {
+	origLoad := loadDisplayNames
+	loadDisplayNames = func() (map[string]string, error) {
+		return names, nil
+	}
+	forgetDisplayNames()
+	return func() {
+		loadDisplayNames = origLoad
+		forgetDisplayNames()
+	}
+}
+
+func TestHandles(t *testing.T) {
+	defer withAliases(map[string]string{})()
+
+	a := handleFor("dustin@spy.net")
+	b := handleFor("aaron@crate.im")
+
+	if a == "" || a == b {
+		t.Fatalf("Expected distinct handles, got %q and %q", a, b)
+	}
+	if a == md5string("dustin@spy.net") {
+		t.Errorf("Handle is just the md5")
+	}
+	if handleFor("Dustin@Spy.net") != a {
+		t.Errorf("Handles should ignore case")
+	}
+	if handleFor("group:qa") != "group:qa" {
+		t.Errorf("Groups should be their own handle")
+	}
+
+	tests := []struct {
+		in, exp string
+	}{
+		{"dustin@spy.net", "dustin@spy.net"},
+		{" dustin@spy.net ", "dustin@spy.net"},
+		{a, "dustin@spy.net"},
+		{"Dustin <" + a + ">", "dustin@spy.net"},
+		{"Aaron <aaron@crate.im>", "aaron@crate.im"},
+		{"group:qa", "group:qa"},
+		{"", ""},
+	}
+
+	for _, x := range tests {
+		if got := resolvePrincipal(x.in); got != x.exp {
+			t.Errorf("resolvePrincipal(%q) = %q, expected %q",
+				x.in, got, x.exp)
+		}
+	}
+}
+
+func TestEmailForHandleScansOnce(t *testing.T) {
+	scans := 0
+	origLoad := loadHandles
+	defer func() {
+		loadHandles = origLoad
+		handleCache.Lock()
+		handleCache.scanned = time.Time{}
+		handleCache.Unlock()
+	}()
+	loadHandles = func() (map[string]string, error) {
+		scans++
+		return map[string]string{
+			computeHandle("quiet@example.com"): "quiet@example.com",
+		}, nil
+	}
+
+	handleCache.Lock()
+	handleCache.scanned = time.Time{}
+	handleCache.Unlock()
+
+	// Someone whose handle we haven't handed out yet.
+	quiet := computeHandle("quiet@example.com")
+	if got := emailForHandle(quiet); got != "quiet@example.com" {
+		t.Errorf("Expected to find quiet@example.com, got %q", got)
+	}
+	for _, h := range []string{"unope", "ubogus", "u0123"} {
+		if got := emailForHandle(h); got != "" {
+			t.Errorf("Expected nobody for %v, got %q", h, got)
+		}
+	}
+	if scans != 1 {
+		t.Errorf("Expected one scan of the users, got %v", scans)
+	}
+}
+
+func TestAddressesForViewers(t *testing.T) {
+	defer withRoles(nil)()
+	defer withGroups()()
+	defer withAliases(map[string]string{})()
+	defer withDisplayNames(map[string]string{})()
+	defer withAway(map[string]Away{})()
+	defer withUsers(map[string]User{
+		"i@example.com": {Id: "i@example.com", Type: "user", Internal: true},
+	})()
+	now := time.Now().UTC()
+	defer withSessions(map[string]Session{
+		"is": {Id: "is", Type: "session", User: "i@example.com",
+			CreatedAt: now, LastSeen: now, ExpiresAt: now.Add(time.Hour)},
+		"ps": {Id: "ps", Type: "session", User: "p@example.com",
+			CreatedAt: now, LastSeen: now, ExpiresAt: now.Add(time.Hour)},
+	})()
+
+	h := withViewer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mustEncode(w, map[string]interface{}{
+			"owner":       Email("dustin@spy.net"),
+			"subscribers": []Email{"aaron@crate.im", "group:qa"},
+			"count":       3,
+		})
+	}))
+
+	get := func(cookie *http.Cookie) map[string]interface{} {
+		req := httptest.NewRequest("GET", "/api/bug/bug-1", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		rv := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &rv); err != nil {
+			t.Fatalf("Error decoding %s: %v", w.Body, err)
+		}
+		return rv
+	}
+	address := func(v interface{}) interface{} {
+		return v.(map[string]interface{})["address"]
+	}
+
+	internal := get(sessionCookie(t, "i@example.com", "is"))
+	subs := internal["subscribers"].([]interface{})
+	if address(internal["owner"]) != "dustin@spy.net" ||
+		address(subs[0]) != "aaron@crate.im" {
+		t.Errorf("Expected addresses for an internal user, got %v", internal)
+	}
+	if address(subs[1]) != nil || internal["count"] != 3.0 {
+		t.Errorf("Expected everything else left alone, got %v", internal)
+	}
+
+	for _, c := range []*http.Cookie{sessionCookie(t, "p@example.com", "ps"), nil} {
+		got := get(c)
+		if address(got["owner"]) != nil ||
+			address(got["subscribers"].([]interface{})[0]) != nil {
+			t.Errorf("Expected no addresses for %v, got %v", c, got)
+		}
+	}
+}
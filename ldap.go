@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var ldapURL = flag.String("ldapURL", "", "LDAP server URL (ldap:// or ldaps://)")
+var ldapBindDN = flag.String("ldapBindDN", "",
+	"DN to bind as when looking up users (empty for anonymous)")
+var ldapBindPassword = flag.String("ldapBindPassword", "",
+	"password for ldapBindDN")
+var ldapBaseDN = flag.String("ldapBaseDN", "", "where to search for users")
+var ldapUserFilter = flag.String("ldapUserFilter", "(mail=%s)",
+	"LDAP filter finding a user by the name they log in with")
+var ldapMailAttr = flag.String("ldapMailAttr", "mail",
+	"LDAP attribute holding the user's email address")
+var ldapInternalGroup = flag.String("ldapInternalGroup", "",
+	"DN of the group whose members are internal (empty to leave alone)")
+var ldapAdminGroup = flag.String("ldapAdminGroup", "",
+	"DN of the group whose members are admins (empty to leave alone)")
+
+var ldapNotConfigured = errors.New("LDAP login is not configured")
+
+type ldapEntry struct {
+	DN    string
+	Attrs map[string][]string
+}
+
+// The parts of an LDAP directory we need.
+type ldapDirectory interface {
+	Bind(dn, password string) error
+	Search(base, filter string, attrs []string) ([]ldapEntry, error)
+	Close()
+}
+
+var ldapDial = func(u string) (ldapDirectory, error) {
+	c, err := ldap.DialURL(u)
+	if err != nil {
+		return nil, err
+	}
+	return goLDAPDirectory{c}, nil
+}
+
+type goLDAPDirectory struct {
+	c *ldap.Conn
+}
+
+func (d goLDAPDirectory) Bind(dn, password string) error {
+	return d.c.Bind(dn, password)
+}
+
+func (d goLDAPDirectory) Search(base, filter string, attrs []string) ([]ldapEntry, error) {
+	res, err := d.c.Search(ldap.NewSearchRequest(base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		filter, attrs, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []ldapEntry{}
+	for _, e := range res.Entries {
+		ent := ldapEntry{e.DN, map[string][]string{}}
+		for _, a := range e.Attributes {
+			ent.Attrs[a.Name] = a.Values
+		}
+		rv = append(rv, ent)
+	}
+	return rv, nil
+}
+
+func (d goLDAPDirectory) Close() {
+	d.c.Close()
+}
+
+// Escape a value for use in a search filter (RFC 4515).
+func ldapEscape(s string) string {
+	rv := ""
+	for _, b := range []byte(s) {
+		switch {
+		case b == '*' || b == '(' || b == ')' || b == '\\' || b == 0 || b > 0x7f:
+			rv += fmt.Sprintf(`\%02x`, b)
+		default:
+			rv += string(b)
+		}
+	}
+	return rv
+}
+
+func containsFold(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if strings.EqualFold(s, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// Users in an LDAP directory.
+type ldapProvider struct{}
+
+func (ldapProvider) Name() string { return "ldap" }
+
+func (ldapProvider) Login(w http.ResponseWriter, r *http.Request) (AuthResult, error) {
+	username, password, err := passwordCredentials(r)
+	if err != nil {
+		return AuthResult{}, err
+	}
+	return ldapAuthenticate(username, password)
+}
+
+// Find the user, then bind as them to check their password.
+func ldapAuthenticate(username, password string) (AuthResult, error) {
+	if *ldapURL == "" || *ldapBaseDN == "" {
+		return AuthResult{}, ldapNotConfigured
+	}
+	// An empty password would be an anonymous bind, which "succeeds".
+	if username == "" || password == "" {
+		return AuthResult{}, badCredentials
+	}
+
+	dir, err := ldapDial(*ldapURL)
+	if err != nil {
+		return AuthResult{}, err
+	}
+	defer dir.Close()
+
+	if *ldapBindDN != "" {
+		err = dir.Bind(*ldapBindDN, *ldapBindPassword)
+		if err != nil {
+			return AuthResult{}, fmt.Errorf("Error binding to directory: %v", err)
+		}
+	}
+
+	entries, err := dir.Search(*ldapBaseDN,
+		fmt.Sprintf(*ldapUserFilter, ldapEscape(username)),
+		[]string{*ldapMailAttr, "memberOf"})
+	if err != nil {
+		return AuthResult{}, err
+	}
+	if len(entries) != 1 {
+		return AuthResult{}, badCredentials
+	}
+	ent := entries[0]
+
+	if dir.Bind(ent.DN, password) != nil {
+		return AuthResult{}, badCredentials
+	}
+
+	mails := ent.Attrs[*ldapMailAttr]
+	if len(mails) == 0 || mails[0] == "" {
+		return AuthResult{}, fmt.Errorf("No %v for %v", *ldapMailAttr, ent.DN)
+	}
+
+	rv := AuthResult{Email: mails[0]}
+	groups := ent.Attrs["memberOf"]
+	if *ldapInternalGroup != "" {
+		internal := containsFold(groups, *ldapInternalGroup)
+		rv.Internal = &internal
+	}
+	if *ldapAdminGroup != "" {
+		admin := containsFold(groups, *ldapAdminGroup)
+		rv.Admin = &admin
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// An in-memory directory understanding just enough filter syntax for
+// the default user filter.
+type fakeDirectory struct {
+	passwords map[string]string
+	entries   []ldapEntry
+	bound     string
+}
+
+func (d *fakeDirectory) Bind(dn, password string) error {
+	if p, ok := d.passwords[dn]; !ok || p != password {
+		return errors.New("invalid credentials")
+	}
+	d.bound = dn
+	return nil
+}
+
+func (d *fakeDirectory) Search(base, filter string, attrs []string) ([]ldapEntry, error) {
+	if d.bound == "" {
+		return nil, errors.New("not bound")
+	}
+	if !strings.HasPrefix(filter, "(") || !strings.HasSuffix(filter, ")") {
+		return nil, errors.New("bad filter " + filter)
+	}
+	parts := strings.SplitN(filter[1:len(filter)-1], "=", 2)
+	rv := []ldapEntry{}
+	for _, e := range d.entries {
+		if !strings.HasSuffix(e.DN, base) {
+			continue
+		}
+		for _, v := range e.Attrs[parts[0]] {
+			if ldapEscape(v) == parts[1] {
+				rv = append(rv, e)
+			}
+		}
+	}
+	return rv, nil
+}
+
+func (d *fakeDirectory) Close() {}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	dir := &fakeDirectory{
+		passwords: map[string]string{
+			"cn=cbugg,dc=example,dc=com":            "service",
+			"uid=alice,ou=people,dc=example,dc=com": "alicepw",
+			"uid=bob,ou=people,dc=example,dc=com":   "bobpw",
+		},
+		entries: []ldapEntry{
+			{"uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+				"mail": {"alice@example.com"},
+				"memberOf": {"cn=staff,ou=groups,dc=example,dc=com",
+					"CN=Admins,ou=groups,dc=example,dc=com"},
+			}},
+			{"uid=bob,ou=people,dc=example,dc=com", map[string][]string{
+				"mail": {"bob@example.com"},
+			}},
+		},
+	}
+
+	origDial := ldapDial
+	ldapDial = func(string) (ldapDirectory, error) {
+		dir.bound = ""
+		return dir, nil
+	}
+	*ldapURL = "ldap://fake"
+	*ldapBaseDN = "ou=people,dc=example,dc=com"
+	*ldapBindDN = "cn=cbugg,dc=example,dc=com"
+	*ldapBindPassword = "service"
+	*ldapInternalGroup = "cn=staff,ou=groups,dc=example,dc=com"
+	*ldapAdminGroup = "cn=admins,ou=groups,dc=example,dc=com"
+	defer func() {
+		ldapDial = origDial
+		*ldapURL, *ldapBaseDN, *ldapBindDN, *ldapBindPassword = "", "", "", ""
+		*ldapInternalGroup, *ldapAdminGroup = "", ""
+	}()
+
+	tests := []struct {
+		User, Password string
+		Err            error
+		Email          string
+		Internal       bool
+		Admin          bool
+	}{
+		{"alice@example.com", "alicepw", nil, "alice@example.com", true, true},
+		{"bob@example.com", "bobpw", nil, "bob@example.com", false, false},
+		{"alice@example.com", "bobpw", badCredentials, "", false, false},
+		{"alice@example.com", "", badCredentials, "", false, false},
+		{"nobody@example.com", "x", badCredentials, "", false, false},
+		{"*", "alicepw", badCredentials, "", false, false},
+	}
+
+	for _, x := range tests {
+		res, err := ldapAuthenticate(x.User, x.Password)
+		if err != x.Err {
+			t.Errorf("On %v/%v, expected error %v, got %v",
+				x.User, x.Password, x.Err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if res.Email != x.Email || res.Internal == nil || res.Admin == nil ||
+			*res.Internal != x.Internal || *res.Admin != x.Admin {
+			t.Errorf("On %v, expected %v internal=%v admin=%v, got %+v",
+				x.User, x.Email, x.Internal, x.Admin, res)
+		}
+	}
+
+	// Without group configuration, membership is left alone.
+	*ldapInternalGroup, *ldapAdminGroup = "", ""
+	res, err := ldapAuthenticate("alice@example.com", "alicepw")
+	if err != nil || res.Internal != nil || res.Admin != nil {
+		t.Errorf("Expected no group mapping, got %+v, %v", res, err)
+	}
+}
+
+func TestLDAPEscape(t *testing.T) {
+	tests := []struct {
+		In, Exp string
+	}{
+		{"alice@example.com", "alice@example.com"},
+		{"*", `\2a`},
+		{"a)(uid=*", `a\29\28uid=\2a`},
+		{`back\slash`, `back\5cslash`},
+		{"café", `caf\c3\a9`},
+	}
+
+	for _, x := range tests {
+		got := ldapEscape(x.In)
+		if got != x.Exp {
+			t.Errorf("ldapEscape(%q) = %q, expected %q", x.In, got, x.Exp)
+		}
+	}
+}
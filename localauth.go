@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Used to spend the same time on unknown users as on known ones.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"),
+	bcrypt.DefaultCost)
+
+// Usernames and bcrypt hashed passwords stored on the user document.
+type localProvider struct{}
+
+func (localProvider) Name() string { return "local" }
+
+func (localProvider) Login(w http.ResponseWriter, r *http.Request) (AuthResult, error) {
+	email, password, err := passwordCredentials(r)
+	if err != nil {
+		return AuthResult{}, err
+	}
+
+	u, err := getUser(email)
+	hash := []byte(u.PasswordHash)
+	if err != nil || len(hash) == 0 {
+		hash = dummyPasswordHash
+	}
+
+	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil || u.PasswordHash == "" {
+		return AuthResult{}, badCredentials
+	}
+
+	return AuthResult{Email: u.Id}, nil
+}
+
+func setPassword(email, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return db.Update("u-"+email, 0, func(current []byte) ([]byte, error) {
+		user := User{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &user)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Common fields
+		user.Id = email
+		user.Type = "user"
+
+		user.PasswordHash = string(hash)
+
+		return json.Marshal(user)
+	})
+}
+
+func serveSetMyPassword(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
+
+	if me.PasswordHash != "" {
+		err := bcrypt.CompareHashAndPassword([]byte(me.PasswordHash),
+			[]byte(r.FormValue("old")))
+		if err != nil {
+			showError(w, r, "Current password is incorrect", 403)
+			return
+		}
+	} else if !freshLogin(r, me.Id) {
+		showError(w, r, "Log in again to set a password", 403)
+		return
+	}
+
+	password := r.FormValue("new")
+	if len(password) < 8 {
+		showError(w, r, "Password must be at least 8 characters", 400)
+		return
+	}
+
+	err := setPassword(me.Id, password)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	audit(r, me.Id, "password.change", me.Id, nil)
+
+	w.WriteHeader(204)
+}
+
+// Admins reset a password by generating a new one to hand the user.
+func serveAdminPasswordReset(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		showError(w, r, "no email given", 400)
+		return
+	}
+
+	password := randstring(16)
+	err := setPassword(email, password)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	audit(r, whoami(r).Id, "password.reset", email, nil)
+
+	mustEncode(w, map[string]string{"email": email, "password": password})
+}
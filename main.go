@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -60,7 +61,9 @@ func errorCode(err error) int {
 	switch {
 	case err == bugNotVisible:
 		return 401
-	case gomemcached.IsNotFound(err):
+	case err == accountDeactivated:
+		return 403
+	case err == NotFound, gomemcached.IsNotFound(err):
 		return 404
 	}
 	return 500
@@ -78,12 +81,33 @@ func mustEncode(w io.Writer, i interface{}) {
 		headered.Header().Set("Content-type", "application/json")
 	}
 
+	if showsAddresses(w) {
+		i = withAddresses(i)
+	}
+
 	e := json.NewEncoder(w)
 	if err := e.Encode(i); err != nil {
 		panic(err)
 	}
 }
 
+// i as it would be encoded, with addresses added for those who may
+// see them.
+func withAddresses(i interface{}) interface{} {
+	d, err := json.Marshal(i)
+	if err != nil {
+		panic(err)
+	}
+	var rv interface{}
+	dec := json.NewDecoder(bytes.NewReader(d))
+	dec.UseNumber()
+	if err := dec.Decode(&rv); err != nil {
+		panic(err)
+	}
+	addAddresses(rv)
+	return rv
+}
+
 func serveStateCounts(w http.ResponseWriter, r *http.Request) {
 	args := map[string]interface{}{"group_level": 1, "stale": false}
 	states, err := db.View("cbugg", "by_state", args)
@@ -134,14 +158,6 @@ func authRequired(r *http.Request, rm *mux.RouteMatch) bool {
 	return whoami(r).Id != ""
 }
 
-func internalRequired(r *http.Request, rm *mux.RouteMatch) bool {
-	return whoami(r).Internal
-}
-
-func adminRequired(r *http.Request, rm *mux.RouteMatch) bool {
-	return whoami(r).Admin
-}
-
 func notAuthed(w http.ResponseWriter, r *http.Request) {
 	showError(w, r, "You are not authorized", 401)
 }
@@ -186,7 +202,8 @@ func main() {
 
 	r := mux.NewRouter()
 	// Bug CRUD
-	r.HandleFunc("/api/bug/", serveNewBug).Methods("POST").MatcherFunc(authRequired)
+	r.HandleFunc("/api/bug/", rateLimited("write", serveNewBug)).Methods("POST").MatcherFunc(
+		permRequired(permBugCreate))
 	r.HandleFunc("/api/bug/", notAuthed).Methods("POST")
 	r.HandleFunc("/api/bug/", serveBugList).Methods("GET")
 
@@ -194,7 +211,7 @@ func main() {
 	r.HandleFunc("/api/bug/{bugid}",
 		serveBugUpdate).Methods("POST").MatcherFunc(authRequired)
 	r.HandleFunc("/api/bug/{bugid}",
-		serveBugDeletion).Methods("DELETE").MatcherFunc(adminRequired)
+		serveBugDeletion).Methods("DELETE").MatcherFunc(permRequired(permBugDelete))
 	r.HandleFunc("/api/bug/{bugid}", notAuthed).Methods("POST", "DELETE")
 
 	// Bug history
@@ -202,7 +219,7 @@ func main() {
 
 	// Attachments
 	r.HandleFunc("/api/bug/{bugid}/attachments/",
-		serveFileUpload).Methods("POST").MatcherFunc(authRequired)
+		serveFileUpload).Methods("POST").MatcherFunc(permRequired(permBugAttach))
 	r.HandleFunc("/api/bug/{bugid}/attachments/", notAuthed).Methods("POST")
 	r.HandleFunc("/api/bug/{bugid}/attachments/",
 		serveAttachmentList).Methods("GET")
@@ -215,10 +232,25 @@ func main() {
 	r.HandleFunc("/api/bug/{bugid}/attachments/{attid}/",
 		notAuthed).Methods("DELETE")
 
+	// Resumable uploads
+	r.HandleFunc("/api/bug/{bugid}/uploads/",
+		serveNewUpload).Methods("POST").MatcherFunc(permRequired(permBugAttach))
+	r.HandleFunc("/api/bug/{bugid}/uploads/{upid}",
+		serveUploadStatus).Methods("GET").MatcherFunc(authRequired)
+	r.HandleFunc("/api/bug/{bugid}/uploads/{upid}",
+		serveUploadChunk).Methods("PUT").MatcherFunc(permRequired(permBugAttach))
+	r.HandleFunc("/api/bug/{bugid}/uploads/{upid}",
+		serveAbortUpload).Methods("DELETE").MatcherFunc(authRequired)
+	r.HandleFunc("/api/bug/{bugid}/uploads/{upid}/done",
+		serveFinishUpload).Methods("POST").MatcherFunc(permRequired(permBugAttach))
+	r.HandleFunc("/api/bug/{bugid}/uploads/", notAuthed).Methods("POST")
+	r.HandleFunc("/api/bug/{bugid}/uploads/{upid}", notAuthed)
+	r.HandleFunc("/api/bug/{bugid}/uploads/{upid}/done", notAuthed)
+
 	// comments
 	r.HandleFunc("/api/bug/{bugid}/comments/", serveCommentList).Methods("GET")
 	r.HandleFunc("/api/bug/{bugid}/comments/",
-		serveNewComment).Methods("POST").MatcherFunc(authRequired)
+		rateLimited("write", serveNewComment)).Methods("POST").MatcherFunc(permRequired(permBugComment))
 	r.HandleFunc("/api/bug/{bugid}/comments/", notAuthed).Methods("POST")
 	r.HandleFunc("/api/bug/{bugid}/comments/{commid}",
 		serveDelComment).Methods("DELETE").MatcherFunc(authRequired)
@@ -227,42 +259,113 @@ func main() {
 		serveUnDelComment).Methods("POST").MatcherFunc(authRequired)
 	r.HandleFunc("/api/bug/{bugid}/comments/{commid}/undel", notAuthed).Methods("POST")
 	r.HandleFunc("/api/bug/{bugid}/comments/{commid}",
-		serveCommentUpdate).Methods("POST").MatcherFunc(authRequired)
+		serveCommentUpdate).Methods("POST").MatcherFunc(permRequired(permBugComment))
+	r.HandleFunc("/api/bug/{bugid}/comments/{commid}", notAuthed).Methods("POST")
+	r.HandleFunc("/api/bug/{bugid}/comments/{commid}/history",
+		serveCommentHistory).Methods("GET")
 
 	// Bug subscriptions
 	r.HandleFunc("/api/bug/{bugid}/sub/",
-		serveSubscribeBug).Methods("POST").MatcherFunc(authRequired)
+		serveSubscribeBug).Methods("POST").MatcherFunc(permRequired(permBugSubscribe))
 	r.HandleFunc("/api/bug/{bugid}/sub/",
-		serveUnsubscribeBug).Methods("DELETE").MatcherFunc(authRequired)
+		serveUnsubscribeBug).Methods("DELETE").MatcherFunc(permRequired(permBugSubscribe))
 	r.HandleFunc("/api/bug/{bugid}/sub/", notAuthed)
 
 	// Private bug visibility
 	r.HandleFunc("/api/bug/{bugid}/viewer/add/",
-		serveAddBugViewer).Methods("POST").MatcherFunc(internalRequired)
+		serveAddBugViewer).Methods("POST").MatcherFunc(permRequired(permPrivateManage))
 	r.HandleFunc("/api/bug/{bugid}/viewer/remove/",
-		serveRemoveBugViewer).Methods("POST").MatcherFunc(internalRequired)
+		serveRemoveBugViewer).Methods("POST").MatcherFunc(permRequired(permPrivateManage))
 
 	// Bug Pinging
 	r.HandleFunc("/api/bug/{bugid}/ping/",
-		serveBugPing).Methods("POST").MatcherFunc(authRequired)
+		rateLimited("ping", serveBugPing)).Methods("POST").MatcherFunc(permRequired(permBugComment))
 	r.HandleFunc("/api/bug/{bugid}/ping/",
 		notAuthed).Methods("POST")
 	// Or yourself, later.
 	r.HandleFunc("/api/bug/{bugid}/remindme/",
-		serveNewReminder).Methods("POST").MatcherFunc(authRequired)
+		serveNewReminder).Methods("POST").MatcherFunc(permRequired(permBugSubscribe))
 	r.HandleFunc("/api/bug/{bugid}/remindme/",
 		notAuthed).Methods("POST")
 
 	// User list
 	r.HandleFunc("/api/users/", serveUserList).Methods("GET")
-	r.HandleFunc("/api/users/special/", serveSpecialUserList).Methods("GET")
-	r.HandleFunc("/api/users/mod/", serveAdminUserMod).Methods("POST")
+	r.HandleFunc("/api/users/handle/{handle}", serveUserByHandle).Methods("GET")
+	r.HandleFunc("/api/avatar/{handle}", serveAvatar).Methods("GET")
+	r.HandleFunc("/api/users/special/", serveSpecialUserList).Methods("GET").
+		MatcherFunc(permRequired(permUsersView))
+	r.HandleFunc("/api/users/special/", notAuthed).Methods("GET")
+	r.HandleFunc("/api/users/mod/", serveAdminUserMod).Methods("POST").
+		MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/users/password/",
+		serveAdminPasswordReset).Methods("POST").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/users/sessions/",
+		serveAdminRevokeSessions).Methods("DELETE").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/users/export/",
+		serveUserExport).Methods("GET").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/users/erase/",
+		serveUserErase).Methods("POST").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/users/deactivate/",
+		serveDeactivationReport).Methods("GET").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/users/deactivate/",
+		serveDeactivateUser).Methods("POST").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/users/reactivate/",
+		serveReactivateUser).Methods("POST").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/users/merge/",
+		serveMergeUsers).Methods("POST").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/users/mod/", notAuthed).Methods("POST")
+	r.HandleFunc("/api/users/export/", notAuthed).Methods("GET")
+	r.HandleFunc("/api/users/erase/", notAuthed).Methods("POST")
+	r.HandleFunc("/api/users/deactivate/", notAuthed).Methods("GET", "POST")
+	r.HandleFunc("/api/users/reactivate/", notAuthed).Methods("POST")
+	r.HandleFunc("/api/users/merge/", notAuthed).Methods("POST")
+	r.HandleFunc("/api/users/password/", notAuthed).Methods("POST")
+	r.HandleFunc("/api/users/sessions/", notAuthed).Methods("DELETE")
+
+	// Roles
+	r.HandleFunc("/api/roles/", serveRoleList).Methods("GET")
+	r.HandleFunc("/api/roles/{role}",
+		serveSetRole).Methods("POST").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/roles/{role}",
+		serveDeleteRole).Methods("DELETE").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/roles/{role}", notAuthed).Methods("POST", "DELETE")
+
+	// Audit log
+	r.HandleFunc("/api/audit/",
+		serveAuditLog).Methods("GET").MatcherFunc(permRequired(permAuditRead))
+	r.HandleFunc("/api/audit/", notAuthed).Methods("GET")
+
+	// Groups
+	r.HandleFunc("/api/groups/", serveGroupList).Methods("GET")
+	r.HandleFunc("/api/groups/{group}", serveGroup).Methods("GET")
+	r.HandleFunc("/api/groups/{group}",
+		serveSetGroup).Methods("POST").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/groups/{group}",
+		serveDeleteGroup).Methods("DELETE").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/groups/{group}", notAuthed).Methods("POST", "DELETE")
+	r.HandleFunc("/api/groups/{group}/members/",
+		serveAddGroupMember).Methods("POST").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/groups/{group}/members/",
+		serveRemoveGroupMember).Methods("DELETE").MatcherFunc(permRequired(permUsersAdmin))
+	r.HandleFunc("/api/groups/{group}/members/", notAuthed).Methods("POST", "DELETE")
 
 	// All about tags
 	r.HandleFunc("/api/tags/", serveTagList).Methods("GET")
 	r.HandleFunc("/api/tags/{tag}/", serveTagStates).Methods("GET")
 	r.HandleFunc("/api/tags/{tag}/css/",
-		serveTagCSSUpdate).Methods("POST").MatcherFunc(internalRequired)
+		serveTagCSSUpdate).Methods("POST").MatcherFunc(tagEditRequired)
+	r.HandleFunc("/api/tags/{tag}/meta/",
+		serveTagMetaUpdate).Methods("POST").MatcherFunc(tagEditRequired)
+	r.HandleFunc("/api/tags/merge/",
+		serveMergeTagList).Methods("POST").MatcherFunc(permRequired(permTagAdmin))
+	r.HandleFunc("/api/tags/{tag}/rename/",
+		serveRenameTag).Methods("POST").MatcherFunc(permRequired(permTagAdmin))
+	r.HandleFunc("/api/tags/{tag}/deprecated/",
+		serveDeprecateTag).Methods("POST").MatcherFunc(permRequired(permTagAdmin))
+	r.HandleFunc("/api/tags/{tag}/deprecated/",
+		serveUndeprecateTag).Methods("DELETE").MatcherFunc(permRequired(permTagAdmin))
+	r.HandleFunc("/api/tags/{tag}/parent/",
+		serveSetTagParent).Methods("POST").MatcherFunc(tagEditRequired)
 	r.HandleFunc("/api/tags/{tag}/sub/",
 		serveSubscribeTag).Methods("POST").MatcherFunc(authRequired)
 	r.HandleFunc("/api/tags/{tag}/sub/",
@@ -282,20 +385,53 @@ func main() {
 	r.HandleFunc("/api/me/prefs/",
 		serveSetMyPrefs).Methods("POST").MatcherFunc(authRequired)
 	r.HandleFunc("/api/me/prefs/", notAuthed).Methods("POST")
-	r.HandleFunc("/api/me/token/",
-		serveUserAuthToken).Methods("GET").MatcherFunc(authRequired)
-	r.HandleFunc("/api/me/token/",
-		serveUpdateUserAuthToken).Methods("POST").MatcherFunc(authRequired)
-	r.HandleFunc("/api/me/token/", notAuthed)
+	r.HandleFunc("/api/me/profile/",
+		serveMyProfile).Methods("GET").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/profile/",
+		serveSetMyProfile).Methods("POST").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/profile/avatar/",
+		serveSetMyAvatar).Methods("POST").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/profile/avatar/",
+		serveDeleteMyAvatar).Methods("DELETE").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/away/",
+		serveMyAway).Methods("GET").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/away/",
+		serveSetMyAway).Methods("POST").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/away/",
+		serveClearMyAway).Methods("DELETE").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/profile/", notAuthed)
+	r.HandleFunc("/api/me/profile/avatar/", notAuthed)
+	r.HandleFunc("/api/me/away/", notAuthed)
+	r.HandleFunc("/api/me/tokens/",
+		serveTokenList).Methods("GET").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/tokens/",
+		serveNewToken).Methods("POST").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/tokens/{tokid}",
+		serveRevokeToken).Methods("DELETE").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/tokens/", notAuthed)
+	r.HandleFunc("/api/me/tokens/{tokid}", notAuthed)
+	r.HandleFunc("/api/me/sessions/",
+		serveMySessions).Methods("GET").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/sessions/",
+		serveRevokeMySessions).Methods("DELETE").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/sessions/{sessid}",
+		serveRevokeMySession).Methods("DELETE").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/sessions/", notAuthed)
+	r.HandleFunc("/api/me/sessions/{sessid}", notAuthed)
+	r.HandleFunc("/api/me/password/",
+		serveSetMyPassword).Methods("POST").MatcherFunc(authRequired)
+	r.HandleFunc("/api/me/password/", notAuthed)
 
 	r.HandleFunc("/hooks/github/issue/", serveGithubIssue).Methods("POST")
 	r.HandleFunc("/hooks/github/pull/", serveGithubPullRequest).Methods("POST")
 	r.HandleFunc("/hooks/github/push/", serveGithubPush).Methods("POST")
 	r.HandleFunc("/api/github/issue/fetch/",
-		serveGithubIssueFetch).MatcherFunc(internalRequired).Methods("POST")
+		serveGithubIssueFetch).MatcherFunc(permRequired(permBugImport)).Methods("POST")
 
 	r.HandleFunc("/api/state-counts", serveStateCounts)
-	r.HandleFunc("/auth/login", serveLogin).Methods("POST")
+	r.HandleFunc("/auth/login", serveLogin).Methods("GET", "POST")
+	r.HandleFunc("/auth/providers", serveAuthProviders).Methods("GET")
+	r.HandleFunc("/auth/oidc/callback", serveOIDCCallback).Methods("GET")
 	r.HandleFunc("/auth/logout", serveLogout).Methods("POST")
 
 	r.HandleFunc("/api/version", serveVersion)
@@ -318,6 +454,7 @@ func main() {
 		"/admin/",
 		"/changes/",
 		"/prefs/",
+		"/login/",
 	}
 
 	for _, p := range appPages {
@@ -338,13 +475,19 @@ func main() {
 	r.Handle("/statecounts", http.RedirectHandler("/statecounts/", 302))
 	r.Handle("/", http.RedirectHandler("/static/app.html", 302))
 
-	http.Handle("/", r)
+	initRateLimits()
+	http.Handle("/", basicAuthThrottle(csrfProtect(withViewer(r))))
 
 	db, err = dbConnect(*cbServ, *cbBucket)
 	if err != nil {
 		log.Fatalf("Error connecting to couchbase: %v", err)
 	}
 
+	err = initHandleKey()
+	if err != nil {
+		log.Fatalf("Error setting up user handles: %v", err)
+	}
+
 	go loadRecent()
 
 	log.Printf("Listening on %v", *addr)
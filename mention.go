@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var mentionRE = regexp.MustCompile(
+	`(?:^|[^\w@.])@(\w[\w.+-]*(?:@[\w-]+(?:\.[\w-]+)+)?)`)
+
+type bugMention struct {
+	bug         Bug
+	to, actor   string
+	text, about string
+}
+
+// Find the distinct @handles in some text, in order of appearance.
+func findMentions(text string) []string {
+	rv := []string{}
+	seen := map[string]bool{}
+	for _, m := range mentionRE.FindAllStringSubmatch(text, -1) {
+		h := strings.TrimRight(m[1], ".")
+		if h != "" && !seen[strings.ToLower(h)] {
+			seen[strings.ToLower(h)] = true
+			rv = append(rv, h)
+		}
+	}
+	return rv
+}
+
+// Resolve a handle to a user's email address.  A handle may either
+// be a full address or the part before the @ as long as that's
+// unambiguous.
+func resolveMention(handle string, users []string) string {
+	if strings.Contains(handle, "@") {
+		handle = canonicalEmail(handle)
+		for _, u := range users {
+			if strings.EqualFold(u, handle) {
+				return u
+			}
+		}
+		return ""
+	}
+
+	rv := ""
+	for _, u := range users {
+		if strings.EqualFold(Email(u).shortEmail(), handle) {
+			if rv != "" {
+				return ""
+			}
+			rv = u
+		}
+	}
+	return rv
+}
+
+// Notify and subscribe users newly mentioned in text (relative to
+// oldText).  ob is the thing containing the text, which may be less
+// visible than the bug itself.  The returned warnings are meant for
+// the actor.
+func notifyMentions(bug Bug, ob interface{}, text, oldText, actor, about string) []string {
+	old := map[string]bool{}
+	for _, h := range findMentions(oldText) {
+		old[strings.ToLower(h)] = true
+	}
+
+	handles := []string{}
+	for _, h := range findMentions(text) {
+		if !old[strings.ToLower(h)] {
+			handles = append(handles, h)
+		}
+	}
+	if len(handles) == 0 {
+		return nil
+	}
+
+	users, err := listUsers()
+	if err != nil {
+		log.Printf("Error listing users for mentions on %v: %v",
+			bug.Id, err)
+		return nil
+	}
+
+	warnings := []string{}
+	for _, h := range handles {
+		email := resolveMention(h, users)
+		if email == "" || email == actor {
+			continue
+		}
+
+		// As with pings, an unknown user just isn't special.
+		u, _ := getUser(email)
+		u.Id = email
+
+		if !(isVisible(bug, u) && isVisible(ob, u)) {
+			warnings = append(warnings,
+				fmt.Sprintf("%v can't see this %v and was not notified",
+					Email(email).shortEmail(), about))
+			continue
+		}
+
+		notifyMention(bug, email, actor, text, about)
+
+		err := updateSubscription(bug.Id, email, true)
+		if err != nil {
+			log.Printf("Error subscribing %v to %v on mention: %v",
+				email, bug.Id, err)
+		}
+	}
+
+	return warnings
+}
+
+func addWarnings(w http.ResponseWriter, warnings []string) {
+	for _, s := range warnings {
+		w.Header().Add("Warning", fmt.Sprintf("199 cbugg %q", s))
+	}
+}
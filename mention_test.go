@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindMentions(t *testing.T) {
+	tests := []struct {
+		In  string
+		Exp []string
+	}{
+		{"", []string{}},
+		{"no mentions here", []string{}},
+		{"@dustin", []string{"dustin"}},
+		{"hey @dustin, look", []string{"dustin"}},
+		{"ask @dustin.", []string{"dustin"}},
+		{"@dustin and @Dustin", []string{"dustin"}},
+		{"cc @dustin@spy.net please", []string{"dustin@spy.net"}},
+		{"mail dustin@spy.net", []string{}},
+		{"@aaron @marty.schoch", []string{"aaron", "marty.schoch"}},
+		{"(@aaron)", []string{"aaron"}},
+	}
+
+	for _, x := range tests {
+		got := findMentions(x.In)
+		if !reflect.DeepEqual(got, x.Exp) {
+			t.Errorf("On %q, expected %v, got %v", x.In, x.Exp, got)
+		}
+	}
+}
+
+func TestResolveMention(t *testing.T) {
+	defer withAliases(map[string]string{})()
+
+	users := []string{
+		"aaron@crate.im",
+		"dustin@couchbase.com",
+		"dustin@spy.net",
+		"marty.schoch@gmail.com",
+	}
+
+	tests := []struct {
+		Handle, Exp string
+	}{
+		{"aaron", "aaron@crate.im"},
+		{"Aaron", "aaron@crate.im"},
+		{"marty.schoch", "marty.schoch@gmail.com"},
+		{"dustin", ""},
+		{"dustin@spy.net", "dustin@spy.net"},
+		{"DUSTIN@SPY.NET", "dustin@spy.net"},
+		{"nobody", ""},
+		{"nobody@example.com", ""},
+	}
+
+	for _, x := range tests {
+		got := resolveMention(x.Handle, users)
+		if got != x.Exp {
+			t.Errorf("On %v, expected %q, got %q", x.Handle, x.Exp, got)
+		}
+	}
+}
@@ -32,6 +32,9 @@ func (b bugChange) IsVisibleTo(u User) bool {
 }
 
 func (b bugChange) changeObjectFor(u User) (Change, error) {
+	if b.bug != nil && !b.bug.IsVisibleTo(u) {
+		return Change{}, bugNotVisible
+	}
 	if b.bug == nil {
 		bug, err := getBugFor(b.bugid, u)
 		if err != nil {
@@ -62,10 +65,12 @@ type bugTagged struct {
 }
 
 var commentChan = make(chan Comment, 100)
+var commentEditChan = make(chan Comment, 100)
 var attachmentChan = make(chan Attachment, 100)
 var bugChan = make(chan bugChange, 100)
 var assignedChan = make(chan string, 100)
 var pingChan = make(chan bugPing, 100)
+var mentionChan = make(chan bugMention, 100)
 var tagChan = make(chan bugTagged, 100)
 
 var bugNotifyDelays map[string]chan bugChange
@@ -85,6 +90,10 @@ func notifyComment(c Comment) {
 	commentChan <- c
 }
 
+func notifyCommentEdit(c Comment) {
+	commentEditChan <- c
+}
+
 func notifyAttachment(a Attachment) {
 	attachmentChan <- a
 }
@@ -93,6 +102,10 @@ func notifyBugPing(b Bug, from, to string) {
 	pingChan <- bugPing{b, from, to}
 }
 
+func notifyMention(b Bug, to, actor, text, about string) {
+	mentionChan <- bugMention{b, to, actor, text, about}
+}
+
 func notifyTagAssigned(bugid, tag, actor string) {
 	tagChan <- bugTagged{bugid, tag, actor}
 }
@@ -125,6 +138,7 @@ func sendNotifications(tmplName string, subs []string,
 	if *mailServer == "" || *mailFrom == "" {
 		log.Printf("Email not configured, would have sent this:")
 		fields["MailTo"] = "someone@example.com"
+		fields["MailToZone"] = ""
 		templates.ExecuteTemplate(os.Stderr, tmplName, fields)
 
 		return
@@ -135,12 +149,17 @@ func sendNotifications(tmplName string, subs []string,
 	for _, to := range subs {
 		buf := &bytes.Buffer{}
 
-		if hasBug && bug.Private && !emailIsInternal(to) {
+		u := userForEmail(to)
+		if u.Deactivated {
+			continue
+		}
+		if hasBug && !isVisible(bug, u) {
 			log.Printf("Skipping private notification of %v to %v", bug, to)
 			continue
 		}
 
 		fields["MailTo"] = to
+		fields["MailToZone"] = u.TimeZone
 		err := templates.ExecuteTemplate(buf, tmplName, fields)
 
 		if err != nil {
@@ -165,7 +184,7 @@ func sendAttachmentNotification(a Attachment) {
 		return
 	}
 
-	to := filterUnprivelegedEmails(b, removeFromList(b.Subscribers, a.User))
+	to := removeFromList(filterUnprivelegedEmails(b, b.Subscribers), a.User)
 
 	sendNotifications("attach_notification", to,
 		map[string]interface{}{
@@ -181,8 +200,46 @@ func sendCommentNotification(c Comment) {
 		return
 	}
 
+	subs := filterUnprivelegedEmails(c, b.Subscribers)
+
+	// The author of the comment being replied to hears about it
+	// whether subscribed or not.
+	if c.InReplyTo != "" {
+		parent, err := getComment(c.InReplyTo)
+		if err != nil {
+			log.Printf("Error getting parent %v of comment %v: %v",
+				c.InReplyTo, c.Id, err)
+		} else if parent.User != c.User {
+			subs = removeFromList(subs, parent.User)
+			to := filterUnprivelegedEmails(b,
+				filterUnprivelegedEmails(c, []string{parent.User}))
+			sendNotifications("reply_notification", to,
+				map[string]interface{}{
+					"Comment": c,
+					"Parent":  parent,
+					"Bug":     b,
+				})
+		}
+	}
+
 	sendNotifications("comment_notification",
-		filterUnprivelegedEmails(c, b.Subscribers),
+		filterUnprivelegedEmails(b, subs),
+		map[string]interface{}{
+			"Comment": c,
+			"Bug":     b,
+		})
+}
+
+func sendCommentEditNotification(c Comment) {
+	b, err := getBug(c.BugId)
+	if err != nil {
+		log.Printf("Error getting bug %v for comment edit notification: %v",
+			c.BugId, err)
+		return
+	}
+
+	sendNotifications("comment_edit_notification",
+		removeFromList(filterUnprivelegedEmails(c, b.Subscribers), c.User),
 		map[string]interface{}{
 			"Comment": c,
 			"Bug":     b,
@@ -216,7 +273,7 @@ func sendBugNotification(bugid string, fields []string,
 	}
 	acts := []string{}
 	for k := range actors {
-		acts = append(acts, k)
+		acts = append(acts, displayNameFor(k))
 	}
 	sort.Strings(acts)
 
@@ -304,15 +361,34 @@ func sendBugAssignedNotification(bugid string) {
 		return
 	}
 
-	if !strings.Contains(b.Owner, "@") {
+	if !strings.Contains(b.Owner, "@") && !isGroupPrincipal(b.Owner) {
 		log.Printf("bug %v has no assignee", bugid)
 		return
 	}
 
-	sendNotifications("assign_notification", []string{b.Owner},
+	to := filterUnprivelegedEmails(b, []string{b.Owner})
+	sendNotifications("assign_notification", to,
+		map[string]interface{}{"Bug": b})
+	sendDelegateNotifications("assign_delegate_notification", to,
 		map[string]interface{}{"Bug": b})
 }
 
+// Let the delegates of anyone in to who's away know what they were
+// sent.  The template gets who's away as Away.
+func sendDelegateNotifications(tmplName string, to []string,
+	fields map[string]interface{}) {
+
+	for delegate, away := range delegatesFor(to) {
+		for _, a := range away {
+			fields["Away"] = a
+			sendNotifications(tmplName, []string{delegate}, fields)
+		}
+	}
+}
+
+// Tell the subscribers of a tag, and of the tags above it, that a bug
+// was given it.  Subscribers of an ancestor the bug already had have
+// heard about it already.
 func sendTagNotification(bugid, tagName, actor string) {
 	b, err := getBug(bugid)
 	if err != nil {
@@ -321,24 +397,38 @@ func sendTagNotification(bugid, tagName, actor string) {
 		return
 	}
 
-	tag := Tag{}
-	err = db.Get("tag-"+tagName, &tag)
-	if err != nil {
-		if !gomemcached.IsNotFound(err) {
-			log.Printf("Error sending notification for tag %v: %v",
-				tagName, err)
+	sent := []string{actor}
+	for _, t := range append([]string{tagName}, tagAncestors(tagName)...) {
+		if t != tagName && contains(b.Tags, t) {
+			continue
 		}
-		return
-	}
 
-	to := filterUnprivelegedEmails(b, removeFromList(tag.Subscribers, actor))
+		tag := Tag{}
+		err = db.Get("tag-"+t, &tag)
+		if err != nil {
+			if !gomemcached.IsNotFound(err) {
+				log.Printf("Error sending notification for tag %v: %v",
+					t, err)
+			}
+			continue
+		}
 
-	sendNotifications("tag_notification", to,
-		map[string]interface{}{
-			"Bug":   b,
-			"Tag":   tagName,
-			"Actor": actor,
-		})
+		to := []string{}
+		for _, e := range filterUnprivelegedEmails(b, tag.Subscribers) {
+			if !contains(sent, e) {
+				to = append(to, e)
+				sent = append(sent, e)
+			}
+		}
+
+		sendNotifications("tag_notification", to,
+			map[string]interface{}{
+				"Bug":        b,
+				"Tag":        tagName,
+				"Subscribed": t,
+				"Actor":      actor,
+			})
+	}
 }
 
 func sendBugPingNotification(bp bugPing) {
@@ -347,11 +437,25 @@ func sendBugPingNotification(bp bugPing) {
 			"Bug":       bp.bug,
 			"Requester": bp.from,
 		})
+	sendDelegateNotifications("ping_delegate", []string{bp.to},
+		map[string]interface{}{
+			"Bug":       bp.bug,
+			"Requester": bp.from,
+		})
+}
+
+func sendMentionNotification(bm bugMention) {
+	sendNotifications("mention_notification", []string{bm.to},
+		map[string]interface{}{
+			"Bug":   bm.bug,
+			"Actor": bm.actor,
+			"Text":  bm.text,
+			"About": bm.about,
+		})
 }
 
-func updateSubscription(bugid, email string, add bool) error {
-	// Don't need error, just checking for privilege
-	u, _ := getUser(email)
+var updateSubscription = func(bugid, email string, add bool) error {
+	u := userForEmail(email)
 
 	return db.Update(bugid, 0, func(current []byte) ([]byte, error) {
 		if len(current) == 0 {
@@ -369,7 +473,10 @@ func updateSubscription(bugid, email string, add bool) error {
 		}
 
 		// Turn this into a delete if the user can't see the bug
-		add = add && isVisible(bug, u)
+		// or has left.  Groups may subscribe to anything their
+		// members can see.
+		add = add && !u.Deactivated &&
+			(isGroupPrincipal(email) || isVisible(bug, u))
 
 		if add {
 			for _, e := range bug.Subscribers {
@@ -398,9 +505,14 @@ func notificationLoop() {
 			sendAttachmentNotification(a)
 		case bp := <-pingChan:
 			sendBugPingNotification(bp)
+		case bm := <-mentionChan:
+			sendMentionNotification(bm)
 		case c := <-commentChan:
 			changes_broadcaster.Submit(c)
 			sendCommentNotification(c)
+		case c := <-commentEditChan:
+			changes_broadcaster.Submit(commentEdit{c})
+			sendCommentEditNotification(c)
 		case bugid := <-assignedChan:
 			sendBugAssignedNotification(bugid)
 		case c := <-bugChan:
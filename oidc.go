@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect configuration
+
+var oidcIssuer = flag.String("oidcIssuer", "",
+	"OpenID Connect issuer URL used for login")
+var oidcClientID = flag.String("oidcClientId", "",
+	"OpenID Connect client id")
+var oidcClientSecret = flag.String("oidcClientSecret", "",
+	"OpenID Connect client secret")
+var oidcDomains = flag.String("oidcDomains", "",
+	"comma separated email domains allowed to log in (empty allows any)")
+
+const OIDC_COOKIE = "cbugg-oidc"
+
+var oidcNotConfigured = errors.New("OpenID Connect login is not configured")
+
+type oidcConfig struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+}
+
+type oidcKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// What we remember in the browser between sending the user off to
+// the issuer and them coming back.
+type oidcState struct {
+	State   string
+	Nonce   string
+	Return  string
+	Expires int64
+}
+
+type idTokenClaims struct {
+	Issuer        string          `json:"iss"`
+	Audience      json.RawMessage `json:"aud"`
+	Expires       int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified *bool           `json:"email_verified"`
+}
+
+var oidcMu sync.Mutex
+var oidcCached *oidcConfig
+var oidcKeys map[string]*rsa.PublicKey
+
+func getOIDCJSON(u string, ob interface{}) error {
+	res, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("HTTP error fetching %v: %v", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(ob)
+}
+
+func getOIDCConfig() (oidcConfig, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+
+	if *oidcIssuer == "" || *oidcClientID == "" {
+		return oidcConfig{}, oidcNotConfigured
+	}
+
+	if oidcCached != nil && oidcCached.Issuer == *oidcIssuer {
+		return *oidcCached, nil
+	}
+
+	conf := oidcConfig{}
+	err := getOIDCJSON(strings.TrimRight(*oidcIssuer, "/")+
+		"/.well-known/openid-configuration", &conf)
+	if err != nil {
+		return conf, err
+	}
+	if conf.Issuer != *oidcIssuer {
+		return conf, fmt.Errorf("Issuer mismatch: configured %v, got %v",
+			*oidcIssuer, conf.Issuer)
+	}
+
+	oidcCached = &conf
+	oidcKeys = nil
+	return conf, nil
+}
+
+func getOIDCKey(conf oidcConfig, kid string) (*rsa.PublicKey, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+
+	if k, ok := oidcKeys[kid]; ok {
+		return k, nil
+	}
+
+	// Unknown key, the issuer may have rotated them.
+	keys := struct {
+		Keys []oidcKey `json:"keys"`
+	}{}
+	err := getOIDCJSON(conf.JWKSURL, &keys)
+	if err != nil {
+		return nil, err
+	}
+
+	oidcKeys = map[string]*rsa.PublicKey{}
+	for _, k := range keys.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			log.Printf("Invalid modulus on key %v: %v", k.Kid, err)
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			log.Printf("Invalid exponent on key %v: %v", k.Kid, err)
+			continue
+		}
+		oidcKeys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	if k, ok := oidcKeys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("Unknown signing key %q", kid)
+}
+
+func audienceContains(raw json.RawMessage, aud string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == aud
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		return contains(many, aud)
+	}
+	return false
+}
+
+func verifyIDToken(conf oidcConfig, token, nonce string) (idTokenClaims, error) {
+	claims := idTokenClaims{}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("Malformed id token")
+	}
+
+	hdr := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	hbytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(hbytes, &hdr)
+	}
+	if err != nil {
+		return claims, fmt.Errorf("Invalid id token header: %v", err)
+	}
+	if hdr.Alg != "RS256" {
+		return claims, fmt.Errorf("Unsupported id token algorithm %q", hdr.Alg)
+	}
+
+	key, err := getOIDCKey(conf, hdr.Kid)
+	if err != nil {
+		return claims, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("Invalid id token signature: %v", err)
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig)
+	if err != nil {
+		return claims, fmt.Errorf("Bad id token signature: %v", err)
+	}
+
+	cbytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(cbytes, &claims)
+	}
+	if err != nil {
+		return claims, fmt.Errorf("Invalid id token claims: %v", err)
+	}
+
+	switch {
+	case claims.Issuer != conf.Issuer:
+		return claims, fmt.Errorf("Wrong issuer: %v", claims.Issuer)
+	case !audienceContains(claims.Audience, *oidcClientID):
+		return claims, errors.New("Token was not issued for us")
+	case time.Now().Unix() >= claims.Expires:
+		return claims, errors.New("Token is expired")
+	case claims.Nonce != nonce:
+		return claims, errors.New("Wrong nonce")
+	case claims.Email == "":
+		return claims, errors.New("No email address in token")
+	case claims.EmailVerified != nil && !*claims.EmailVerified:
+		return claims, errors.New("Email address is not verified")
+	}
+
+	return claims, nil
+}
+
+func emailDomainAllowed(email, domains string) bool {
+	if domains == "" {
+		return true
+	}
+	x := strings.LastIndex(email, "@")
+	if x < 0 {
+		return false
+	}
+	for _, d := range strings.Split(domains, ",") {
+		if strings.EqualFold(strings.TrimSpace(d), email[x+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func oidcRedirectURL() string {
+	return strings.TrimRight(*baseURL, "/") + "/auth/oidc/callback"
+}
+
+// Only allow returning to a local path.  Browsers read backslashes
+// as slashes and drop tabs and newlines, so /\evil.com and /\t/evil.com
+// are as good as //evil.com; refuse those too.
+func safeReturnPath(p string) string {
+	u, err := url.Parse(p)
+	if err != nil || u.Scheme != "" || u.Host != "" ||
+		!strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") ||
+		strings.ContainsAny(p, "\\\t\r\n") {
+		return "/"
+	}
+	return p
+}
+
+// Logging in via an external OpenID Connect issuer.
+type oidcProvider struct{}
+
+func (oidcProvider) Name() string { return "oidc" }
+
+func (oidcProvider) Login(w http.ResponseWriter, r *http.Request) (AuthResult, error) {
+	startOIDCLogin(w, r)
+	return AuthResult{}, nil
+}
+
+func startOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	conf, err := getOIDCConfig()
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	st := oidcState{
+		State:   randstring(24),
+		Nonce:   randstring(24),
+		Return:  safeReturnPath(r.FormValue("return")),
+		Expires: time.Now().Add(10 * time.Minute).Unix(),
+	}
+
+	encoded, err := secureCookie.Encode(OIDC_COOKIE, st)
+	if err != nil {
+		showError(w, r, "Couldn't encode cookie: "+err.Error(), 500)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_COOKIE,
+		Value:    encoded,
+		Path:     "/auth/",
+		MaxAge:   600,
+		HttpOnly: true,
+	})
+
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {*oidcClientID},
+		"redirect_uri":  {oidcRedirectURL()},
+		"scope":         {"openid email"},
+		"state":         {st.State},
+		"nonce":         {st.Nonce},
+	}
+
+	sep := "?"
+	if strings.Contains(conf.AuthURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, conf.AuthURL+sep+params.Encode(), 302)
+}
+
+func exchangeOIDCCode(conf oidcConfig, code string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {oidcRedirectURL()},
+	}
+
+	req, err := http.NewRequest("POST", conf.TokenURL,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(*oidcClientID),
+		url.QueryEscape(*oidcClientSecret))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("Token request failed: %v", res.Status)
+	}
+
+	tokres := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&tokres)
+	if err != nil {
+		return "", err
+	}
+	if tokres.IDToken == "" {
+		return "", errors.New("No id token in token response")
+	}
+	return tokres.IDToken, nil
+}
+
+func serveOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	st := oidcState{}
+	c, err := r.Cookie(OIDC_COOKIE)
+	if err == nil {
+		err = secureCookie.Decode(OIDC_COOKIE, c.Value, &st)
+	}
+	if err != nil || st.State == "" || st.State != r.FormValue("state") ||
+		time.Now().Unix() > st.Expires {
+		showError(w, r, "Invalid or expired login attempt", 400)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   OIDC_COOKIE,
+		Path:   "/auth/",
+		MaxAge: -1,
+	})
+
+	if e := r.FormValue("error"); e != "" {
+		showError(w, r, "Login failed: "+e+" "+
+			r.FormValue("error_description"), 401)
+		return
+	}
+
+	conf, err := getOIDCConfig()
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	token, err := exchangeOIDCCode(conf, r.FormValue("code"))
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	claims, err := verifyIDToken(conf, token, st.Nonce)
+	if err != nil {
+		showError(w, r, err.Error(), 401)
+		return
+	}
+
+	if !emailDomainAllowed(claims.Email, *oidcDomains) {
+		showError(w, r, claims.Email+" is not allowed to log in here", 403)
+		return
+	}
+
+	err = completeLogin(w, r, AuthResult{Email: claims.Email})
+	if err != nil {
+		showError(w, r, err.Error(), errorCode(err))
+		return
+	}
+
+	http.Redirect(w, r, st.Return, 303)
+}
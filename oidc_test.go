@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// A just-enough OpenID Connect issuer for exercising the login flow.
+type mockIssuer struct {
+	srv    *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	m := &mockIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration",
+		func(w http.ResponseWriter, r *http.Request) {
+			mustEncode(w, map[string]string{
+				"issuer":                 m.srv.URL,
+				"authorization_endpoint": m.srv.URL + "/authorize",
+				"token_endpoint":         m.srv.URL + "/token",
+				"jwks_uri":               m.srv.URL + "/jwks",
+			})
+		})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		pub := m.key.PublicKey
+		mustEncode(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "test",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(
+					big.NewInt(int64(pub.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "cbugg" || secret != "sekrit" ||
+			r.FormValue("code") != "good-code" ||
+			r.FormValue("redirect_uri") != oidcRedirectURL() {
+			http.Error(w, "no", 400)
+			return
+		}
+		mustEncode(w, map[string]string{
+			"id_token": m.sign(t, m.claims),
+		})
+	})
+
+	m.srv = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	body, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("Error encoding claims: %v", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." +
+		base64.RawURLEncoding.EncodeToString(body)
+	h := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	defer withAliases(map[string]string{})()
+	entries := []AuditEntry{}
+	defer withAuditLog(&entries)()
+
+	m := newMockIssuer(t)
+	defer m.srv.Close()
+
+	initSecureCookie([]byte("test cookie key"))
+	*oidcIssuer = m.srv.URL
+	*oidcClientID = "cbugg"
+	*oidcClientSecret = "sekrit"
+	*oidcDomains = "example.com"
+	defer func() { *oidcIssuer, *oidcClientID, *oidcDomains = "", "", "" }()
+
+	// Nobody's been here before.
+	origGetUser := getUser
+	defer func() { getUser = origGetUser }()
+	getUser = func(string) (User, error) { return User{}, NotAUser }
+
+	origNewSession := newSession
+	defer func() { newSession = origNewSession }()
+	newSession = func(email, ua string) (Session, error) {
+		now := time.Now()
+		return Session{Id: "sess", Type: "session", User: email,
+			CreatedAt: now, LastSeen: now, ExpiresAt: now.Add(time.Hour)}, nil
+	}
+
+	// Step one: we get sent off to the issuer.
+	w := httptest.NewRecorder()
+	serveLogin(w, httptest.NewRequest("GET", "/auth/login?return=/bug/bug-1", nil))
+	if w.Code != 302 {
+		t.Fatalf("Expected redirect to issuer, got %v: %s", w.Code, w.Body)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Error parsing location: %v", err)
+	}
+	if loc.Path != "/authorize" || loc.Query().Get("client_id") != "cbugg" {
+		t.Fatalf("Unexpected authorization URL: %v", loc)
+	}
+	state := loc.Query().Get("state")
+	nonce := loc.Query().Get("nonce")
+	stateCookie := w.Result().Cookies()[0]
+
+	claims := func(email string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   m.srv.URL,
+			"aud":   "cbugg",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": nonce,
+			"email": email,
+		}
+	}
+
+	callback := func(state, code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/auth/oidc/callback?"+
+			url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+		req.AddCookie(stateCookie)
+		w := httptest.NewRecorder()
+		serveOIDCCallback(w, req)
+		return w
+	}
+
+	m.claims = claims("someone@example.com")
+
+	if w := callback("wrong", "good-code"); w.Code != 400 {
+		t.Errorf("Expected bad state to fail, got %v", w.Code)
+	}
+	if w := callback(state, "bad-code"); w.Code != 500 {
+		t.Errorf("Expected bad code to fail, got %v", w.Code)
+	}
+
+	m.claims = claims("someone@elsewhere.com")
+	if w := callback(state, "good-code"); w.Code != 403 {
+		t.Errorf("Expected disallowed domain to fail, got %v", w.Code)
+	}
+
+	m.claims = claims("someone@example.com")
+	m.claims["nonce"] = "replayed"
+	if w := callback(state, "good-code"); w.Code != 401 {
+		t.Errorf("Expected wrong nonce to fail, got %v", w.Code)
+	}
+
+	m.claims = claims("someone@example.com")
+	m.claims["aud"] = []string{"someone-else"}
+	if w := callback(state, "good-code"); w.Code != 401 {
+		t.Errorf("Expected wrong audience to fail, got %v", w.Code)
+	}
+
+	// And finally, a proper login.
+	m.claims = claims("someone@example.com")
+	w = callback(state, "good-code")
+	if w.Code != 303 || w.Header().Get("Location") != "/bug/bug-1" {
+		t.Fatalf("Expected redirect back after login, got %v to %v: %s",
+			w.Code, w.Header().Get("Location"), w.Body)
+	}
+	if len(entries) != 1 || entries[0].Action != "login" ||
+		entries[0].Actor != "someone@example.com" {
+		t.Errorf("Expected the login audited, got %+v", entries)
+	}
+
+	var authCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == AUTH_COOKIE {
+			authCookie = c
+		}
+	}
+	if authCookie == nil {
+		t.Fatalf("No auth cookie set")
+	}
+
+	val := browserIdData{}
+	err = secureCookie.Decode("user", authCookie.Value, &val)
+	if err != nil {
+		t.Fatalf("Error decoding auth cookie: %v", err)
+	}
+	if val.Email != "someone@example.com" || val.Session != "sess" {
+		t.Errorf("Expected someone@example.com in session sess, got %+v", val)
+	}
+}
+
+func TestVerifyIDTokenSignature(t *testing.T) {
+	m := newMockIssuer(t)
+	defer m.srv.Close()
+	other := newMockIssuer(t)
+	defer other.srv.Close()
+
+	*oidcClientID = "cbugg"
+	defer func() { *oidcClientID = "" }()
+
+	conf := oidcConfig{Issuer: m.srv.URL, JWKSURL: m.srv.URL + "/jwks"}
+	claims := map[string]interface{}{
+		"iss":   m.srv.URL,
+		"aud":   "cbugg",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": "n",
+		"email": "someone@example.com",
+	}
+
+	oidcKeys = nil
+	if _, err := verifyIDToken(conf, m.sign(t, claims), "n"); err != nil {
+		t.Errorf("Expected valid token, got %v", err)
+	}
+
+	oidcKeys = nil
+	if _, err := verifyIDToken(conf, other.sign(t, claims), "n"); err == nil {
+		t.Errorf("Expected token signed by someone else to fail")
+	}
+
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	oidcKeys = nil
+	if _, err := verifyIDToken(conf, m.sign(t, claims), "n"); err == nil {
+		t.Errorf("Expected expired token to fail")
+	}
+}
+
+func TestEmailDomainAllowed(t *testing.T) {
+	tests := []struct {
+		Email, Domains string
+		Exp            bool
+	}{
+		{"a@example.com", "", true},
+		{"a@example.com", "example.com", true},
+		{"a@Example.COM", "example.com", true},
+		{"a@example.com", "couchbase.com, example.com", true},
+		{"a@example.com.evil", "example.com", false},
+		{"a@sub.example.com", "example.com", false},
+		{"nobody", "example.com", false},
+	}
+
+	for _, x := range tests {
+		got := emailDomainAllowed(x.Email, x.Domains)
+		if got != x.Exp {
+			t.Errorf("emailDomainAllowed(%v, %v) = %v, expected %v",
+				x.Email, x.Domains, got, x.Exp)
+		}
+	}
+}
+
+func TestSafeReturnPath(t *testing.T) {
+	tests := map[string]string{
+		"":                   "/",
+		"/":                  "/",
+		"/bug/bug-1":         "/bug/bug-1",
+		"/search/?q=x#top":   "/search/?q=x#top",
+		"bug/bug-1":          "/",
+		"http://evil.com/":   "/",
+		"//evil.com":         "/",
+		"/\\evil.com":        "/",
+		"/\t/evil.com":       "/",
+		"/bug/\\..\\..\\x":   "/",
+		"javascript:alert()": "/",
+	}
+
+	for in, exp := range tests {
+		if got := safeReturnPath(in); got != exp {
+			t.Errorf("safeReturnPath(%q) = %q, expected %q", in, got, exp)
+		}
+	}
+}
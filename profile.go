@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/couchbaselabs/cbfs/client"
+)
+
+const maxAvatarSize = 1 << 20
+
+var localeRE = regexp.MustCompile(`^[a-z]{2,3}([-_][A-Za-z]{2,4})?$`)
+
+var (
+	invalidDisplayName = errors.New("display names are 1-64 characters without @, < or >")
+	invalidTimeZone    = errors.New("unknown time zone")
+	invalidLocale      = errors.New("invalid locale")
+)
+
+func isProfileError(err error) bool {
+	switch err {
+	case invalidDisplayName, invalidTimeZone, invalidLocale:
+		return true
+	}
+	return false
+}
+
+func validDisplayName(s string) bool {
+	return s != "" && utf8.RuneCountInString(s) <= 64 &&
+		!strings.ContainsAny(s, "@<>")
+}
+
+// Apply the profile fields present in a form, checking each.
+func updateProfile(p *Profile, form url.Values) error {
+	if _, ok := form["display_name"]; ok {
+		n := strings.TrimSpace(form.Get("display_name"))
+		if n != "" && !validDisplayName(n) {
+			return invalidDisplayName
+		}
+		p.DisplayName = n
+	}
+	if _, ok := form["time_zone"]; ok {
+		tz := strings.TrimSpace(form.Get("time_zone"))
+		if tz != "" {
+			if _, err := time.LoadLocation(tz); err != nil {
+				return invalidTimeZone
+			}
+		}
+		p.TimeZone = tz
+	}
+	if _, ok := form["locale"]; ok {
+		l := strings.TrimSpace(form.Get("locale"))
+		if l != "" && !localeRE.MatchString(l) {
+			return invalidLocale
+		}
+		p.Locale = l
+	}
+	return nil
+}
+
+// The profile as clients see it.  Where an avatar is stored is our
+// business, so they get where to fetch it instead.
+func profileJSON(u User) map[string]interface{} {
+	h := handleFor(u.Id)
+	return map[string]interface{}{
+		"handle":          h,
+		"display_name":    u.DisplayName,
+		"name":            displayNameFor(u.Id),
+		"time_zone":       u.TimeZone,
+		"locale":          u.Locale,
+		"uploaded_avatar": u.Avatar != "",
+		"avatar":          "/api/avatar/" + h,
+	}
+}
+
+// Change the current user's profile in a CAS loop.
+func updateMyProfile(me User, f func(p *Profile) error) (User, error) {
+	user := User{}
+	err := db.Update("u-"+me.Id, 0, func(current []byte) ([]byte, error) {
+		user = User{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &user)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Common fields
+		user.Id = me.Id
+		user.Type = "user"
+
+		err := f(&user.Profile)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(user)
+	})
+	forgetDisplayNames()
+	return user, err
+}
+
+func serveMyProfile(w http.ResponseWriter, r *http.Request) {
+	mustEncode(w, profileJSON(whoami(r)))
+}
+
+func serveSetMyProfile(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	user, err := updateMyProfile(whoami(r), func(p *Profile) error {
+		return updateProfile(p, r.Form)
+	})
+	if err != nil {
+		code := 500
+		if isProfileError(err) {
+			code = 400
+		}
+		showError(w, r, err.Error(), code)
+		return
+	}
+
+	mustEncode(w, profileJSON(user))
+}
+
+// The only kinds of avatar we take, none of which can carry script.
+var avatarTypes = []string{"image/png", "image/jpeg", "image/gif"}
+
+// The type of an avatar from the start of its content, or "" if it's
+// not one we take.
+func avatarType(head []byte) string {
+	t := http.DetectContentType(head)
+	if !contains(avatarTypes, t) {
+		return ""
+	}
+	return t
+}
+
+func serveSetMyAvatar(w http.ResponseWriter, r *http.Request) {
+	if *cbfsUrl == "" {
+		showError(w, r, "avatar storage is not configured", 500)
+		return
+	}
+
+	me := whoami(r)
+	f, fh, err := r.FormFile("avatar")
+	if err != nil {
+		showError(w, r, err.Error(), 400)
+		return
+	}
+	defer f.Close()
+
+	// Go by what's in the file, not what the client says it is.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		showError(w, r, err.Error(), 400)
+		return
+	}
+	head = head[:n]
+	ctype := avatarType(head)
+	if ctype == "" {
+		showError(w, r, "Avatars must be PNG, JPEG or GIF images", 400)
+		return
+	}
+
+	dest := *cbfsUrl + "avatars/" + randstring(8) + "/" + url.QueryEscape(fh.Filename)
+	durl, err := url.Parse(dest)
+	if err != nil {
+		showError(w, r, err.Error(), 400)
+		return
+	}
+
+	cbfsc, err := cbfsclient.New(*cbfsUrl)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	cr := &countingReader{r: io.LimitReader(io.MultiReader(bytes.NewReader(head), f),
+		maxAvatarSize+1)}
+	err = cbfsc.Put(fh.Filename, durl.Path, cr,
+		cbfsclient.PutOptions{ContentType: ctype})
+	if err == nil && cr.n > maxAvatarSize {
+		go deleteBlobFile(dest)
+		showError(w, r, "Avatars can be at most 1MB", 413)
+		return
+	}
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	old := ""
+	user, err := updateMyProfile(me, func(p *Profile) error {
+		old = p.Avatar
+		p.Avatar = dest
+		return nil
+	})
+	if err != nil {
+		go deleteBlobFile(dest)
+		showError(w, r, err.Error(), 500)
+		return
+	}
+	if old != "" {
+		go deleteBlobFile(old)
+	}
+
+	mustEncode(w, profileJSON(user))
+}
+
+func serveDeleteMyAvatar(w http.ResponseWriter, r *http.Request) {
+	old := ""
+	user, err := updateMyProfile(whoami(r), func(p *Profile) error {
+		old = p.Avatar
+		p.Avatar = ""
+		return nil
+	})
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+	if old != "" {
+		go deleteBlobFile(old)
+	}
+
+	mustEncode(w, profileJSON(user))
+}
+
+// Send an uploaded avatar.  Returns false if there isn't one to send.
+func serveUploadedAvatar(w http.ResponseWriter, r *http.Request, email string) bool {
+	if email == "" || isGroupPrincipal(email) {
+		return false
+	}
+	u, err := getUser(email)
+	if err != nil || u.Avatar == "" {
+		return false
+	}
+
+	res, err := avatarClient.Get(u.Avatar)
+	if err != nil {
+		log.Printf("Error fetching avatar for %v: %v", email, err)
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		log.Printf("Error fetching avatar for %v: %v", email, res.Status)
+		return false
+	}
+
+	// Anything else could be script running as us.
+	ctype := res.Header.Get("Content-Type")
+	if !contains(avatarTypes, ctype) {
+		log.Printf("Not serving %v avatar for %v", ctype, email)
+		return false
+	}
+
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	io.Copy(w, res.Body)
+	return true
+}
+
+// A time as someone in the given zone would read it.
+func inZone(t time.Time, zone string) string {
+	loc, err := time.LoadLocation(zone)
+	if err != nil || zone == "" {
+		loc = time.UTC
+	}
+	return t.In(loc).Format("Mon, 2 Jan 2006 15:04 MST")
+}
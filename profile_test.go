@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUpdateProfile(t *testing.T) {
+	start := Profile{DisplayName: "Dustin", TimeZone: "UTC", Locale: "en"}
+
+	tests := []struct {
+		form url.Values
+		exp  Profile
+		err  error
+	}{
+		{url.Values{}, start, nil},
+		{url.Values{"display_name": {"  Dustin S.  "}},
+			Profile{DisplayName: "Dustin S.", TimeZone: "UTC", Locale: "en"}, nil},
+		{url.Values{"display_name": {""}, "locale": {"pt-BR"}},
+			Profile{TimeZone: "UTC", Locale: "pt-BR"}, nil},
+		{url.Values{"time_zone": {"America/Los_Angeles"}},
+			Profile{DisplayName: "Dustin", TimeZone: "America/Los_Angeles",
+				Locale: "en"}, nil},
+		{url.Values{"display_name": {"dustin@spy.net"}}, start, invalidDisplayName},
+		{url.Values{"display_name": {"Dustin <u1234>"}}, start, invalidDisplayName},
+		{url.Values{"time_zone": {"Mars/Olympus_Mons"}}, start, invalidTimeZone},
+		{url.Values{"locale": {"english please"}}, start, invalidLocale},
+	}
+
+	for _, x := range tests {
+		p := start
+		err := updateProfile(&p, x.form)
+		if err != x.err {
+			t.Errorf("updateProfile(%v) error = %v, expected %v",
+				x.form, err, x.err)
+		}
+		if err == nil && p != x.exp {
+			t.Errorf("updateProfile(%v) = %+v, expected %+v", x.form, p, x.exp)
+		}
+	}
+}
+
+func TestInZone(t *testing.T) {
+	when := time.Date(2014, 3, 1, 18, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		zone, exp string
+	}{
+		{"", "Sat, 1 Mar 2014 18:30 UTC"},
+		{"bogus", "Sat, 1 Mar 2014 18:30 UTC"},
+		{"America/Los_Angeles", "Sat, 1 Mar 2014 10:30 PST"},
+	}
+
+	for _, x := range tests {
+		if got := inZone(when, x.zone); got != x.exp {
+			t.Errorf("inZone(%v, %q) = %q, expected %q", when, x.zone, got, x.exp)
+		}
+	}
+}
+
+func TestAvatarType(t *testing.T) {
+	tests := []struct {
+		head string
+		exp  string
+	}{
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{"\xff\xd8\xff\xe0\x00\x10JFIF", "image/jpeg"},
+		{"GIF89a\x01\x00\x01\x00", "image/gif"},
+		{`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`, ""},
+		{`<svg onload="alert(1)"/>`, ""},
+		{"<html><script>alert(1)</script>", ""},
+		{"", ""},
+	}
+
+	for _, x := range tests {
+		if got := avatarType([]byte(x.head)); got != x.exp {
+			t.Errorf("avatarType(%q) = %q, expected %q", x.head, got, x.exp)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rateLimitSpec = flag.String("rateLimits",
+	"auth:10/1m,write:30/1m,ping:10/1h",
+	"comma separated class:count/period request budgets")
+var rateLimitStore = flag.String("rateLimitStore", "memory",
+	"where to keep rate limit state (memory or couchbase)")
+var rateLimitForwarded = flag.Bool("rateLimitForwarded", false,
+	"take client addresses from X-Forwarded-For")
+
+// Requests turned away, by route class.
+var throttledRequests = expvar.NewMap("throttled")
+
+// A budget allows count requests per period, refilled smoothly, with
+// up to count in a burst.
+type rateBudget struct {
+	count  int
+	period time.Duration
+}
+
+func (b rateBudget) rate() float64 {
+	return float64(b.count) / b.period.Seconds()
+}
+
+func parseRateLimits(s string) (map[string]rateBudget, error) {
+	rv := map[string]rateBudget{}
+	for _, spec := range splitList(s) {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q", spec)
+		}
+		budget := strings.SplitN(parts[1], "/", 2)
+		if len(budget) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q", spec)
+		}
+		n, err := strconv.Atoi(budget[0])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid count in %q", spec)
+		}
+		d, err := time.ParseDuration(budget[1])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid period in %q", spec)
+		}
+		rv[parts[0]] = rateBudget{n, d}
+	}
+	return rv, nil
+}
+
+// The state of one bucket.
+type tokenBucket struct {
+	Type    string    `json:"type"`
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// Refill the bucket to now and try to take cost tokens from it.  A
+// zero cost only asks whether a request would be allowed.  When it
+// wouldn't, the second result says how long until it would.
+func (t *tokenBucket) take(b rateBudget, cost float64, now time.Time) (bool, time.Duration) {
+	if t.Updated.IsZero() {
+		t.Tokens = float64(b.count)
+	} else if now.After(t.Updated) {
+		t.Tokens += now.Sub(t.Updated).Seconds() * b.rate()
+	}
+	t.Tokens = math.Min(t.Tokens, float64(b.count))
+	t.Updated = now
+
+	if t.Tokens < 1 {
+		wait := time.Duration((1 - t.Tokens) / b.rate() * float64(time.Second))
+		return false, wait
+	}
+	t.Tokens -= cost
+	return true, 0
+}
+
+type rateLimiter interface {
+	take(key string, b rateBudget, cost float64) (bool, time.Duration)
+}
+
+// Rate limit state kept in this process.
+type memoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func (m *memoryLimiter) take(key string, b rateBudget, cost float64) (bool, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.buckets == nil {
+		m.buckets = map[string]*tokenBucket{}
+	}
+
+	// Forget buckets that have been idle long enough to be full.
+	if now.Sub(m.swept) > time.Minute {
+		for k, t := range m.buckets {
+			if now.Sub(t.Updated) > 24*time.Hour {
+				delete(m.buckets, k)
+			}
+		}
+		m.swept = now
+	}
+
+	t, ok := m.buckets[key]
+	if !ok {
+		t = &tokenBucket{}
+		m.buckets[key] = t
+	}
+	return t.take(b, cost, now)
+}
+
+// Rate limit state shared between instances through couchbase.
+type couchbaseLimiter struct{}
+
+func (couchbaseLimiter) take(key string, b rateBudget, cost float64) (bool, time.Duration) {
+	ok, wait := true, time.Duration(0)
+	exp := int(b.period.Seconds()) + 60
+	err := db.Update("ratelimit-"+key, exp, func(current []byte) ([]byte, error) {
+		t := tokenBucket{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &t)
+			if err != nil {
+				return nil, err
+			}
+		}
+		t.Type = "ratelimit"
+		ok, wait = t.take(b, cost, time.Now())
+		return json.Marshal(t)
+	})
+	if err != nil {
+		// Better to let people in than lock everyone out.
+		log.Printf("Error updating rate limit %v: %v", key, err)
+		return true, 0
+	}
+	return ok, wait
+}
+
+var limiter rateLimiter
+var rateLimits map[string]rateBudget
+
+func initRateLimits() {
+	var err error
+	rateLimits, err = parseRateLimits(*rateLimitSpec)
+	if err != nil {
+		log.Fatalf("Error parsing rate limits: %v", err)
+	}
+	switch *rateLimitStore {
+	case "memory":
+		limiter = &memoryLimiter{}
+	case "couchbase":
+		limiter = couchbaseLimiter{}
+	default:
+		log.Fatalf("Unknown rate limit store: %v", *rateLimitStore)
+	}
+}
+
+// The address a request came from.  Behind a proxy, that's the last
+// X-Forwarded-For entry, which the proxy added.  Anything before it
+// came from the client and can't be trusted.
+func clientAddr(r *http.Request) string {
+	if *rateLimitForwarded {
+		if fs := r.Header["X-Forwarded-For"]; len(fs) > 0 {
+			addrs := strings.Split(fs[len(fs)-1], ",")
+			if a := strings.TrimSpace(addrs[len(addrs)-1]); a != "" {
+				return a
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Charge a request of the given class against the client's address
+// and, if known, user.  Returns false after writing a 429 if either is
+// out of budget.  A zero cost checks without charging.
+func rateCheck(w http.ResponseWriter, r *http.Request, class, user string,
+	cost float64) bool {
+
+	keys := []string{class + "-ip-" + clientAddr(r)}
+	if user != "" {
+		keys = append(keys, class+"-user-"+user)
+	}
+	return rateCheckKeys(w, r, class, keys, cost)
+}
+
+// Charge a request against each of the keys in a class's budget.  If
+// any of them is out of budget, none are charged, and a 429 is written.
+func rateCheckKeys(w http.ResponseWriter, r *http.Request, class string,
+	keys []string, cost float64) bool {
+
+	b, ok := rateLimits[class]
+	if !ok {
+		return true
+	}
+
+	for _, k := range keys {
+		if ok, wait := limiter.take(k, b, 0); !ok {
+			throttledRequests.Add(class, 1)
+			secs := int(math.Ceil(wait.Seconds()))
+			if secs < 1 {
+				secs = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			showError(w, r, "Too many requests, try again later", 429)
+			return false
+		}
+	}
+	if cost > 0 {
+		for _, k := range keys {
+			limiter.take(k, b, cost)
+		}
+	}
+	return true
+}
+
+// Wrap a handler so each request is charged against a class budget.
+func rateLimited(class string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rateCheck(w, r, class, whoami(r).Id, 1) {
+			h(w, r)
+		}
+	}
+}
+
+// Login failures count against the client's address, and against the
+// address and account together.  Nothing counts against an account
+// alone, or anyone could lock anyone else out by failing as them.
+func authKeys(r *http.Request, user string) []string {
+	addr := clientAddr(r)
+	keys := []string{"auth-ip-" + addr}
+	if user != "" {
+		keys = append(keys, "auth-user-"+addr+"-"+user)
+	}
+	return keys
+}
+
+// Guard against password and token guessing.  Clients who have failed
+// too often are turned away before their credentials are looked at,
+// and each failure uses up some of their budget.
+func authAttemptAllowed(w http.ResponseWriter, r *http.Request, user string) bool {
+	return rateCheckKeys(w, r, "auth", authKeys(r, user), 0)
+}
+
+func noteAuthFailure(r *http.Request, user string) {
+	b, ok := rateLimits["auth"]
+	if !ok {
+		return
+	}
+	for _, k := range authKeys(r, user) {
+		limiter.take(k, b, 1)
+	}
+}
+
+// Throttle HTTP Basic auth.  whoami checks credentials several times
+// a request, so the credentials are checked once here to decide what
+// to charge.
+func basicAuthThrottle(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := basicAuthCredentials(r)
+		if ok {
+			if !authAttemptAllowed(w, r, user) {
+				return
+			}
+			if _, valid := userFromToken(r, user, pass); !valid {
+				noteAuthFailure(r, user)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	got, err := parseRateLimits("auth:10/1m, ping:3/1h")
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	exp := map[string]rateBudget{
+		"auth": {10, time.Minute},
+		"ping": {3, time.Hour},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	for _, bad := range []string{"auth", "auth:10", "auth:x/1m",
+		"auth:0/1m", "auth:10/forever", "auth:10/-1m"} {
+		if _, err := parseRateLimits(bad); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := rateBudget{2, time.Minute}
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	tb := tokenBucket{}
+
+	tests := []struct {
+		after time.Duration
+		cost  float64
+		ok    bool
+		wait  time.Duration
+	}{
+		{0, 1, true, 0},
+		{0, 0, true, 0},
+		{0, 1, true, 0},
+		{0, 0, false, 30 * time.Second},
+		{0, 1, false, 30 * time.Second},
+		{10 * time.Second, 1, false, 20 * time.Second},
+		{20 * time.Second, 1, true, 0},
+		{time.Hour, 1, true, 0},
+		{0, 1, true, 0},
+		{0, 1, false, 30 * time.Second},
+	}
+
+	for i, x := range tests {
+		now = now.Add(x.after)
+		ok, wait := tb.take(b, x.cost, now)
+		if ok != x.ok || wait != x.wait {
+			t.Errorf("%v: take = %v, %v, expected %v, %v",
+				i, ok, wait, x.ok, x.wait)
+		}
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	origLimiter, origLimits := limiter, rateLimits
+	defer func() { limiter, rateLimits = origLimiter, origLimits }()
+	limiter = &memoryLimiter{}
+	rateLimits = map[string]rateBudget{"write": {2, time.Hour}}
+
+	h := rateLimited("write", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+	other := rateLimited("unlimited", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+
+	req := func(addr string) *http.Request {
+		r, _ := http.NewRequest("POST", "/api/bug/", nil)
+		r.RemoteAddr = addr
+		return r
+	}
+
+	for i, exp := range []int{204, 204, 429} {
+		w := httptest.NewRecorder()
+		h(w, req("10.0.0.1:1234"))
+		if w.Code != exp {
+			t.Errorf("Request %v: got %v, expected %v", i, w.Code, exp)
+		}
+		if exp == 429 && w.Header().Get("Retry-After") != "1800" {
+			t.Errorf("Expected to retry after 1800s, got %q",
+				w.Header().Get("Retry-After"))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h(w, req("10.0.0.2:1234"))
+	if w.Code != 204 {
+		t.Errorf("Other address got %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	other(w, req("10.0.0.1:1234"))
+	if w.Code != 204 {
+		t.Errorf("Unlimited class got %v", w.Code)
+	}
+}
+
+func TestRateCheckChargesNothingWhenRefused(t *testing.T) {
+	origLimiter, origLimits := limiter, rateLimits
+	defer func() { limiter, rateLimits = origLimiter, origLimits }()
+	mem := &memoryLimiter{}
+	limiter = mem
+	rateLimits = map[string]rateBudget{"write": {2, time.Hour}}
+
+	req := func(addr string) *http.Request {
+		r, _ := http.NewRequest("POST", "/api/bug/", nil)
+		r.RemoteAddr = addr
+		return r
+	}
+
+	// Use up a's budget from one address.
+	for i := 0; i < 2; i++ {
+		if !rateCheck(httptest.NewRecorder(), req("10.0.0.1:1"), "write", "a@x", 1) {
+			t.Fatalf("Request %v refused", i)
+		}
+	}
+	// Refused on the user from another address, which shouldn't
+	// cost that address anything.
+	if rateCheck(httptest.NewRecorder(), req("10.0.0.2:1"), "write", "a@x", 1) {
+		t.Fatalf("Expected a@x to be out of budget")
+	}
+	if got := mem.buckets["write-ip-10.0.0.2"].Tokens; got != 2 {
+		t.Errorf("Expected the address to keep its budget, has %v", got)
+	}
+}
+
+func TestAuthFailuresPerAddress(t *testing.T) {
+	origLimiter, origLimits := limiter, rateLimits
+	defer func() { limiter, rateLimits = origLimiter, origLimits }()
+	limiter = &memoryLimiter{}
+	rateLimits = map[string]rateBudget{"auth": {2, time.Hour}}
+
+	req := func(addr string) *http.Request {
+		r, _ := http.NewRequest("POST", "/auth/login", nil)
+		r.RemoteAddr = addr
+		return r
+	}
+
+	for i := 0; i < 2; i++ {
+		noteAuthFailure(req("10.0.0.1:1"), "victim@x")
+	}
+	if authAttemptAllowed(httptest.NewRecorder(), req("10.0.0.1:1"), "victim@x") {
+		t.Errorf("Expected the guessing address to be turned away")
+	}
+	if !authAttemptAllowed(httptest.NewRecorder(), req("10.0.0.2:1"), "victim@x") {
+		t.Errorf("Expected the account to be usable from elsewhere")
+	}
+}
+
+func TestClientAddrForwarded(t *testing.T) {
+	defer func() { *rateLimitForwarded = false }()
+
+	req := func(forwarded ...string) *http.Request {
+		r, _ := http.NewRequest("POST", "/auth/login", nil)
+		r.RemoteAddr = "10.0.0.9:1234"
+		for _, f := range forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		return r
+	}
+
+	tests := []struct {
+		forwarded []string
+		exp       string
+	}{
+		{nil, "10.0.0.9"},
+		{[]string{"192.0.2.1"}, "192.0.2.1"},
+		// The client made up the first address; the proxy added the last.
+		{[]string{"198.51.100.7, 192.0.2.1"}, "192.0.2.1"},
+		{[]string{"198.51.100.7", "192.0.2.1"}, "192.0.2.1"},
+		{[]string{"198.51.100.7,"}, "10.0.0.9"},
+	}
+
+	*rateLimitForwarded = true
+	for _, x := range tests {
+		if got := clientAddr(req(x.forwarded...)); got != x.exp {
+			t.Errorf("clientAddr with %q = %v, expected %v",
+				x.forwarded, got, x.exp)
+		}
+	}
+
+	*rateLimitForwarded = false
+	if got := clientAddr(req("192.0.2.1")); got != "10.0.0.9" {
+		t.Errorf("Expected forwarding ignored when not behind a proxy, got %v", got)
+	}
+
+	// Spoofing a new address each time doesn't get a fresh budget.
+	*rateLimitForwarded = true
+	origLimiter, origLimits := limiter, rateLimits
+	defer func() { limiter, rateLimits = origLimiter, origLimits }()
+	limiter = &memoryLimiter{}
+	rateLimits = map[string]rateBudget{"auth": {2, time.Hour}}
+	for i := 0; i < 2; i++ {
+		noteAuthFailure(req(fmt.Sprintf("203.0.113.%v, 192.0.2.1", i)), "")
+	}
+	if authAttemptAllowed(httptest.NewRecorder(),
+		req("203.0.113.99, 192.0.2.1"), "") {
+		t.Errorf("Expected a spoofed address to be turned away")
+	}
+}
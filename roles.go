@@ -0,0 +1,247 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/gorilla/mux"
+)
+
+// Things users may be allowed to do.
+const (
+	permBugCreate      = "bug:create"
+	permBugComment     = "bug:comment"
+	permBugEdit        = "bug:edit"
+	permBugTriage      = "bug:triage"
+	permBugAttach      = "bug:attach"
+	permBugSubscribe   = "bug:subscribe"
+	permBugDelete      = "bug:delete"
+	permBugImport      = "bug:import"
+	permPrivateRead    = "private:read"
+	permPrivateManage  = "private:manage"
+	permTagEdit        = "tag:edit"
+	permTagSubscribers = "tag:subscribers"
+	permTagAdmin       = "tag:admin"
+	permUsersView      = "users:view"
+	permUsersAdmin     = "users:admin"
+	permAuditRead      = "audit:read"
+
+	permAll = "*"
+)
+
+var allPermissions = []string{
+	permBugCreate, permBugComment, permBugEdit, permBugTriage,
+	permBugAttach, permBugSubscribe, permBugDelete, permBugImport,
+	permPrivateRead, permPrivateManage, permTagEdit, permTagSubscribers,
+	permTagAdmin, permUsersView, permUsersAdmin, permAuditRead,
+}
+
+var defaultRoles = flag.String("defaultRoles", "reporter,triager",
+	"comma separated roles for users who haven't been given any")
+
+// The roles we start out with.  Any of them may be redefined by
+// storing a role document of the same name.
+var builtinRoles = map[string]Role{
+	"admin": {Name: "admin", Permissions: []string{permAll}},
+	"internal": {Name: "internal", Permissions: []string{
+		permPrivateRead, permPrivateManage, permTagEdit, permBugImport,
+		permUsersView}},
+	"reporter": {Name: "reporter", Permissions: []string{
+		permBugCreate, permBugComment, permBugAttach, permBugSubscribe}},
+	"triager": {Name: "triager", Permissions: []string{
+		permBugEdit, permBugTriage}},
+	"tag-maintainer": {Name: "tag-maintainer", Permissions: []string{
+		permTagEdit, permTagSubscribers}},
+	"auditor": {Name: "auditor", Permissions: []string{
+		permPrivateRead, permUsersView, permBugSubscribe, permAuditRead}},
+}
+
+const roleCacheTime = 30 * time.Second
+
+var roleCache = struct {
+	sync.Mutex
+	roles   map[string]Role
+	fetched time.Time
+}{}
+
+var loadRoles = func() (map[string]Role, error) {
+	args := map[string]interface{}{
+		"stale":        false,
+		"include_docs": true,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Doc struct {
+				Json Role
+			}
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "roles", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]Role{}
+	for k, v := range builtinRoles {
+		rv[k] = v
+	}
+	for _, row := range viewRes.Rows {
+		rv[row.Doc.Json.Name] = row.Doc.Json
+	}
+	return rv, nil
+}
+
+func getRoles() map[string]Role {
+	roleCache.Lock()
+	defer roleCache.Unlock()
+
+	if roleCache.roles != nil && time.Since(roleCache.fetched) < roleCacheTime {
+		return roleCache.roles
+	}
+
+	roles, err := loadRoles()
+	if err != nil {
+		log.Printf("Error loading roles: %v", err)
+		if roleCache.roles != nil {
+			return roleCache.roles
+		}
+		return builtinRoles
+	}
+	roleCache.roles = roles
+	roleCache.fetched = time.Now()
+	return roles
+}
+
+func forgetRoles() {
+	roleCache.Lock()
+	defer roleCache.Unlock()
+	roleCache.roles = nil
+}
+
+func splitList(s string) []string {
+	rv := []string{}
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if x != "" {
+			rv = append(rv, x)
+		}
+	}
+	return rv
+}
+
+// The names of the roles a user holds.
+func rolesFor(u User) []string {
+	if u.Id == "" {
+		return []string{}
+	}
+	rv := append([]string{}, u.Roles...)
+	if len(rv) == 0 {
+		rv = splitList(*defaultRoles)
+	}
+	// Groups only ever add roles.
+	for _, g := range groupsOf(u.Id) {
+		rv = append(rv, g.Roles...)
+	}
+	if u.Admin {
+		rv = append(rv, "admin")
+	}
+	if u.Internal {
+		rv = append(rv, "internal")
+	}
+	return rv
+}
+
+func roleGrants(r Role, perm string) bool {
+	return contains(r.Permissions, perm) || contains(r.Permissions, permAll)
+}
+
+func userCan(u User, perm string) bool {
+	roles := getRoles()
+	for _, rn := range rolesFor(u) {
+		if roleGrants(roles[rn], perm) {
+			return true
+		}
+	}
+	return false
+}
+
+func emailCan(email, perm string) bool {
+	return userCan(userForEmail(email), perm)
+}
+
+func permissionsOf(u User) []string {
+	rv := []string{}
+	for _, p := range allPermissions {
+		if userCan(u, p) {
+			rv = append(rv, p)
+		}
+	}
+	return rv
+}
+
+// A route matcher requiring the given permission.
+func permRequired(perm string) mux.MatcherFunc {
+	return func(r *http.Request, rm *mux.RouteMatch) bool {
+		return userCan(whoami(r), perm)
+	}
+}
+
+func serveRoleList(w http.ResponseWriter, r *http.Request) {
+	roles := getRoles()
+	names := []string{}
+	for k := range roles {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	rv := []Role{}
+	for _, n := range names {
+		rv = append(rv, roles[n])
+	}
+	mustEncode(w, rv)
+}
+
+func serveSetRole(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["role"]
+	perms := splitList(r.FormValue("permissions"))
+	for _, p := range perms {
+		if p != permAll && !contains(allPermissions, p) {
+			showError(w, r, "Unknown permission: "+p, 400)
+			return
+		}
+	}
+
+	role := Role{Name: name, Type: "role", Permissions: perms}
+	err := db.Set("role-"+name, 0, role)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+	forgetRoles()
+
+	audit(r, whoami(r).Id, "role.set", name,
+		map[string]interface{}{"permissions": perms})
+
+	mustEncode(w, role)
+}
+
+func serveDeleteRole(w http.ResponseWriter, r *http.Request) {
+	err := db.Delete("role-" + mux.Vars(r)["role"])
+	if err != nil && !gomemcached.IsNotFound(err) {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+	forgetRoles()
+
+	audit(r, whoami(r).Id, "role.delete", mux.Vars(r)["role"], nil)
+
+	w.WriteHeader(204)
+}
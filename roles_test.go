@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+)
+
+// Use the given roles in place of the database's, or just the
+// built-in ones if roles is nil.
+func withRoles(roles map[string]Role) func() {
+	origLoad := loadRoles
+	if roles == nil {
+		roles = builtinRoles
+	}
+	loadRoles = func() (map[string]Role, error) {
+		return roles, nil
+	}
+	forgetRoles()
+	return func() {
+		loadRoles = origLoad
+		forgetRoles()
+	}
+}
+
+func TestUserCan(t *testing.T) {
+	roles := map[string]Role{}
+	for k, v := range builtinRoles {
+		roles[k] = v
+	}
+	roles["triager"] = Role{Name: "triager", Permissions: []string{permBugTriage}}
+	defer withRoles(roles)()
+	defer withGroups()()
+
+	nobody := User{}
+	plain := User{Id: "plain@example.com"}
+	auditor := User{Id: "a@example.com", Roles: []string{"auditor"}}
+	triager := User{Id: "t@example.com", Roles: []string{"triager"}}
+	maint := User{Id: "m@example.com", Roles: []string{"reporter", "tag-maintainer"}}
+	internal := User{Id: "i@example.com", Internal: true}
+	admin := User{Id: "admin@example.com", Roles: []string{"auditor"}, Admin: true}
+	bogus := User{Id: "b@example.com", Roles: []string{"no-such-role"}}
+
+	tests := []struct {
+		U    User
+		Perm string
+		Exp  bool
+	}{
+		{nobody, permBugComment, false},
+		{nobody, permPrivateRead, false},
+		{plain, permBugCreate, true},
+		{plain, permBugComment, true},
+		{plain, permBugTriage, true},
+		{plain, permBugEdit, false}, // redefined triager above
+		{plain, permPrivateRead, false},
+		{auditor, permPrivateRead, true},
+		{auditor, permBugComment, false},
+		{auditor, permBugCreate, false},
+		{triager, permBugTriage, true},
+		{triager, permBugCreate, false},
+		{maint, permTagEdit, true},
+		{maint, permTagSubscribers, true},
+		{maint, permBugTriage, false},
+		{internal, permPrivateRead, true},
+		{internal, permBugCreate, true},
+		{internal, permUsersAdmin, false},
+		{internal, permTagEdit, true},
+		{internal, permTagAdmin, false},
+		{maint, permTagAdmin, false},
+		{admin, permUsersAdmin, true},
+		{admin, permTagAdmin, true},
+		{admin, permBugDelete, true},
+		{bogus, permBugComment, false},
+	}
+
+	for _, x := range tests {
+		if got := userCan(x.U, x.Perm); got != x.Exp {
+			t.Errorf("userCan(%v %v, %v) = %v, expected %v",
+				x.U.Id, rolesFor(x.U), x.Perm, got, x.Exp)
+		}
+	}
+
+	if len(auditor.Roles) != 1 {
+		t.Errorf("rolesFor modified the user's roles: %v", auditor.Roles)
+	}
+}
+
+func TestBugVisibilityFollowsRoles(t *testing.T) {
+	defer withRoles(nil)()
+	defer withGroups()()
+
+	b := Bug{Private: true, AlsoVisibleTo: []string{"friend@example.com"}}
+
+	tests := []struct {
+		U   User
+		Exp bool
+	}{
+		{User{}, false},
+		{User{Id: "plain@example.com"}, false},
+		{User{Id: "friend@example.com"}, true},
+		{User{Id: "a@example.com", Roles: []string{"auditor"}}, true},
+		{User{Id: "i@example.com", Internal: true}, true},
+	}
+
+	for _, x := range tests {
+		if got := b.IsVisibleTo(x.U); got != x.Exp {
+			t.Errorf("Private bug visible to %v = %v, expected %v",
+				x.U.Id, got, x.Exp)
+		}
+	}
+}
+
+func TestPrivateFieldPermission(t *testing.T) {
+	defer withRoles(nil)()
+	defer withGroups()()
+
+	tests := []struct {
+		U   User
+		Exp bool
+	}{
+		{User{}, false},
+		{User{Id: "plain@example.com"}, false},
+		// Someone a private bug was shared with can't unshare it.
+		{User{Id: "friend@example.com"}, false},
+		{User{Id: "t@example.com", Roles: []string{"triager"}}, false},
+		{User{Id: "i@example.com", Internal: true}, true},
+		{User{Id: "admin@example.com", Admin: true}, true},
+	}
+
+	for _, x := range tests {
+		if got := mayUpdateBugField(x.U, "bug-1", "private"); got != x.Exp {
+			t.Errorf("%v may change private = %v, expected %v",
+				x.U.Id, got, x.Exp)
+		}
+	}
+	if !mayUpdateBugField(User{Id: "plain@example.com"}, "bug-1", "title") {
+		t.Errorf("Expected anyone to be able to edit titles")
+	}
+}
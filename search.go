@@ -21,14 +21,39 @@ func getDefaultFilterComponents(r *http.Request) []Filter {
 		buildTermFilter("doc.type", "bug"),
 	}
 
-	// if users is external, add additional filter
-	if whoami(r).Internal == false {
-		result = append(result, buildNotFilter(buildTermFilter("doc.private", "true")))
+	if f := bugVisibilityFilter(whoami(r)); f != nil {
+		result = append(result, f)
 	}
 
 	return result
 }
 
+// The search equivalent of Bug.IsVisibleTo, or nil if the user can
+// see everything.
+func bugVisibilityFilter(u User) Filter {
+	if userCan(u, permPrivateRead) {
+		return nil
+	}
+
+	public := buildNotFilter(buildTermFilter("doc.private", "true"))
+	if u.Id == "" {
+		return public
+	}
+	return buildOrFilter([]Filter{
+		public,
+		buildTermsFilter("doc.also_visible_to", principalsOf(u.Id), ""),
+	})
+}
+
+// The search equivalent of Comment.IsVisibleTo, or nil if the user
+// can see everything.
+func commentVisibilityFilter(u User) Filter {
+	if userCan(u, permPrivateRead) {
+		return nil
+	}
+	return buildNotFilter(buildTermFilter("doc.private", "true"))
+}
+
 // powers the bug similarity feature when entering new bugs
 func findSimilarBugs(w http.ResponseWriter, r *http.Request) {
 
@@ -141,8 +166,13 @@ func searchBugs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.FormValue("tags") != "" {
-		tagsFilter := buildTermsFilter("doc.tags", strings.Split(r.FormValue("tags"), ","), "and")
-		filterComponents = append(filterComponents, tagsFilter)
+		tagsFilters := buildTagsFilters(strings.Split(r.FormValue("tags"), ","))
+		filterComponents = append(filterComponents, tagsFilters...)
+	}
+
+	if r.FormValue("namespace") != "" {
+		nsFilter := buildNamespaceFilter(strings.Split(r.FormValue("namespace"), ","))
+		filterComponents = append(filterComponents, nsFilter)
 	}
 
 	if r.FormValue("modified") != "" {
@@ -188,10 +218,18 @@ func searchBugs(w http.ResponseWriter, r *http.Request) {
 	if r.FormValue("query") != "" {
 		insideQuery = buildQueryStringQuery(r.FormValue("query"))
 
-		// only add these child queries if we actually have a query string
-		childTypesToQuery := []string{"comment", "attachment"}
-		for _, typ := range childTypesToQuery {
-			queryComponent := buildHashChildQuery(typ, insideQuery)
+		// only add these child queries if we actually have a query
+		// string, and don't let private comments match for those
+		// who can't see them
+		childQueries := map[string]Query{
+			"comment":    insideQuery,
+			"attachment": insideQuery,
+		}
+		if f := commentVisibilityFilter(whoami(r)); f != nil {
+			childQueries["comment"] = buildFilteredQuery(insideQuery, f)
+		}
+		for _, typ := range []string{"comment", "attachment"} {
+			queryComponent := buildHashChildQuery(typ, childQueries[typ])
 			shouldQueries = append(shouldQueries, queryComponent)
 		}
 	}
@@ -369,6 +407,41 @@ func buildTermsFilter(field string, terms []string, execution string) Filter {
 	}
 }
 
+// Bugs must have every tag asked for, or something under it.
+func buildTagsFilters(tags []string) []Filter {
+	plain := []string{}
+	rv := []Filter{}
+	for _, t := range tags {
+		under := tagDescendants(t)
+		if len(under) == 0 {
+			plain = append(plain, t)
+			continue
+		}
+		rv = append(rv, buildTermsFilter("doc.tags", append([]string{t}, under...), ""))
+	}
+	if len(plain) > 0 {
+		rv = append([]Filter{buildTermsFilter("doc.tags", plain, "and")}, rv...)
+	}
+	return rv
+}
+
+// Bugs with a tag in any of the namespaces.
+func buildNamespaceFilter(namespaces []string) Filter {
+	components := []Filter{}
+	for _, ns := range namespaces {
+		components = append(components, buildPrefixFilter("doc.tags", ns+":"))
+	}
+	return buildOrFilter(components)
+}
+
+func buildPrefixFilter(field string, prefix string) Filter {
+	return Filter{
+		"prefix": map[string]interface{}{
+			field: prefix,
+		},
+	}
+}
+
 func buildTermFilter(field string, term string) Filter {
 	return Filter{
 		"term": map[string]interface{}{
@@ -399,6 +472,12 @@ func buildAndFilter(components []Filter) Filter {
 	}
 }
 
+func buildOrFilter(components []Filter) Filter {
+	return Filter{
+		"or": components,
+	}
+}
+
 func buildNotFilter(filter Filter) Filter {
 	return Filter{
 		"not": filter,
@@ -491,6 +570,15 @@ func buildHashChildQuery(typ string, query Query) Query {
 	}
 }
 
+func buildFilteredQuery(query Query, filter Filter) Query {
+	return Query{
+		"filtered": map[string]interface{}{
+			"query":  query,
+			"filter": filter,
+		},
+	}
+}
+
 func buildMatchAllQuery() Query {
 	return Query{
 		"match_all": map[string]interface{}{},
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Just enough of elasticsearch's filter semantics to check ours.
+func filterMatches(t *testing.T, f Filter, doc map[string]interface{}) bool {
+	lookup := func(field string) []string {
+		var v interface{} = doc
+		for _, k := range strings.Split(field, ".") {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v = m[k]
+		}
+		switch x := v.(type) {
+		case nil:
+			return nil
+		case []interface{}:
+			rv := []string{}
+			for _, e := range x {
+				rv = append(rv, fmt.Sprint(e))
+			}
+			return rv
+		default:
+			return []string{fmt.Sprint(x)}
+		}
+	}
+
+	for k, v := range f {
+		switch k {
+		case "and", "or":
+			subs := v.([]Filter)
+			for _, sub := range subs {
+				m := filterMatches(t, sub, doc)
+				if k == "or" && m {
+					return true
+				}
+				if k == "and" && !m {
+					return false
+				}
+			}
+			return k == "and"
+		case "not":
+			return !filterMatches(t, v.(Filter), doc)
+		case "term":
+			for field, term := range v.(map[string]interface{}) {
+				return contains(lookup(field), term.(string))
+			}
+		case "terms":
+			m := v.(map[string]interface{})
+			for field, terms := range m {
+				if field == "execution" {
+					continue
+				}
+				have := lookup(field)
+				all := m["execution"] == "and"
+				for _, term := range terms.([]string) {
+					if contains(have, term) != all {
+						return !all
+					}
+				}
+				return all
+			}
+		case "prefix":
+			for field, prefix := range v.(map[string]interface{}) {
+				for _, s := range lookup(field) {
+					if strings.HasPrefix(s, prefix.(string)) {
+						return true
+					}
+				}
+				return false
+			}
+		}
+	}
+	t.Fatalf("Unhandled filter: %v", f)
+	return false
+}
+
+func asSearchDoc(t *testing.T, ob interface{}) map[string]interface{} {
+	d, err := json.Marshal(ob)
+	if err != nil {
+		t.Fatalf("Error marshaling %v: %v", ob, err)
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(d, &m); err != nil {
+		t.Fatalf("Error unmarshaling %s: %v", d, err)
+	}
+	return map[string]interface{}{"doc": m}
+}
+
+func TestSearchVisibilityMatchesIsVisibleTo(t *testing.T) {
+	defer withGroups(
+		Group{Name: "qa", Members: []string{"q@example.com"}},
+	)()
+	defer withRoles(nil)()
+
+	users := []User{
+		{},
+		{Id: "plain@example.com"},
+		{Id: "friend@example.com"},
+		{Id: "q@example.com"},
+		{Id: "i@example.com", Internal: true},
+		{Id: "a@example.com", Roles: []string{"auditor"}},
+	}
+
+	bugs := []Bug{
+		{Id: "public", Type: "bug"},
+		{Id: "private", Type: "bug", Private: true},
+		{Id: "friend", Type: "bug", Private: true,
+			AlsoVisibleTo: []string{"friend@example.com"}},
+		{Id: "group", Type: "bug", Private: true,
+			AlsoVisibleTo: []string{"group:qa"}},
+		{Id: "public-shared", Type: "bug",
+			AlsoVisibleTo: []string{"friend@example.com"}},
+	}
+
+	comments := []Comment{
+		{Id: "public", Type: "comment"},
+		{Id: "private", Type: "comment", Private: true},
+	}
+
+	for _, u := range users {
+		bf := bugVisibilityFilter(u)
+		for _, b := range bugs {
+			got := bf == nil || filterMatches(t, bf, asSearchDoc(t, b))
+			if got != b.IsVisibleTo(u) {
+				t.Errorf("Search visibility of bug %v to %q = %v, IsVisibleTo = %v",
+					b.Id, u.Id, got, !got)
+			}
+		}
+
+		cf := commentVisibilityFilter(u)
+		for _, c := range comments {
+			got := cf == nil || filterMatches(t, cf, asSearchDoc(t, c))
+			if got != c.IsVisibleTo(u) {
+				t.Errorf("Search visibility of comment %v to %q = %v, IsVisibleTo = %v",
+					c.Id, u.Id, got, !got)
+			}
+		}
+	}
+}
+
+func TestTagAndNamespaceFilters(t *testing.T) {
+	defer withTagParents(map[string]string{
+		"component:views-index": "component:views",
+	})()
+
+	bugs := []Bug{
+		{Id: "views", Tags: []string{"component:views"}},
+		{Id: "index", Tags: []string{"component:views-index", "windows"}},
+		{Id: "windows", Tags: []string{"platform:windows", "windows"}},
+		{Id: "plain", Tags: []string{"windows"}},
+	}
+
+	tests := []struct {
+		tags, namespaces []string
+		exp              []string
+	}{
+		{[]string{"component:views"}, nil, []string{"views", "index"}},
+		{[]string{"component:views", "windows"}, nil, []string{"index"}},
+		{[]string{"component:views-index"}, nil, []string{"index"}},
+		{[]string{"windows"}, nil, []string{"index", "windows", "plain"}},
+		{nil, []string{"platform"}, []string{"windows"}},
+		{nil, []string{"platform", "component"},
+			[]string{"views", "index", "windows"}},
+		{[]string{"windows"}, []string{"component"}, []string{"index"}},
+	}
+
+	for _, x := range tests {
+		filters := []Filter{}
+		if x.tags != nil {
+			filters = append(filters, buildTagsFilters(x.tags)...)
+		}
+		if x.namespaces != nil {
+			filters = append(filters, buildNamespaceFilter(x.namespaces))
+		}
+		f := buildAndFilter(filters)
+
+		got := []string{}
+		for _, b := range bugs {
+			if filterMatches(t, f, asSearchDoc(t, b)) {
+				got = append(got, b.Id)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(x.exp, ",") {
+			t.Errorf("Tags %v in %v matched %v, expected %v",
+				x.tags, x.namespaces, got, x.exp)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/couchbaselabs/go-couchbase"
+	"github.com/dustin/gomemcached"
+	"github.com/gorilla/mux"
+)
+
+var sessionIdle = flag.Duration("sessionIdle", 7*24*time.Hour,
+	"how long a login session lasts without being used")
+var sessionMax = flag.Duration("sessionMax", 30*24*time.Hour,
+	"how long a login session lasts at most")
+
+// Don't rewrite a session on every request it's used for.
+const sessionSeenResolution = time.Minute
+
+// How recently someone must have logged in to do things that would
+// outlive the session, like setting a first password.
+const freshLoginTime = 10 * time.Minute
+
+var errNoSession = errors.New("No such session")
+var errNotYourSession = errors.New("That's not your session")
+
+func sessionValid(s Session, t time.Time) bool {
+	return s.Type == "session" && t.Before(s.ExpiresAt) &&
+		t.Sub(s.LastSeen) < *sessionIdle
+}
+
+// When the database should forget about the session on its own.
+func sessionDBExpiry(s Session) int {
+	t := s.LastSeen.Add(*sessionIdle)
+	if s.ExpiresAt.Before(t) {
+		t = s.ExpiresAt
+	}
+	return int(t.Unix())
+}
+
+var newSession = func(email, userAgent string) (Session, error) {
+	now := time.Now().UTC()
+	s := Session{
+		Id:        randstring(32),
+		Type:      "session",
+		User:      email,
+		UserAgent: userAgent,
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(*sessionMax),
+	}
+
+	added, err := db.Add("session-"+s.Id, sessionDBExpiry(s), s)
+	if err == nil && !added {
+		err = errors.New("session id collision")
+	}
+	return s, err
+}
+
+var getSession = func(id string) (Session, error) {
+	rv := Session{}
+	err := db.Get("session-"+id, &rv)
+	return rv, err
+}
+
+func touchSession(id string, t time.Time) error {
+	s, err := getSession(id)
+	if err != nil {
+		return err
+	}
+	s.LastSeen = t
+	return db.Update("session-"+id, sessionDBExpiry(s),
+		func(current []byte) ([]byte, error) {
+			if len(current) == 0 {
+				return nil, couchbase.UpdateCancel
+			}
+			s := Session{}
+			err := json.Unmarshal(current, &s)
+			if err != nil {
+				return nil, err
+			}
+			if t.Sub(s.LastSeen) < sessionSeenResolution {
+				return nil, couchbase.UpdateCancel
+			}
+			s.LastSeen = t
+			return json.Marshal(s)
+		})
+}
+
+// Make sure a session is still good and belongs to the given user.
+func checkSession(id, email string) error {
+	if id == "" {
+		return errNoSession
+	}
+	s, err := getSession(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if !sessionValid(s, now) || s.User != email {
+		return errNoSession
+	}
+
+	if now.Sub(s.LastSeen) >= sessionSeenResolution {
+		go func() {
+			maybeLog("recording use of session", touchSession(id, now))
+		}()
+	}
+	return nil
+}
+
+func currentSession(r *http.Request) string {
+	cookie, err := r.Cookie(AUTH_COOKIE)
+	if err != nil {
+		return ""
+	}
+	val := browserIdData{}
+	if secureCookie.Decode("user", cookie.Value, &val) != nil {
+		return ""
+	}
+	return val.Session
+}
+
+// Whether the request comes from a session the user started within
+// freshLoginTime.
+func freshLogin(r *http.Request, email string) bool {
+	id := currentSession(r)
+	if id == "" {
+		return false
+	}
+	s, err := getSession(id)
+	return err == nil && s.User == email &&
+		time.Since(s.CreatedAt) < freshLoginTime
+}
+
+func listSessions(email string) ([]Session, error) {
+	args := map[string]interface{}{
+		"stale":        false,
+		"key":          email,
+		"include_docs": true,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Doc struct {
+				Json Session
+			}
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "sessions", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []Session{}
+	now := time.Now().UTC()
+	for _, row := range viewRes.Rows {
+		if sessionValid(row.Doc.Json, now) {
+			rv = append(rv, row.Doc.Json)
+		}
+	}
+	return rv, nil
+}
+
+func deleteSession(id string) error {
+	err := db.Delete("session-" + id)
+	if gomemcached.IsNotFound(err) {
+		err = nil
+	}
+	return err
+}
+
+func revokeSessions(email string) error {
+	sessions, err := listSessions(email)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		err = deleteSession(s.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func clearAuthCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   AUTH_COOKIE,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+func serveMySessions(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
+
+	sessions, err := listSessions(me.Id)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	current := currentSession(r)
+	rv := []map[string]interface{}{}
+	for _, s := range sessions {
+		rv = append(rv, map[string]interface{}{
+			"id":         s.Id,
+			"user_agent": s.UserAgent,
+			"created_at": s.CreatedAt,
+			"last_seen":  s.LastSeen,
+			"expires_at": s.ExpiresAt,
+			"current":    s.Id == current,
+		})
+	}
+
+	mustEncode(w, rv)
+}
+
+// Log out everywhere.
+func serveRevokeMySessions(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
+
+	err := revokeSessions(me.Id)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	audit(r, me.Id, "sessions.revoke", me.Id, nil)
+
+	clearAuthCookie(w)
+	w.WriteHeader(204)
+}
+
+func serveRevokeMySession(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
+	id := mux.Vars(r)["sessid"]
+
+	s, err := getSession(id)
+	if err == nil && s.User != me.Id {
+		err = errNotYourSession
+	}
+	if err == nil {
+		err = deleteSession(id)
+	}
+	if err != nil {
+		code := errorCode(err)
+		if err == errNotYourSession {
+			code = 403
+		}
+		showError(w, r, err.Error(), code)
+		return
+	}
+
+	audit(r, me.Id, "session.revoke", me.Id,
+		map[string]interface{}{"session": id})
+
+	if id == currentSession(r) {
+		clearAuthCookie(w)
+	}
+	w.WriteHeader(204)
+}
+
+func serveAdminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		showError(w, r, "no email given", 400)
+		return
+	}
+
+	err := revokeSessions(email)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	audit(r, whoami(r).Id, "sessions.revoke", email, nil)
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionValid(t *testing.T) {
+	*sessionIdle = time.Hour
+	defer func() { *sessionIdle = 7 * 24 * time.Hour }()
+
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := Session{
+		Type:      "session",
+		CreatedAt: start,
+		LastSeen:  start.Add(5 * time.Hour),
+		ExpiresAt: start.Add(6 * time.Hour),
+	}
+
+	tests := []struct {
+		At  time.Duration
+		Exp bool
+	}{
+		{5 * time.Hour, true},
+		{5*time.Hour + 59*time.Minute, true},
+		{6 * time.Hour, false},
+		{7 * time.Hour, false},
+	}
+
+	for _, x := range tests {
+		if got := sessionValid(s, start.Add(x.At)); got != x.Exp {
+			t.Errorf("At %v, expected %v, got %v", x.At, x.Exp, got)
+		}
+	}
+
+	s.LastSeen = start
+	if sessionValid(s, start.Add(90*time.Minute)) {
+		t.Errorf("Expected idle session to be invalid")
+	}
+	if got, exp := sessionDBExpiry(s), int(start.Add(time.Hour).Unix()); got != exp {
+		t.Errorf("Expected idle expiry at %v, got %v", exp, got)
+	}
+
+	s.LastSeen = start.Add(5*time.Hour + 30*time.Minute)
+	if got, exp := sessionDBExpiry(s), int(s.ExpiresAt.Unix()); got != exp {
+		t.Errorf("Expected absolute expiry at %v, got %v", exp, got)
+	}
+
+	s.LastSeen = start.Add(5 * time.Hour)
+	s.Type = "user"
+	if sessionValid(s, start.Add(5*time.Hour)) {
+		t.Errorf("Expected non-session to be invalid")
+	}
+}
+
+func withSessions(sessions map[string]Session) func() {
+	origGet := getSession
+	getSession = func(id string) (Session, error) {
+		s, ok := sessions[id]
+		if !ok {
+			return s, errNoSession
+		}
+		return s, nil
+	}
+	return func() {
+		getSession = origGet
+	}
+}
+
+// A cookie logging email in with the given session.
+func sessionCookie(t *testing.T, email, session string) *http.Cookie {
+	initSecureCookie([]byte("test cookie key"))
+	encoded, err := secureCookie.Encode("user", browserIdData{
+		Email: email, Session: session})
+	if err != nil {
+		t.Fatalf("Error encoding cookie: %v", err)
+	}
+	return &http.Cookie{Name: AUTH_COOKIE, Value: encoded}
+}
+
+func TestCheckSession(t *testing.T) {
+	now := time.Now().UTC()
+	sessions := map[string]Session{
+		"live": {Id: "live", Type: "session", User: "a@example.com",
+			CreatedAt: now, LastSeen: now, ExpiresAt: now.Add(time.Hour)},
+		"old": {Id: "old", Type: "session", User: "a@example.com",
+			CreatedAt: now.Add(-2 * time.Hour), LastSeen: now.Add(-2 * time.Hour),
+			ExpiresAt: now.Add(-time.Hour)},
+	}
+	defer withSessions(sessions)()
+
+	tests := []struct {
+		Email, Session string
+		Exp            bool
+	}{
+		{"a@example.com", "live", true},
+		{"b@example.com", "live", false},
+		{"a@example.com", "old", false},
+		{"a@example.com", "revoked", false},
+		{"a@example.com", "", false},
+	}
+
+	for _, x := range tests {
+		err := checkSession(x.Session, x.Email)
+		if (err == nil) != x.Exp {
+			t.Errorf("On %v/%v, expected ok=%v, got %v",
+				x.Email, x.Session, x.Exp, err)
+		}
+	}
+}
+
+func TestFreshLogin(t *testing.T) {
+	initSecureCookie([]byte("test cookie key"))
+
+	now := time.Now().UTC()
+	sessions := map[string]Session{
+		"new": {Id: "new", Type: "session", User: "a@example.com",
+			CreatedAt: now.Add(-time.Minute), LastSeen: now,
+			ExpiresAt: now.Add(time.Hour)},
+		"stale": {Id: "stale", Type: "session", User: "a@example.com",
+			CreatedAt: now.Add(-time.Hour), LastSeen: now,
+			ExpiresAt: now.Add(time.Hour)},
+	}
+	defer withSessions(sessions)()
+
+	request := func(session string) *http.Request {
+		req := httptest.NewRequest("POST", "/api/me/password/", nil)
+		if session != "" {
+			req.AddCookie(sessionCookie(t, "a@example.com", session))
+		}
+		return req
+	}
+
+	tests := []struct {
+		Email, Session string
+		Exp            bool
+	}{
+		{"a@example.com", "new", true},
+		{"b@example.com", "new", false},
+		{"a@example.com", "stale", false},
+		{"a@example.com", "missing", false},
+		{"a@example.com", "", false},
+	}
+
+	for _, x := range tests {
+		if got := freshLogin(request(x.Session), x.Email); got != x.Exp {
+			t.Errorf("freshLogin(%v/%v) = %v, expected %v",
+				x.Email, x.Session, got, x.Exp)
+		}
+	}
+}
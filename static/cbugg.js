@@ -59,6 +59,8 @@ angular.module('cbugg', ['cbuggFilters', 'cbuggAuth', 'cbuggRealtime', 'cbuggEdi
                                    controller: 'AdminCtrl'}).
             when('/prefs/', {templateUrl: '/static/partials/prefs.html',
                                    controller: 'PrefsCtrl'}).
+            when('/login/', {templateUrl: '/static/partials/login.html',
+                                   controller: 'LoginPageCtrl'}).
 
             otherwise({redirectTo: '/statecounts/'});
         $locationProvider.html5Mode(true);
@@ -72,6 +74,22 @@ angular.module('cbugg', ['cbuggFilters', 'cbuggAuth', 'cbuggRealtime', 'cbuggEdi
         }, 30000);
     }]);
 
+// The CSRF token the server wants echoed back on changes.  $http
+// handles this itself; plain forms and raw XHRs need a hand.
+// Show dates in the user's language, if moment knows it.
+function setDateLocale(locale) {
+    try {
+        moment.lang(locale ? locale.split(/[-_]/)[0] : "en");
+    } catch(e) {
+        moment.lang("en");
+    }
+}
+
+function xsrfToken() {
+    var m = document.cookie.match(/(?:^|;\s*)XSRF-TOKEN=([^;]*)/);
+    return m ? decodeURIComponent(m[1]) : "";
+}
+
 function StatesByCountCtrl($scope, $http, cbuggPage, cbuggRealtime) {
     $scope.recent = [];
     cbuggPage.setTitle("Home");
@@ -89,8 +107,8 @@ function StatesByCountCtrl($scope, $http, cbuggPage, cbuggRealtime) {
 }
 
 function bugListDataPrep(data) {
-    var grouped = _.pairs(_.groupBy(data, function(e) { return e.Value.Owner.md5; }));
-    var nameMap = _.object(_.map(data, function(e){return e.Value.Owner.md5;}),
+    var grouped = _.pairs(_.groupBy(data, function(e) { return e.Value.Owner.handle; }));
+    var nameMap = _.object(_.map(data, function(e){return e.Value.Owner.handle;}),
                            _.map(data, function(e){return e.Value.Owner.email;}));
     _.forEach(grouped, function(x) {
         x[1] = _.sortBy(x[1], function(e) { return e.Value.Mod; }).reverse();
@@ -124,7 +142,8 @@ function LoginCtrl($scope, $http, $rootScope, bAlert, cbuggAuth) {
     });
 
     $scope.getAuthToken = function() {
-        $http.get("/api/me/token/").
+        $http.post("/api/me/tokens/", "name=" + encodeURIComponent("From the menu"),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
             success(function(res) {
                 $scope.authtoken = res.token;
             });
@@ -144,6 +163,7 @@ function SearchCtrl($scope, $http, $rootScope, $location, cbuggAuth) {
 }
 
 function SimilarBugCtrl($scope, $http, $location) {
+    $scope.xsrfToken = xsrfToken();
 
     $scope.similarBugs = [];
     $scope.debouncedLookupSimilar = _.debounce(function(){$scope.lookupSimilar();}, 500);
@@ -180,10 +200,14 @@ function PingCtrl($scope, $rootScope, $http, bAlert, cbuggAuth) {
                 .error(function(data, code) {
                     bAlert("Error " + code, "Couldn't ping " + user + ": " + data, "error");
                 })
-                .success(function(data) {
+                .success(function(data, code, headers) {
+                    var warning = headers('Warning');
+                    if (warning) {
+                        bAlert("Warning", warning, "warning");
+                    }
                     $scope.$parent.comments.push({
                         type: 'ping',
-                        from: {md5: $scope.auth.gravatar,
+                        from: {handle: $scope.auth.gravatar,
                                email: $scope.auth.username.match(/[^@]+/)[0]},
                         to: data
                     });
@@ -234,7 +258,7 @@ function TagCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, b
         if($scope.tag) {
             $scope.subcount = $scope.tag.subscribers.length;
             _.forEach($scope.tag.subscribers, function(el) {
-                $scope.subscribed |= ($scope.auth.gravatar == el.md5);
+                $scope.subscribed |= ($scope.auth.gravatar == el.handle);
             });
         }
     };
@@ -260,7 +284,7 @@ function TagCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, b
         $scope.cssdirty = true;
         var val = "";
         if ($scope.tag.fgcolor != "" && $scope.tag.bgcolor != "") {
-            val = ".tag-" + $scope.tag.name + " {" +
+            val = ".tag-" + $scope.tag.name.replace(/([^\w-])/g, "\\$1") + " {" +
                 " background: " + $scope.tag.bgcolor + "; " +
                 " color: " + $scope.tag.fgcolor + ";}";
         }
@@ -268,6 +292,66 @@ function TagCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, b
         document.getElementById("dynamicstyle").innerText = val;
     };
 
+    $scope.updateparent = function() {
+        $http.post("/api/tags/" + $scope.tag.name + "/parent/",
+                   "parent=" + encodeURIComponent($scope.tag.parent || ""),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}})
+            .error(function(data, code) {
+                bAlert("Error " + code, "Failed to move the tag: " + data, "error");})
+            .success(function() {
+                $scope.parentdirty = false;
+            });
+    };
+
+    // Name <handle> reads well and comes back as the same person.
+    var principal = function(p) {
+        return p.handle.indexOf("group:") === 0 ? p.handle : p.email + " <" + p.handle + ">";
+    };
+
+    var metaForm = function(tag) {
+        return {
+            description: tag.description,
+            maintainers: _.map(tag.maintainers, principal).join(", "),
+            default_owner: tag.default_owner ? principal(tag.default_owner) : ""
+        };
+    };
+
+    $scope.updatemeta = function() {
+        $http.post("/api/tags/" + $scope.tag.name + "/meta/", $.param($scope.meta),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}})
+            .error(function(data, code) {
+                bAlert("Error " + code, "Failed to update the tag: " + data, "error");})
+            .success(function(meta) {
+                _.extend($scope.tag, meta);
+                $scope.meta = metaForm($scope.tag);
+            });
+    };
+
+    $scope.renametag = function() {
+        if (!$scope.renameto) {
+            return;
+        }
+        $http.post("/api/tags/" + $scope.tag.name + "/rename/",
+                   "to=" + encodeURIComponent($scope.renameto),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}})
+            .error(function(data, code) {
+                bAlert("Error " + code, "Failed to rename the tag: " + data, "error");})
+            .success(function(res) {
+                bAlert("Renamed", res.bugs + " bugs retagged " + res.into, "success");
+                $location.path("/tag/" + res.into);
+            });
+    };
+
+    $scope.deprecate = function(deprecated) {
+        $http({method: deprecated ? "POST" : "DELETE",
+               url: "/api/tags/" + $scope.tag.name + "/deprecated/"})
+            .error(function(data, code) {
+                bAlert("Error " + code, "Failed to update the tag: " + data, "error");})
+            .success(function() {
+                $scope.tag.deprecated = deprecated;
+            });
+    };
+
     $scope.subscribe = function() {
         $http.post('/api/tags/' + $scope.tag.name + '/sub/');
         $scope.subscribed = true;
@@ -285,6 +369,8 @@ function TagCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, b
     $http.get('/api/tags/' + $routeParams.tagname + "/").success(function(taginfo) {
         $http.get("/api/states/").success(function(allstates) {
             $scope.tag = taginfo;
+            $scope.meta = metaForm(taginfo);
+            $scope.lineage = (taginfo.ancestors || []).slice().reverse();
             var scopeMap = _.object(_.pluck(allstates, 'name'), allstates);
             $scope.states = _.sortBy(_.pairs(taginfo.states),
                                      function(n) {
@@ -305,7 +391,7 @@ function SpecialUsersCtrl($scope, $http, cbuggAuth) {
     });
 }
 
-function AdminCtrl($scope, $http, cbuggAuth) {
+function AdminCtrl($scope, $http, cbuggAuth, bAlert) {
     $http.get("/api/me/").success(function(me) {
         $scope.me = me;
     });
@@ -355,6 +441,181 @@ function AdminCtrl($scope, $http, cbuggAuth) {
         $(".internalbox").val("");
     };
 
+    $scope.resetPassword = function() {
+        var e = $(".passwordbox").val();
+        $http.post("/api/users/password/",
+                   "email=" + encodeURIComponent(e),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
+            success(function(data) {
+                $scope.newPassword = data;
+                $(".passwordbox").val("");
+            }).
+            error(function(data, code) {
+                bAlert("Error " + code, "Failed to reset password.");
+            });
+    };
+
+    $http.get("/api/roles/").success(function(roles) {
+        $scope.roles = roles;
+    });
+
+    $scope.setRoles = function() {
+        var e = $(".rolesuserbox").val();
+        $http.post("/api/users/mod/",
+                   "email=" + encodeURIComponent(e) +
+                   "&roles=" + encodeURIComponent($(".rolesbox").val()),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
+            success(function() {
+                bAlert("Success", "Updated roles for " + e, "success");
+                $(".rolesuserbox").val("");
+                $(".rolesbox").val("");
+            }).
+            error(function(data, code) {
+                bAlert("Error " + code, "Failed to update roles.");
+            });
+    };
+
+    $scope.revokeSessions = function() {
+        var e = $(".sessionbox").val();
+        $http.delete("/api/users/sessions/?email=" + encodeURIComponent(e)).
+            success(function() {
+                bAlert("Success", "Logged " + e + " out everywhere.", "success");
+                $(".sessionbox").val("");
+            }).
+            error(function(data, code) {
+                bAlert("Error " + code, "Failed to revoke sessions.");
+            });
+    };
+
+    $scope.setAliases = function() {
+        var e = $(".aliasuserbox").val();
+        $http.post("/api/users/mod/",
+                   "email=" + encodeURIComponent(e) +
+                   "&aliases=" + encodeURIComponent($(".aliasesbox").val()),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
+            success(function() {
+                bAlert("Success", "Updated aliases for " + e, "success");
+                $(".aliasuserbox").val("");
+                $(".aliasesbox").val("");
+            }).
+            error(function(data, code) {
+                bAlert("Error " + code, "Failed to update aliases: " + data);
+            });
+    };
+
+    $scope.mergeUsers = function() {
+        var from = $(".mergefrombox").val(), into = $(".mergeintobox").val();
+        if (!confirm("Merge " + from + " into " + into + "?  This can't be undone.")) {
+            return;
+        }
+        $http.post("/api/users/merge/",
+                   "from=" + encodeURIComponent(from) + "&into=" + encodeURIComponent(into),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
+            success(function(data) {
+                bAlert("Success", "Merged " + data.documents + " documents from " +
+                       from + " into " + data.into + ".", "success");
+                $(".mergefrombox").val("");
+                $(".mergeintobox").val("");
+            }).
+            error(function(data, code) {
+                bAlert("Error " + code, "Failed to merge: " + data);
+            });
+    };
+
+    $scope.deactivationReport = function() {
+        var e = $(".leaverbox").val();
+        $http.get("/api/users/deactivate/?email=" + encodeURIComponent(e)).
+            success(function(data) {
+                $scope.leaver = data;
+            }).
+            error(function(data, code) {
+                bAlert("Error " + code, "Failed to look up " + e + ".");
+            });
+    };
+
+    $scope.deactivate = function() {
+        var e = $(".leaverbox").val();
+        if (!confirm("Deactivate " + e + "?")) {
+            return;
+        }
+        $http.post("/api/users/deactivate/",
+                   "email=" + encodeURIComponent(e) +
+                   "&successor=" + encodeURIComponent($(".successorbox").val()),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
+            success(function(data) {
+                $scope.leaver = data;
+            }).
+            error(function(data, code) {
+                bAlert("Error " + code, "Failed to deactivate " + e + ": " + data);
+            });
+    };
+
+    $scope.reactivate = function() {
+        var e = $(".leaverbox").val();
+        $http.post("/api/users/reactivate/",
+                   "email=" + encodeURIComponent(e),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
+            success(function() {
+                bAlert("Success", "Reactivated " + e + ".", "success");
+                $scope.leaver = null;
+            }).
+            error(function(data, code) {
+                bAlert("Error " + code, "Failed to reactivate " + e + ".");
+            });
+    };
+
+    $scope.exportUser = function() {
+        var e = $(".exportbox").val();
+        window.location = "/api/users/export/?format=zip&email=" + encodeURIComponent(e);
+        $(".exportbox").val("");
+    };
+
+    $scope.eraseUser = function() {
+        var e = $(".erasebox").val();
+        if (!confirm("Erase " + e + " from every bug?  This can't be undone.")) {
+            return;
+        }
+        $http.post("/api/users/erase/",
+                   "email=" + encodeURIComponent(e),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
+            success(function(data) {
+                bAlert("Success", "Erased " + e + " from " + data.documents +
+                       " documents, now shown as " + data.alias + ".", "success");
+                $(".erasebox").val("");
+            }).
+            error(function(data, code) {
+                bAlert("Error " + code, "Failed to erase user.");
+            });
+    };
+
     $(".userbox").typeahead({source: $scope.getUsers});
 
-}
\ No newline at end of file
+}
+
+function LoginPageCtrl($scope, $http, $location, cbuggPage, bAlert) {
+    cbuggPage.setTitle("Log In");
+    $scope.returnTo = $location.search()['return'] || "/";
+    $scope.providers = [];
+    $scope.form = {};
+
+    $http.get('/auth/providers').success(function(providers) {
+        $scope.providers = providers;
+        $scope.passwordProviders = _.without(providers, "oidc");
+        $scope.form.provider = $scope.passwordProviders[0];
+    });
+
+    $scope.oidcURL = function() {
+        return "/auth/login?provider=oidc&return=" + encodeURIComponent($scope.returnTo);
+    };
+
+    $scope.login = function() {
+        $http.post('/auth/login', $.param($scope.form),
+                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
+            success(function() {
+                window.location = $scope.returnTo;
+            }).
+            error(function(data, code) {
+                bAlert("Error " + code, "Failed to log in.", "error");
+            });
+    };
+}
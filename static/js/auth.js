@@ -9,57 +9,47 @@ cbuggAuth.factory('cbuggAuth', function($rootScope, $http, bAlert, cbuggPrefs) {
         userPrefs: {}
     };
 
-    personaLoaded(function () {
-        navigator.id.watch({
-            onlogin: function(assertion) {
-                $http.post('/auth/login', "assertion="+assertion+"&audience=" +
-                    encodeURIComponent(location.protocol+"//"+location.host),
-                    {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
-                success(function(res) {
-                    auth.loggedin = true;
-                    auth.username = res.email;
-                    auth.gravatar = res.emailmd5;
-                    if(res.prefs) {
-                        // some users have prefs: null
-                        // in which case they should keep the defaults
-                       auth.userPrefs = res.prefs;
-                       auth.prefs = $.extend(true, cbuggPrefs.getDefaultPreferences(), auth.userPrefs);
-                    }
-                    auth.authtoken = "";
-                    $rootScope.loggedin = true;
-                }).
-                error(function(res, err) {
-                    bAlert("Error", "Couldn't log you in.", "error");
-                });
-            },
-            onlogout: function() {
-                $http.post('/auth/logout').
-                    success(function(res) {
-                        $rootScope.loggedin = false;
-                        auth.loggedin = false;
-                        auth.authtoken = "";
-                        auth.username = "";
-                        auth.gravatar = "";
-                        auth.prefs = cbuggPrefs.getDefaultPreferences();
-                        auth.userPrefs = {};
-                    }).
-                    error(function(res) {
-                        bAlert("Error", "Problem logging out.", "error");
-                        // we failed to log out, do not pretend to have succeeded
-                    });
-            }});
-    });
-    function fetchAuthToken() {
-        $http.get("/api/me/token/").
+    // Ask the server whether our cookie is still good.
+    $http.post('/auth/login').
+        success(function(res) {
+            auth.loggedin = true;
+            auth.username = res.email;
+            auth.gravatar = res.handle;
+            setDateLocale(res.locale);
+            if(res.prefs) {
+                // some users have prefs: null
+                // in which case they should keep the defaults
+               auth.userPrefs = res.prefs;
+               auth.prefs = $.extend(true, cbuggPrefs.getDefaultPreferences(), auth.userPrefs);
+            }
+            auth.authtoken = "";
+            $rootScope.loggedin = true;
+        });
+    function logout() {
+        $http.post('/auth/logout').
             success(function(res) {
-                auth.authtoken = res.token;
+                $rootScope.loggedin = false;
+                auth.loggedin = false;
+                auth.authtoken = "";
+                auth.username = "";
+                auth.gravatar = "";
+                auth.prefs = cbuggPrefs.getDefaultPreferences();
+                auth.userPrefs = {};
+            }).
+            error(function(res) {
+                bAlert("Error", "Problem logging out.", "error");
+                // we failed to log out, do not pretend to have succeeded
             });
     }
-    function logout() {
-        navigator.id.logout();
-    }
     function login() {
-        navigator.id.request();
+        var ret = encodeURIComponent(window.location.pathname);
+        $http.get('/auth/providers').success(function(providers) {
+            if (_.isEqual(providers, ["oidc"])) {
+                window.location = "/auth/login?return=" + ret;
+            } else {
+                window.location = "/login/?return=" + ret;
+            }
+        });
     }
     function getAuth() {
         return auth;
@@ -1,5 +1,12 @@
 function BugCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, bAlert, cbuggAuth, cbuggPage, cbuggGrowl) {
     $rootScope.$watch('loggedin', function() { $scope.auth = cbuggAuth.get(); });
+    var showWarnings = function(headers) {
+        var warning = headers('Warning');
+        if (warning) {
+            bAlert("Warning", warning, "warning");
+        }
+    };
+
     var updateBug = function(field, newValue) {
         var bug = $scope.bug;
         if (newValue === undefined) {
@@ -8,9 +15,10 @@ function BugCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, b
         if(bug && newValue) {
             $http.post('/api/bug/' + bug.id, "id=" + field + "&value=" + encodeURIComponent(newValue),
                        {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
-            success(function(data) {
+            success(function(data, code, headers) {
                 $scope.bug = data;
                 checkSubscribed();
+                showWarnings(headers);
             }).
             error(function(data, code) {
                 bAlert("Error " + code, "could not update bug: " + data, "error");
@@ -102,6 +110,7 @@ function BugCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, b
         xhr.addEventListener("error", uploadFailed, false);
         xhr.addEventListener("abort", uploadCanceled, false);
         xhr.open("POST", "/api/bug/" + $scope.bug.id + "/attachments/");
+        xhr.setRequestHeader("X-XSRF-TOKEN", xsrfToken());
         $scope.progressVisible = true;
         xhr.send(fd);
     };
@@ -199,14 +208,14 @@ function BugCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, b
         if($scope.bug) {
             $scope.subcount = $scope.bug.subscribers.length;
             _.forEach($scope.bug.subscribers, function(el) {
-                $scope.subscribed |= ($scope.auth.gravatar == el.md5);
+                $scope.subscribed |= ($scope.auth.gravatar == el.handle);
             });
         }
     };
 
     var checkOwnership = function (objects) {
         var owned = _.map(objects, function(ob) {
-            if(ob.user && $rootScope.loggedin && $scope.auth.gravatar == ob.user.md5) {
+            if(ob.user && $rootScope.loggedin && $scope.auth.gravatar == ob.user.handle) {
                 ob.mine = true;
             } else {
                 ob.mine = false;
@@ -327,8 +336,9 @@ function BugCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, b
                     'body=' + encodeURIComponent($scope.draftcomment) +
                    '&private=' + $scope.draftcommentpriv,
                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
-            success(function(data) {
+            success(function(data, code, headers) {
                 console.log("Posting comment", $scope.draftcomment, $scope.draftcommentpriv);
+                showWarnings(headers);
                 data.mine = true;
                 $scope.comments.push(data);
                 $scope.draftcomment="";
@@ -419,7 +429,7 @@ function BugCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, b
 
     $scope.rmSpecial = function(u) {
         $http.post('/api/bug/' + $routeParams.bugId + '/viewer/remove/',
-                   'email=' + u.md5,
+                   'email=' + u.handle,
                   {headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
             success(function(data) {
                 $scope.bug.also_visible_to = data.also_visible_to;
@@ -450,7 +460,7 @@ function BugCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, b
             // not this bug
             return;
         }
-        else if(change.user.md5 == $scope.auth.gravatar) {
+        else if(change.user.handle == $scope.auth.gravatar) {
             // wait this is me
             return;
         }
@@ -465,8 +475,10 @@ function BugCtrl($scope, $routeParams, $http, $rootScope, $timeout, $location, b
         alertAction = "changed";
         if(change.action == "commented on") {
             alertAction = "commented";
+        } else if(change.action == "edited a comment on") {
+            alertAction = "edited";
         }
-        alertId = change.bugid + "-" + alertAction + "-by-" + change.user.md5;
+        alertId = change.bugid + "-" + alertAction + "-by-" + change.user.handle;
         alert = { title: "Update", template: "change", change: change, context: $location.path(), id: alertId};
         cbuggGrowl.createAlert(alert);
     });
@@ -37,7 +37,7 @@ function NavigatorCtrl($scope, $routeParams, $http, $location, cbuggAuth, cbuggP
     $scope.isSubscribed = function(userhash, subscribers) {
         for (var i in subscribers) {
             subscriber = subscribers[i];
-            if (subscriber.md5 == userhash) {
+            if (subscriber.handle == userhash) {
                 return true;
             }
         }
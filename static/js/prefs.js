@@ -46,6 +46,140 @@ function PrefsCtrl($scope, $http, cbuggAuth, cbuggPage, cbuggPrefs, bAlert) {
 		});
 	};
 
+	$scope.avatarVersion = 0;
+	$http.get("/api/me/profile/").success(function(profile) {
+		$scope.profile = profile;
+	});
+
+	var profileUpdated = function(profile) {
+		$scope.profile = profile;
+		$scope.avatarVersion++;
+	};
+
+	$scope.saveProfile = function() {
+		var form = _.pick($scope.profile, "display_name", "time_zone", "locale");
+		$http.post("/api/me/profile/", $.param(form),
+			{headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
+			success(function(profile) {
+				profileUpdated(profile);
+				setDateLocale(profile.locale);
+				bAlert("Success", "Profile Saved", "success");
+			}).
+			error(function(err) {
+				bAlert("Error", err, "error");
+			});
+	};
+
+	$scope.uploadAvatar = function(files) {
+		if (!files.length) {
+			return;
+		}
+		var fd = new FormData();
+		fd.append("avatar", files[0]);
+		$http.post("/api/me/profile/avatar/", fd,
+			{headers: {"Content-Type": undefined}, transformRequest: angular.identity}).
+			success(profileUpdated).
+			error(function(err) {
+				bAlert("Error", err, "error");
+			});
+	};
+
+	$scope.removeAvatar = function() {
+		$http.delete("/api/me/profile/avatar/").
+			success(profileUpdated).
+			error(function(err) {
+				bAlert("Error", err, "error");
+			});
+	};
+
+	$scope.awayForm = {};
+	$http.get("/api/me/away/").success(function(away) {
+		$scope.away = away;
+	});
+
+	$scope.saveAway = function() {
+		$http.post("/api/me/away/", $.param($scope.awayForm),
+			{headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
+			success(function(away) {
+				$scope.away = away;
+				$scope.awayForm = {};
+				bAlert("Success", "Away Saved", "success");
+			}).
+			error(function(err) {
+				bAlert("Error", err, "error");
+			});
+	};
+
+	$scope.clearAway = function() {
+		$http.delete("/api/me/away/").
+			success(function(away) {
+				$scope.away = away;
+			}).
+			error(function(err) {
+				bAlert("Error", err, "error");
+			});
+	};
+
+	var loadTokens = function() {
+		$http.get("/api/me/tokens/").success(function(tokens) {
+			$scope.tokens = tokens;
+		});
+	};
+	loadTokens();
+
+	$scope.newToken = {scope: "full"};
+
+	$scope.createToken = function() {
+		$http.post("/api/me/tokens/", $.param($scope.newToken),
+			{headers: {"Content-Type": "application/x-www-form-urlencoded"}}).
+			success(function(res) {
+				$scope.createdToken = res.token;
+				$scope.newToken = {scope: "full"};
+				loadTokens();
+			}).
+			error(function(err) {
+				bAlert("Error", err, "error");
+			});
+	};
+
+	$scope.revokeToken = function(id) {
+		$http.delete("/api/me/tokens/" + id).
+			success(loadTokens).
+			error(function(err) {
+				bAlert("Error", err, "error");
+			});
+	};
+
+	var loadSessions = function() {
+		$http.get("/api/me/sessions/").success(function(sessions) {
+			$scope.sessions = sessions;
+		});
+	};
+	loadSessions();
+
+	$scope.endSession = function(s) {
+		$http.delete("/api/me/sessions/" + s.id).
+			success(function() {
+				if (s.current) {
+					window.location = "/";
+				}
+				loadSessions();
+			}).
+			error(function(err) {
+				bAlert("Error", err, "error");
+			});
+	};
+
+	$scope.logoutEverywhere = function() {
+		$http.delete("/api/me/sessions/").
+			success(function() {
+				window.location = "/";
+			}).
+			error(function(err) {
+				bAlert("Error", err, "error");
+			});
+	};
+
 	$scope.reset = function() {
 		cbuggPrefs.saveUserPreferences({},
 			function(res) {
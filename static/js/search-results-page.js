@@ -25,7 +25,7 @@ function SearchResultsCtrl($scope, $routeParams, $location, cbuggPage, cbuggSear
     $scope.isSubscribed = function(userhash, subscribers) {
         for (var i in subscribers) {
             subscriber = subscribers[i];
-            if (subscriber.md5 == userhash) {
+            if (subscriber.handle == userhash) {
                 return true;
             }
         }
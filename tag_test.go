@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -36,3 +37,189 @@ func TestNewTags(t *testing.T) {
 		}
 	}
 }
+
+func withTagParents(parents map[string]string) func() {
+	origLoad := loadTagParents
+	loadTagParents = func() (map[string]string, error) {
+		return parents, nil
+	}
+	forgetTagParents()
+	return func() {
+		loadTagParents = origLoad
+		forgetTagParents()
+	}
+}
+
+func withTags(tags map[string]Tag) func() {
+	origGet := getTag
+	getTag = func(name string) (Tag, error) {
+		tag, ok := tags[name]
+		if !ok {
+			return Tag{}, NotFound
+		}
+		return tag, nil
+	}
+	return func() {
+		getTag = origGet
+	}
+}
+
+func TestTagTree(t *testing.T) {
+	defer withTagParents(map[string]string{
+		"component:views":       "component:server",
+		"component:views-index": "component:views",
+		"component:views-query": "component:views",
+		"loop-a":                "loop-b",
+		"loop-b":                "loop-a",
+	})()
+
+	tests := []struct {
+		tag         string
+		ancestors   []string
+		descendants []string
+	}{
+		{"component:views-index",
+			[]string{"component:views", "component:server"},
+			[]string{}},
+		{"component:server",
+			[]string{},
+			[]string{"component:views", "component:views-index",
+				"component:views-query"}},
+		{"plain", []string{}, []string{}},
+		// Loops shouldn't have been allowed in, but mustn't hang.
+		{"loop-a", []string{"loop-b"}, []string{"loop-b"}},
+	}
+
+	for _, x := range tests {
+		if got := tagAncestors(x.tag); !reflect.DeepEqual(got, x.ancestors) {
+			t.Errorf("Ancestors of %v = %v, expected %v",
+				x.tag, got, x.ancestors)
+		}
+		if got := tagDescendants(x.tag); !reflect.DeepEqual(got, x.descendants) {
+			t.Errorf("Descendants of %v = %v, expected %v",
+				x.tag, got, x.descendants)
+		}
+	}
+
+	parentTests := []struct {
+		tag, parent string
+		err         error
+	}{
+		{"component:views", "", nil},
+		{"component:ui", "component:server", nil},
+		{"component:server", "component:views-index", invalidParent},
+		{"component:server", "component:server", invalidParent},
+		{"component:server", "component:", invalidTag},
+	}
+
+	for _, x := range parentTests {
+		if err := checkTagParent(x.tag, x.parent); err != x.err {
+			t.Errorf("Putting %v under %v = %v, expected %v",
+				x.tag, x.parent, err, x.err)
+		}
+	}
+}
+
+func TestValidTag(t *testing.T) {
+	tests := []struct {
+		tag string
+		exp bool
+	}{
+		{"views", true},
+		{"component-view-engine", true},
+		{"component:views", true},
+		{"version:2.0", true},
+		{"platform:windows:8", true},
+		{"", false},
+		{":views", false},
+		{"component:", false},
+		{"two words", false},
+	}
+
+	for _, x := range tests {
+		if got := validTag(x.tag); got != x.exp {
+			t.Errorf("validTag(%q) = %v, expected %v", x.tag, got, x.exp)
+		}
+	}
+}
+
+func TestCSSClassEscape(t *testing.T) {
+	tests := []struct {
+		in, exp string
+	}{
+		{"views", "views"},
+		{"component:views", `component\:views`},
+		{"version:2.0", `version\:2\.0`},
+	}
+
+	for _, x := range tests {
+		if got := cssClassEscape(x.in); got != x.exp {
+			t.Errorf("cssClassEscape(%q) = %q, expected %q", x.in, got, x.exp)
+		}
+	}
+}
+
+func TestReplaceTags(t *testing.T) {
+	tests := []struct {
+		tags, from []string
+		into       string
+		exp        []string
+	}{
+		{[]string{"a", "viewengine", "b"}, []string{"viewengine"}, "views",
+			[]string{"a", "views", "b"}},
+		{[]string{"view-engine", "views"}, []string{"view-engine"}, "views",
+			[]string{"views"}},
+		{[]string{"viewengine", "a", "view-engine"},
+			[]string{"viewengine", "view-engine"}, "component:views",
+			[]string{"component:views", "a"}},
+		{[]string{"a"}, []string{"viewengine"}, "views", []string{"a"}},
+		{[]string{}, []string{"viewengine"}, "views", []string{}},
+	}
+
+	for _, x := range tests {
+		got := replaceTags(x.tags, x.from, x.into)
+		if !reflect.DeepEqual(got, x.exp) {
+			t.Errorf("Replacing %v with %v in %v = %v, expected %v",
+				x.from, x.into, x.tags, got, x.exp)
+		}
+	}
+}
+
+func TestTagFromPath(t *testing.T) {
+	tests := []struct {
+		path, exp string
+	}{
+		{"/api/tags/views/css/", "views"},
+		{"/api/tags/component:views/meta/", "component:views"},
+		{"/api/tags/views/", "views"},
+	}
+
+	for _, x := range tests {
+		if got := tagFromPath(x.path); got != x.exp {
+			t.Errorf("tagFromPath(%q) = %q, expected %q", x.path, got, x.exp)
+		}
+	}
+}
+
+func TestAbsorbTags(t *testing.T) {
+	into := Tag{Name: "views", Subscribers: []string{"a@x"},
+		Description: "Views and indexes"}
+	old := []Tag{
+		{Name: "view", Subscribers: []string{"b@x", "a@x"},
+			FGColor: "#fff", BGColor: "#000", Parent: "server",
+			Description: "The old one", Maintainers: []string{"m@x"},
+			DefaultOwner: "o@x"},
+		{Name: "vews", Subscribers: []string{"c@x"},
+			Maintainers: []string{"n@x"}, DefaultOwner: "p@x"},
+	}
+
+	absorbTags(&into, old)
+
+	exp := Tag{Name: "views", Subscribers: []string{"b@x", "a@x", "c@x"},
+		FGColor: "#fff", BGColor: "#000", Parent: "server",
+		Description: "Views and indexes", Maintainers: []string{"m@x"},
+		DefaultOwner: "o@x"}
+	if !reflect.DeepEqual(into, exp) {
+		t.Errorf("Expected\n%+v, got\n%+v", exp, into)
+	}
+}
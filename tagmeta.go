@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// What a tag is for, who looks after it, and who its bugs go to
+// before anyone's picked them up.
+
+var invalidDefaultOwner = errors.New("default owners must be active people or groups")
+
+var getTag = func(name string) (Tag, error) {
+	tag := Tag{}
+	err := db.Get("tag-"+name, &tag)
+	if err == nil && tag.Type != "tag" {
+		return Tag{}, fmt.Errorf("Expected a tag, got %v", tag.Type)
+	}
+	return tag, err
+}
+
+// Whether u looks after the tag or one above it.
+func maintainsTag(u User, name string) bool {
+	for _, t := range append([]string{name}, tagAncestors(name)...) {
+		tag, err := getTag(t)
+		if err == nil && principalsInclude(tag.Maintainers, u.Id) {
+			return true
+		}
+	}
+	return false
+}
+
+func maintainsAnyTag(u User, tags []string) bool {
+	for _, t := range tags {
+		if maintainsTag(u, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// The tag in a /api/tags/{tag}/... path.  Route variables aren't set
+// yet when matchers run.
+func tagFromPath(path string) string {
+	t := strings.TrimPrefix(path, "/api/tags/")
+	if x := strings.Index(t, "/"); x >= 0 {
+		t = t[:x]
+	}
+	return t
+}
+
+// Tag editors may change any tag, and maintainers their own.
+func tagEditRequired(r *http.Request, rm *mux.RouteMatch) bool {
+	me := whoami(r)
+	return userCan(me, permTagEdit) ||
+		(me.Id != "" && maintainsTag(me, tagFromPath(r.URL.Path)))
+}
+
+// Whether me may change a field of a bug.  Maintainers of a bug's
+// tags may triage it without being triagers everywhere.
+func mayUpdateBugField(me User, bugid, field string) bool {
+	perm := bugFieldPermission(field)
+	if userCan(me, perm) {
+		return true
+	}
+	if perm != permBugTriage || me.Id == "" {
+		return false
+	}
+	b, err := getBug(bugid)
+	return err == nil && maintainsAnyTag(me, b.Tags)
+}
+
+// The default owner of the first of the tags (or the nearest tag
+// above it) that has one, skipping anyone in except.
+func defaultOwnerFor(tags []string, except string) string {
+	for _, t := range tags {
+		for _, a := range append([]string{t}, tagAncestors(t)...) {
+			tag, err := getTag(a)
+			if err != nil || tag.DefaultOwner == "" ||
+				tag.DefaultOwner == except ||
+				userForEmail(tag.DefaultOwner).Deactivated {
+				continue
+			}
+			return tag.DefaultOwner
+		}
+	}
+	return ""
+}
+
+// Give an untriaged, unowned bug to the default owner of one of the
+// tags it was just given.  Returns any warnings from the assignment.
+func autoAssign(b Bug, tags []string, me User) []string {
+	if b.Owner != "" || (b.Status != "inbox" && b.Status != "new") {
+		return nil
+	}
+	owner := defaultOwnerFor(tags, "")
+	if owner == "" {
+		return nil
+	}
+	_, warnings, err := updateBug(b.Id, "owner", owner, me)
+	if err != nil {
+		log.Printf("Error assigning %v to %v: %v", b.Id, owner, err)
+		return nil
+	}
+	return warnings
+}
+
+func tagMetaJSON(tag Tag) map[string]interface{} {
+	maintainers := []Email{}
+	for _, m := range tag.Maintainers {
+		maintainers = append(maintainers, Email(m))
+	}
+	rv := map[string]interface{}{
+		"description": tag.Description,
+		"maintainers": maintainers,
+		"deprecated":  tag.Deprecated,
+		"parent":      tag.Parent,
+		"namespace":   tagNamespace(tag.Name),
+	}
+	if tag.DefaultOwner != "" {
+		rv["default_owner"] = Email(tag.DefaultOwner)
+	}
+	return rv
+}
+
+// Every tag document, for listing tags with their metadata.
+func allTags() (map[string]Tag, error) {
+	args := map[string]interface{}{
+		"include_docs": true,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Key string
+			Doc struct {
+				Json Tag
+			}
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "tag_info", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]Tag{}
+	for _, row := range viewRes.Rows {
+		rv[row.Key] = row.Doc.Json
+	}
+	return rv, nil
+}
+
+// Set a tag's description, maintainers and default owner from
+// whichever of them are in the form.
+func serveTagMetaUpdate(w http.ResponseWriter, r *http.Request) {
+	tagname := mux.Vars(r)["tag"]
+	r.ParseForm()
+
+	var maintainers []string
+	if _, ok := r.Form["maintainers"]; ok {
+		maintainers = []string{}
+		for _, m := range splitList(r.FormValue("maintainers")) {
+			maintainers = append(maintainers, resolvePrincipal(m))
+		}
+	}
+	owner := resolvePrincipal(r.FormValue("default_owner"))
+	if owner != "" && ((!strings.Contains(owner, "@") && !isGroupPrincipal(owner)) ||
+		userForEmail(owner).Deactivated) {
+		showError(w, r, invalidDefaultOwner.Error(), 400)
+		return
+	}
+
+	tag := Tag{}
+	err := db.Update("tag-"+tagname, 0, func(current []byte) ([]byte, error) {
+		tag = Tag{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &tag)
+			if err != nil {
+				return nil, err
+			}
+			if tag.Type != "tag" {
+				return nil, fmt.Errorf("Expected a tag, got %v",
+					tag.Type)
+			}
+		}
+
+		tag.Name = tagname
+		tag.Type = "tag"
+		if _, ok := r.Form["description"]; ok {
+			tag.Description = strings.TrimSpace(r.FormValue("description"))
+		}
+		if maintainers != nil {
+			tag.Maintainers = maintainers
+		}
+		if _, ok := r.Form["default_owner"]; ok {
+			tag.DefaultOwner = owner
+		}
+
+		return json.Marshal(tag)
+	})
+
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	audit(r, whoami(r).Id, "tag.meta", tagname, map[string]interface{}{
+		"maintainers":   tag.Maintainers,
+		"default_owner": tag.DefaultOwner,
+	})
+
+	mustEncode(w, tagMetaJSON(tag))
+}
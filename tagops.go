@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/go-couchbase"
+	"github.com/gorilla/mux"
+)
+
+// Cleaning up tags across every bug that has them: renaming,
+// merging several into one, and deprecating them so they aren't
+// applied again.
+
+var (
+	deprecatedTag = errors.New("deprecated tags can't be newly applied")
+	errMergeTags  = errors.New("need tags to merge and a tag to merge them into")
+)
+
+// Refuse any of the given tags that have been deprecated.
+func checkDeprecatedTags(tags []string) error {
+	for _, t := range tags {
+		if t == "" {
+			continue
+		}
+		tag := Tag{}
+		if err := db.Get("tag-"+t, &tag); err == nil && tag.Deprecated {
+			return deprecatedTag
+		}
+	}
+	return nil
+}
+
+// Swap any of from in tags for into, keeping the order and not
+// doubling up.
+func replaceTags(tags, from []string, into string) []string {
+	rv := []string{}
+	for _, t := range tags {
+		if contains(from, t) {
+			t = into
+		}
+		if !contains(rv, t) {
+			rv = append(rv, t)
+		}
+	}
+	return rv
+}
+
+// The ids of every bug with the tag.
+func bugsTagged(t string) ([]string, error) {
+	args := map[string]interface{}{
+		"reduce":    false,
+		"stale":     false,
+		"start_key": []interface{}{t},
+		"end_key":   []interface{}{t, map[string]interface{}{}},
+	}
+	res, err := db.View("cbugg", "tags", args)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []string{}
+	for _, row := range res.Rows {
+		if !strings.HasPrefix(row.ID, "tag-") {
+			rv = append(rv, row.ID)
+		}
+	}
+	return rv, nil
+}
+
+// Rewrite a bug's tags, leaving history behind as an edit would.
+// Subscribers aren't mailed; nothing about the bug has really changed.
+func retagBug(id string, from []string, into string, me User) error {
+	now := time.Now().UTC()
+	historyKey := id + "-" + now.Format(time.RFC3339Nano)
+
+	err := db.Update(id, 0, func(current []byte) ([]byte, error) {
+		if len(current) == 0 {
+			return nil, couchbase.UpdateCancel
+		}
+		bug := Bug{}
+		err := json.Unmarshal(current, &bug)
+		if err != nil {
+			return nil, err
+		}
+		if bug.Type != "bug" {
+			return nil, couchbase.UpdateCancel
+		}
+
+		tags := replaceTags(bug.Tags, from, into)
+		if strings.Join(tags, ",") == strings.Join(bug.Tags, ",") {
+			return nil, couchbase.UpdateCancel
+		}
+
+		history := Bug{
+			Id:         id,
+			Type:       "bughistory",
+			ModifiedAt: bug.ModifiedAt,
+			ModType:    bug.ModType,
+			ModBy:      bug.ModBy,
+			Tags:       bug.Tags,
+		}
+		err = db.Set(historyKey, 0, &history)
+		if err != nil {
+			return nil, err
+		}
+
+		bug.Tags = tags
+		bug.ModifiedAt = now
+		bug.ModBy = me.Id
+		bug.ModType = "tags"
+		bug.Parent = historyKey
+
+		return json.Marshal(&bug)
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+// Give a tag the subscribers of others, and their colors, parent,
+// description, maintainers and default owner where it has none.
+func absorbTags(tag *Tag, old []Tag) {
+	for _, o := range old {
+		for _, s := range o.Subscribers {
+			tag.Subscribers = removeFromList(tag.Subscribers, s)
+			tag.Subscribers = append(tag.Subscribers, s)
+		}
+		if tag.FGColor == "" && tag.BGColor == "" {
+			tag.FGColor, tag.BGColor = o.FGColor, o.BGColor
+		}
+		if tag.Parent == "" {
+			tag.Parent = o.Parent
+		}
+		if tag.Description == "" {
+			tag.Description = o.Description
+		}
+		if len(tag.Maintainers) == 0 {
+			tag.Maintainers = o.Maintainers
+		}
+		if tag.DefaultOwner == "" {
+			tag.DefaultOwner = o.DefaultOwner
+		}
+	}
+}
+
+// Fold the from tags into into, on every bug and in the tags
+// themselves.  into takes what absorbTags gives it, and their
+// children.  Returns how many bugs were retagged.
+func mergeTags(from []string, into string, me User) (int, error) {
+	from = removeFromList(from, into)
+	if len(from) == 0 || into == "" {
+		return 0, errMergeTags
+	}
+	if err := checkTags(append([]string{into}, from...)); err != nil {
+		return 0, err
+	}
+	if err := checkDeprecatedTags([]string{into}); err != nil {
+		return 0, err
+	}
+
+	ids := []string{}
+	for _, t := range from {
+		tagged, err := bugsTagged(t)
+		if err != nil {
+			return 0, err
+		}
+		for _, id := range tagged {
+			if !contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	n := 0
+	for _, id := range ids {
+		if err := retagBug(id, from, into, me); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	old := []Tag{}
+	for _, t := range from {
+		tag := Tag{}
+		if err := db.Get("tag-"+t, &tag); err == nil && tag.Type == "tag" {
+			old = append(old, tag)
+		}
+	}
+
+	err := db.Update("tag-"+into, 0, func(current []byte) ([]byte, error) {
+		tag := Tag{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &tag)
+			if err != nil {
+				return nil, err
+			}
+			if tag.Type != "tag" {
+				return nil, fmt.Errorf("Expected a tag, got %v",
+					tag.Type)
+			}
+		}
+
+		tag.Name = into
+		tag.Type = "tag"
+		absorbTags(&tag, old)
+		// Don't end up under a tag that's going away, or in a loop.
+		parents := getTagParents()
+		for seen := []string{}; contains(from, tag.Parent) &&
+			!contains(seen, tag.Parent); {
+			seen = append(seen, tag.Parent)
+			tag.Parent = parents[tag.Parent]
+		}
+		if contains(from, tag.Parent) ||
+			checkTagParent(into, tag.Parent) != nil {
+			tag.Parent = ""
+		}
+
+		return json.Marshal(tag)
+	})
+	if err != nil {
+		return n, err
+	}
+
+	for c, p := range getTagParents() {
+		if c == into || !contains(from, p) {
+			continue
+		}
+		err = setTagParent(c, into)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	for _, o := range old {
+		err = db.Delete("tag-" + o.Name)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	forgetTagParents()
+	return n, nil
+}
+
+func serveMergeTags(w http.ResponseWriter, r *http.Request, from []string, into string) {
+	me := whoami(r)
+	n, err := mergeTags(from, into, me)
+	audit(r, me.Id, "tag.merge", into,
+		map[string]interface{}{"from": from, "bugs": n})
+	if err != nil {
+		code := 500
+		switch err {
+		case errMergeTags, invalidTag, deprecatedTag:
+			code = 400
+		}
+		showError(w, r, err.Error(), code)
+		return
+	}
+
+	mustEncode(w, map[string]interface{}{
+		"from": from,
+		"into": into,
+		"bugs": n,
+	})
+}
+
+func serveRenameTag(w http.ResponseWriter, r *http.Request) {
+	serveMergeTags(w, r, []string{mux.Vars(r)["tag"]},
+		strings.TrimSpace(r.FormValue("to")))
+}
+
+func serveMergeTagList(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	from := []string{}
+	for _, f := range r.Form["from"] {
+		from = append(from, splitTags(f)...)
+	}
+	serveMergeTags(w, r, from, strings.TrimSpace(r.FormValue("into")))
+}
+
+func serveTagDeprecation(w http.ResponseWriter, r *http.Request, deprecated bool) {
+	tagname := mux.Vars(r)["tag"]
+
+	err := db.Update("tag-"+tagname, 0, func(current []byte) ([]byte, error) {
+		tag := Tag{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &tag)
+			if err != nil {
+				return nil, err
+			}
+			if tag.Type != "tag" {
+				return nil, fmt.Errorf("Expected a tag, got %v",
+					tag.Type)
+			}
+		}
+
+		tag.Name = tagname
+		tag.Type = "tag"
+		tag.Deprecated = deprecated
+
+		return json.Marshal(tag)
+	})
+
+	audit(r, whoami(r).Id, "tag.deprecate", tagname,
+		map[string]interface{}{"deprecated": deprecated})
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func serveDeprecateTag(w http.ResponseWriter, r *http.Request) {
+	serveTagDeprecation(w, r, true)
+}
+
+func serveUndeprecateTag(w http.ResponseWriter, r *http.Request) {
+	serveTagDeprecation(w, r, false)
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -32,11 +35,45 @@ func serveTagList(w http.ResponseWriter, r *http.Request) {
 		rv[r.Key[0]] = r.Value
 	}
 
-	mustEncode(w, rv)
+	if r.FormValue("meta") == "" {
+		mustEncode(w, rv)
+		return
+	}
+
+	// With meta, each tag comes with its description, maintainers
+	// and so on alongside its count.
+	tags, err := allTags()
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+	withMeta := map[string]interface{}{}
+	for name, count := range rv {
+		tag := tags[name]
+		tag.Name = name
+		m := tagMetaJSON(tag)
+		m["count"] = count
+		withMeta[name] = m
+	}
+	mustEncode(w, withMeta)
 }
 
-func serveTagStates(w http.ResponseWriter, r *http.Request) {
-	t := mux.Vars(r)["tag"]
+// Counting bugs across a tag tree means going through every one of
+// them, so the counts are kept for a while.
+const tagStateCacheTime = 30 * time.Second
+
+type tagStateEntry struct {
+	states  map[string]interface{}
+	fetched time.Time
+}
+
+var tagStateCache = struct {
+	sync.Mutex
+	entries map[string]tagStateEntry
+}{entries: map[string]tagStateEntry{}}
+
+// Count bugs by state with a single tag, as the view reduces them.
+func tagStateCounts(t string) (map[string]interface{}, error) {
 	args := map[string]interface{}{
 		"group_level": 2,
 		"stale":       false,
@@ -45,14 +82,90 @@ func serveTagStates(w http.ResponseWriter, r *http.Request) {
 	}
 	states, err := db.View("cbugg", "tags", args)
 	if err != nil {
-		showError(w, r, err.Error(), 500)
-		return
+		return nil, err
 	}
 
 	statemap := map[string]interface{}{}
 	for _, row := range states.Rows {
 		statemap[row.Key.([]interface{})[1].(string)] = row.Value
 	}
+	return statemap, nil
+}
+
+// Count bugs by state under a tag and everything beneath it.  A bug
+// carrying more than one of them is only counted once.
+func tagStates(tags []string) (map[string]interface{}, error) {
+	if len(tags) == 1 {
+		return tagStateCounts(tags[0])
+	}
+
+	key := strings.Join(tags, ",")
+	now := time.Now()
+
+	tagStateCache.Lock()
+	e, ok := tagStateCache.entries[key]
+	tagStateCache.Unlock()
+	if ok && now.Sub(e.fetched) < tagStateCacheTime {
+		return e.states, nil
+	}
+
+	statemap, err := countTagTreeStates(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	tagStateCache.Lock()
+	defer tagStateCache.Unlock()
+	for k, e := range tagStateCache.entries {
+		if now.Sub(e.fetched) >= tagStateCacheTime {
+			delete(tagStateCache.entries, k)
+		}
+	}
+	tagStateCache.entries[key] = tagStateEntry{statemap, now}
+	return statemap, nil
+}
+
+// Count bugs by state across tags, one bug at a time so that bugs with
+// several of them aren't counted twice.
+func countTagTreeStates(tags []string) (map[string]interface{}, error) {
+	byBug := map[string][]interface{}{}
+	for _, t := range tags {
+		args := map[string]interface{}{
+			"reduce":    false,
+			"stale":     false,
+			"start_key": []interface{}{t},
+			"end_key":   []interface{}{t, map[string]interface{}{}},
+		}
+		states, err := db.View("cbugg", "tags", args)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range states.Rows {
+			byBug[row.ID] = row.Key.([]interface{})
+		}
+	}
+
+	statemap := map[string]interface{}{}
+	for id, k := range byBug {
+		state := k[1].(string)
+		n, _ := statemap[state].(int)
+		// The tag documents themselves are there to list the tag.
+		if !strings.HasPrefix(id, "tag-") {
+			n++
+		}
+		statemap[state] = n
+	}
+	return statemap, nil
+}
+
+func serveTagStates(w http.ResponseWriter, r *http.Request) {
+	t := mux.Vars(r)["tag"]
+	descendants := tagDescendants(t)
+	statemap, err := tagStates(append([]string{t}, descendants...))
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
 
 	tag := Tag{}
 	subs := []Email{}
@@ -65,16 +178,64 @@ func serveTagStates(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Error fetching tag %v: %v", t, err)
 	}
 
-	mustEncode(w, map[string]interface{}{
-		"states":      statemap,
-		"subscribers": subs,
-		"name":        t,
-		"bgcolor":     tag.BGColor,
-		"fgcolor":     tag.FGColor,
+	tag.Name = t
+	rv := tagMetaJSON(tag)
+	rv["states"] = statemap
+	rv["subscribers"] = subs
+	rv["name"] = t
+	rv["ancestors"] = tagAncestors(t)
+	rv["children"] = tagChildren(t)
+	rv["descendants"] = descendants
+	rv["bgcolor"] = tag.BGColor
+	rv["fgcolor"] = tag.FGColor
+	rv["maintained"] = maintainsTag(whoami(r), t)
+
+	mustEncode(w, rv)
+}
+
+func setTagParent(tagname, parent string) error {
+	return db.Update("tag-"+tagname, 0, func(current []byte) ([]byte, error) {
+		tag := Tag{}
+		if len(current) > 0 {
+			err := json.Unmarshal(current, &tag)
+			if err != nil {
+				return nil, err
+			}
+			if tag.Type != "tag" {
+				return nil, fmt.Errorf("Expected a tag, got %v",
+					tag.Type)
+			}
+		}
+
+		tag.Name = tagname
+		tag.Type = "tag"
+		tag.Parent = parent
+
+		return json.Marshal(tag)
 	})
 }
 
-func updateTagSubscription(tagname, email string, add bool) error {
+// Put a tag under another, or with no parent, back at the top.
+func serveSetTagParent(w http.ResponseWriter, r *http.Request) {
+	tagname := mux.Vars(r)["tag"]
+	parent := strings.TrimSpace(r.FormValue("parent"))
+	if err := checkTagParent(tagname, parent); err != nil {
+		showError(w, r, err.Error(), 400)
+		return
+	}
+
+	err := setTagParent(tagname, parent)
+	forgetTagParents()
+
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+var updateTagSubscription = func(tagname, email string, add bool) error {
 	return db.Update("tag-"+tagname, 0, func(current []byte) ([]byte, error) {
 		tag := Tag{}
 		if len(current) > 0 {
@@ -100,18 +261,25 @@ func updateTagSubscription(tagname, email string, add bool) error {
 	})
 }
 
-func serveSubscribeTag(w http.ResponseWriter, r *http.Request) {
-	err := updateTagSubscription(mux.Vars(r)["tag"], whoami(r).Id, true)
-	if err != nil {
-		showError(w, r, err.Error(), 500)
-		return
+// Subscribe or unsubscribe yourself or whoever is named in the email
+// parameter: a group you belong to or, for tag maintainers, anyone.
+func serveTagSubscription(w http.ResponseWriter, r *http.Request, add bool) {
+	me := whoami(r)
+	email := resolvePrincipal(r.FormValue("email"))
+	if email == "" {
+		email = me.Id
 	}
 
-	w.WriteHeader(204)
-}
+	if !maySubscribeAs(me, email) {
+		if email == me.Id {
+			showError(w, r, "You are not allowed to subscribe", 403)
+		} else {
+			showError(w, r, "You can only change your own subscription", 403)
+		}
+		return
+	}
 
-func serveUnsubscribeTag(w http.ResponseWriter, r *http.Request) {
-	err := updateTagSubscription(mux.Vars(r)["tag"], whoami(r).Id, false)
+	err := updateTagSubscription(mux.Vars(r)["tag"], email, add)
 	if err != nil {
 		showError(w, r, err.Error(), 500)
 		return
@@ -120,6 +288,14 @@ func serveUnsubscribeTag(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(204)
 }
 
+func serveSubscribeTag(w http.ResponseWriter, r *http.Request) {
+	serveTagSubscription(w, r, true)
+}
+
+func serveUnsubscribeTag(w http.ResponseWriter, r *http.Request) {
+	serveTagSubscription(w, r, false)
+}
+
 func serveTagCSS(w http.ResponseWriter, r *http.Request) {
 	args := map[string]interface{}{
 		"include_docs": true,
@@ -149,7 +325,7 @@ func serveTagCSS(w http.ResponseWriter, r *http.Request) {
 		j := r.Doc.Json
 		if j.BGColor != "" && j.FGColor != "" {
 			fmt.Fprintf(w, ".tag-%v { background: %v; color: %v; }\n",
-				r.Key, j.BGColor, j.FGColor)
+				cssClassEscape(r.Key), j.BGColor, j.FGColor)
 		}
 	}
 }
@@ -185,3 +361,19 @@ func serveTagCSSUpdate(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(204)
 }
+
+// Namespaced tags have colons in their class names, which need
+// escaping in selectors.
+func cssClassEscape(s string) string {
+	rv := []rune{}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '-', r == '_', r > 127:
+		default:
+			rv = append(rv, '\\')
+		}
+		rv = append(rv, r)
+	}
+	return string(rv)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tags may be namespaced, as in component:views or platform:windows,
+// and may sit under a parent tag.  Plain tags are neither, and work
+// as they always have.
+
+const tagTreeCacheTime = 30 * time.Second
+
+var (
+	invalidTag    = errors.New("namespaced tags look like namespace:name")
+	invalidParent = errors.New("a tag can't be under itself or its descendants")
+)
+
+var tagTreeCache = struct {
+	sync.Mutex
+	parents map[string]string
+	fetched time.Time
+}{}
+
+// Tag -> parent, for tags that have one.
+var loadTagParents = func() (map[string]string, error) {
+	args := map[string]interface{}{
+		"stale": false,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Key   string
+			Value string
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "tag_parents", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]string{}
+	for _, row := range viewRes.Rows {
+		rv[row.Key] = row.Value
+	}
+	return rv, nil
+}
+
+func getTagParents() map[string]string {
+	tagTreeCache.Lock()
+	defer tagTreeCache.Unlock()
+
+	if tagTreeCache.parents != nil &&
+		time.Since(tagTreeCache.fetched) < tagTreeCacheTime {
+		return tagTreeCache.parents
+	}
+
+	parents, err := loadTagParents()
+	if err != nil {
+		log.Printf("Error loading tag parents: %v", err)
+		if tagTreeCache.parents != nil {
+			return tagTreeCache.parents
+		}
+		return map[string]string{}
+	}
+	tagTreeCache.parents = parents
+	tagTreeCache.fetched = time.Now()
+	return parents
+}
+
+func forgetTagParents() {
+	tagTreeCache.Lock()
+	defer tagTreeCache.Unlock()
+	tagTreeCache.parents = nil
+}
+
+// The namespace of a tag, or "" for plain tags.
+func tagNamespace(t string) string {
+	if x := strings.Index(t, ":"); x > 0 {
+		return t[:x]
+	}
+	return ""
+}
+
+func validTag(t string) bool {
+	if t == "" || strings.ContainsAny(t, ", \t\r\n") {
+		return false
+	}
+	x := strings.Index(t, ":")
+	return x < 0 || (x > 0 && x < len(t)-1)
+}
+
+// Split a tag list as typed into a bug, on commas and spaces.
+func splitTags(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		switch r {
+		case ',', ' ':
+			return true
+		}
+		return false
+	})
+}
+
+func checkTags(tags []string) error {
+	for _, t := range tags {
+		if !validTag(t) {
+			return invalidTag
+		}
+	}
+	return nil
+}
+
+// The parent, grandparent and so on of a tag, nearest first.
+func tagAncestors(t string) []string {
+	parents := getTagParents()
+	rv := []string{}
+	for p := parents[t]; p != "" && p != t && !contains(rv, p); p = parents[p] {
+		rv = append(rv, p)
+	}
+	return rv
+}
+
+// Every tag under t, at any depth.
+func tagDescendants(t string) []string {
+	children := map[string][]string{}
+	for c, p := range getTagParents() {
+		children[p] = append(children[p], c)
+	}
+
+	rv := []string{}
+	todo := children[t]
+	for len(todo) > 0 {
+		c := todo[0]
+		todo = todo[1:]
+		if c == t || contains(rv, c) {
+			continue
+		}
+		rv = append(rv, c)
+		todo = append(todo, children[c]...)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// The tags directly under t.
+func tagChildren(t string) []string {
+	rv := []string{}
+	for c, p := range getTagParents() {
+		if p == t {
+			rv = append(rv, c)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Whether t may be put under parent without making a loop.
+func checkTagParent(t, parent string) error {
+	if parent == "" {
+		return nil
+	}
+	if !validTag(parent) {
+		return invalidTag
+	}
+	if parent == t || contains(tagAncestors(parent), t) {
+		return invalidParent
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/go-couchbase"
+	"github.com/gorilla/mux"
+)
+
+// What a token may be used for.
+const (
+	scopeRead    = "read"
+	scopeComment = "comment"
+	scopeFull    = "full"
+)
+
+// Don't rewrite a token document on every request it's used for.
+const tokenUseResolution = time.Minute
+
+// The pseudo-id the old single per-user token is listed under until
+// it's first used, and the prefix of the token it then becomes.
+const legacyTokenId = "legacy"
+
+var errNotYourToken = errors.New("That's not your token")
+
+var commentPathRE = regexp.MustCompile(`^/api/bug/[^/]+/comments/([^/]+)?$`)
+
+func validScope(s string) bool {
+	return s == scopeRead || s == scopeComment || s == scopeFull
+}
+
+// Whether a token with the given scope may make the given request.
+func tokenScopeAllows(scope string, r *http.Request) bool {
+	safe := r.Method == "GET" || r.Method == "HEAD"
+	switch scope {
+	case scopeFull:
+		return true
+	case scopeComment:
+		return safe || (r.Method == "POST" && commentPathRE.MatchString(r.URL.Path))
+	case scopeRead:
+		return safe
+	}
+	return false
+}
+
+func hashTokenSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// Check a presented secret against a token at time t.
+func tokenMatches(tok APIToken, secret string, t time.Time) bool {
+	if tok.ExpiresAt != nil && !t.Before(*tok.ExpiresAt) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(tok.Hash),
+		[]byte(hashTokenSecret(secret))) == 1
+}
+
+func getAPIToken(id string) (APIToken, error) {
+	rv := APIToken{}
+	err := db.Get("apitoken-"+id, &rv)
+	if err == nil && rv.Type != "apitoken" {
+		return APIToken{}, errors.New("not a token")
+	}
+	return rv, err
+}
+
+func touchAPIToken(id string, t time.Time) error {
+	return db.Update("apitoken-"+id, 0, func(current []byte) ([]byte, error) {
+		if len(current) == 0 {
+			return nil, couchbase.UpdateCancel
+		}
+		tok := APIToken{}
+		err := json.Unmarshal(current, &tok)
+		if err != nil {
+			return nil, err
+		}
+		if tok.LastUsed != nil && t.Sub(*tok.LastUsed) < tokenUseResolution {
+			return nil, couchbase.UpdateCancel
+		}
+		tok.LastUsed = &t
+		return json.Marshal(tok)
+	})
+}
+
+// The hashed token an old style, single, full access token becomes.
+// Its id comes from the secret, so the old token can still be
+// presented without its id.
+func legacyToken(email, secret string, t time.Time) APIToken {
+	hash := hashTokenSecret(secret)
+	return APIToken{
+		Id:        legacyTokenId + "-" + hash[:16],
+		Type:      "apitoken",
+		User:      email,
+		Name:      "Original API token",
+		Hash:      hash,
+		Scope:     scopeFull,
+		CreatedAt: t,
+	}
+}
+
+// Replace a user's plaintext token with its hashed equivalent.
+func migrateLegacyToken(user User, t time.Time) error {
+	tok := legacyToken(user.Id, user.AuthToken, t)
+	_, err := db.Add("apitoken-"+tok.Id, 0, tok)
+	if err != nil {
+		return err
+	}
+
+	err = db.Update("u-"+user.Id, 0, func(current []byte) ([]byte, error) {
+		if len(current) == 0 {
+			return nil, couchbase.UpdateCancel
+		}
+		u := User{}
+		err := json.Unmarshal(current, &u)
+		if err != nil {
+			return nil, err
+		}
+		if u.AuthToken != user.AuthToken {
+			return nil, couchbase.UpdateCancel
+		}
+
+		u.AuthToken = ""
+
+		return json.Marshal(u)
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+// Find the user a Basic auth email and token identify for this request.
+func userFromToken(r *http.Request, email, token string) (User, bool) {
+	user, err := getUser(email)
+	if err == nil && user.Deactivated {
+		return User{}, false
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		// The old style token.  It's still in plaintext the first
+		// time it's used, so hash it and carry on as if it always
+		// had been.
+		if err == nil && user.AuthToken != "" &&
+			subtle.ConstantTimeCompare([]byte(user.AuthToken), []byte(token)) == 1 {
+			merr := migrateLegacyToken(user, time.Now().UTC())
+			if merr != nil {
+				log.Printf("Error migrating token for %v: %v",
+					user.Id, merr)
+				return User{}, false
+			}
+			user.AuthToken = ""
+		}
+		parts = []string{legacyToken(email, token, time.Time{}).Id, token}
+	}
+
+	tok, terr := getAPIToken(parts[0])
+	if terr != nil || tok.User != canonicalEmail(email) {
+		return User{}, false
+	}
+	now := time.Now().UTC()
+	if !tokenMatches(tok, parts[1], now) || !tokenScopeAllows(tok.Scope, r) {
+		return User{}, false
+	}
+
+	if tok.LastUsed == nil || now.Sub(*tok.LastUsed) >= tokenUseResolution {
+		go func() {
+			maybeLog("recording use of token "+tok.Id, touchAPIToken(tok.Id, now))
+		}()
+	}
+
+	if err != nil {
+		user = User{Id: tok.User, Type: "user"}
+	}
+	return user, true
+}
+
+func listAPITokens(email string) ([]APIToken, error) {
+	args := map[string]interface{}{
+		"stale":        false,
+		"key":          email,
+		"include_docs": true,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Doc struct {
+				Json APIToken
+			}
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "api_tokens", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []APIToken{}
+	for _, row := range viewRes.Rows {
+		tok := row.Doc.Json
+		tok.Hash = ""
+		rv = append(rv, tok)
+	}
+	return rv, nil
+}
+
+func serveTokenList(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
+
+	rv, err := listAPITokens(me.Id)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	if me.AuthToken != "" {
+		rv = append(rv, APIToken{
+			Id:    legacyTokenId,
+			User:  me.Id,
+			Name:  "Original API token",
+			Scope: scopeFull,
+		})
+	}
+
+	mustEncode(w, rv)
+}
+
+func serveNewToken(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
+
+	scope := r.FormValue("scope")
+	if scope == "" {
+		scope = scopeFull
+	}
+	if !validScope(scope) {
+		showError(w, r, "Invalid scope: "+scope, 400)
+		return
+	}
+
+	now := time.Now().UTC()
+	secret := randstring(32)
+	tok := APIToken{
+		Id:        randstring(12),
+		Type:      "apitoken",
+		User:      me.Id,
+		Name:      r.FormValue("name"),
+		Hash:      hashTokenSecret(secret),
+		Scope:     scope,
+		CreatedAt: now,
+	}
+
+	if e := r.FormValue("expires_in"); e != "" {
+		d, err := time.ParseDuration(e)
+		if err != nil || d <= 0 {
+			showError(w, r, "Invalid expiry: "+e, 400)
+			return
+		}
+		exp := now.Add(d)
+		tok.ExpiresAt = &exp
+	}
+
+	added, err := db.Add("apitoken-"+tok.Id, 0, tok)
+	if err == nil && !added {
+		err = errors.New("token id collision")
+	}
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	audit(r, me.Id, "token.create", me.Id, map[string]interface{}{
+		"token": tok.Id, "name": tok.Name, "scope": tok.Scope})
+
+	tok.Hash = ""
+	w.WriteHeader(201)
+	mustEncode(w, map[string]interface{}{
+		"token": tok.Id + "." + secret,
+		"info":  tok,
+	})
+}
+
+func serveRevokeToken(w http.ResponseWriter, r *http.Request) {
+	me := whoami(r)
+	id := mux.Vars(r)["tokid"]
+
+	var err error
+	if id == legacyTokenId {
+		err = db.Update("u-"+me.Id, 0, func(current []byte) ([]byte, error) {
+			user := User{}
+			if len(current) > 0 {
+				err := json.Unmarshal(current, &user)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// Common fields
+			user.Id = me.Id
+			user.Type = "user"
+
+			user.AuthToken = ""
+
+			return json.Marshal(user)
+		})
+	} else {
+		var tok APIToken
+		tok, err = getAPIToken(id)
+		if err == nil && tok.User != me.Id {
+			err = errNotYourToken
+		}
+		if err == nil {
+			err = db.Delete("apitoken-" + id)
+		}
+	}
+
+	if err != nil {
+		code := errorCode(err)
+		if err == errNotYourToken {
+			code = 403
+		}
+		showError(w, r, err.Error(), code)
+		return
+	}
+
+	audit(r, me.Id, "token.revoke", me.Id,
+		map[string]interface{}{"token": id})
+
+	w.WriteHeader(204)
+}
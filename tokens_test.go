@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenScopeAllows(t *testing.T) {
+	tests := []struct {
+		Scope, Method, Path string
+		Exp                 bool
+	}{
+		{scopeFull, "DELETE", "/api/bug/bug-1", true},
+		{scopeFull, "POST", "/api/bug/bug-1", true},
+		{scopeRead, "GET", "/api/bug/bug-1", true},
+		{scopeRead, "HEAD", "/api/bug/bug-1", true},
+		{scopeRead, "POST", "/api/bug/bug-1", false},
+		{scopeRead, "POST", "/api/bug/bug-1/comments/", false},
+		{scopeComment, "GET", "/api/bug/bug-1", true},
+		{scopeComment, "POST", "/api/bug/bug-1/comments/", true},
+		{scopeComment, "POST", "/api/bug/bug-1/comments/c-1", true},
+		{scopeComment, "DELETE", "/api/bug/bug-1/comments/c-1", false},
+		{scopeComment, "POST", "/api/bug/bug-1/comments/c-1/undel", false},
+		{scopeComment, "POST", "/api/bug/bug-1", false},
+		{scopeComment, "POST", "/api/me/tokens/", false},
+		{"bogus", "GET", "/api/bug/bug-1", false},
+	}
+
+	for _, x := range tests {
+		r := httptest.NewRequest(x.Method, x.Path, nil)
+		got := tokenScopeAllows(x.Scope, r)
+		if got != x.Exp {
+			t.Errorf("%v %v %v = %v, expected %v",
+				x.Scope, x.Method, x.Path, got, x.Exp)
+		}
+	}
+}
+
+func TestTokenMatches(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+
+	tok := APIToken{Hash: hashTokenSecret("sekrit")}
+	if !tokenMatches(tok, "sekrit", now) {
+		t.Errorf("Expected token to match")
+	}
+	if tokenMatches(tok, "sekrits", now) {
+		t.Errorf("Expected wrong secret not to match")
+	}
+	if tokenMatches(tok, tok.Hash, now) {
+		t.Errorf("Expected the hash itself not to match")
+	}
+
+	tok.ExpiresAt = &later
+	if !tokenMatches(tok, "sekrit", now) {
+		t.Errorf("Expected unexpired token to match")
+	}
+	if tokenMatches(tok, "sekrit", later) {
+		t.Errorf("Expected expired token not to match")
+	}
+}
+
+func TestLegacyToken(t *testing.T) {
+	now := time.Now()
+	tok := legacyToken("a@example.com", "oldsekrit", now)
+	if tok.Scope != scopeFull || tok.User != "a@example.com" {
+		t.Errorf("Expected a full access token for the user, got %+v", tok)
+	}
+	if !tokenMatches(tok, "oldsekrit", now) {
+		t.Errorf("Expected the old token to match")
+	}
+	if strings.Contains(tok.Id+tok.Hash, "oldsekrit") {
+		t.Errorf("Expected no plaintext in %+v", tok)
+	}
+	// The id can be found again from the old token alone.
+	if again := legacyToken("", "oldsekrit", time.Time{}); again.Id != tok.Id {
+		t.Errorf("Expected id %v, got %v", tok.Id, again.Id)
+	}
+	if other := legacyToken("a@example.com", "newsekrit", now); other.Id == tok.Id {
+		t.Errorf("Expected different tokens to get different ids")
+	}
+}
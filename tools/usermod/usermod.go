@@ -17,6 +17,10 @@ type User struct {
 	AuthToken string                 `json:"auth_token,omitmepty"`
 	Internal  bool                   `json:"internal"`
 	Prefs     map[string]interface{} `json:"prefs"`
+
+	PasswordHash string   `json:"password_hash,omitempty"`
+	Roles        []string `json:"roles,omitempty"`
+	DisplayName  string   `json:"display_name,omitempty"`
 }
 
 func updateUser(email string, isAdmin, isInternal bool) {
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/gorilla/mux"
+)
+
+var uploadExpiry = flag.Duration("uploadExpiry", 24*time.Hour,
+	"how long an idle resumable upload is kept around")
+
+var errNotYourUpload = errors.New("not your upload")
+var errUploadBusy = errors.New("upload is being finalized")
+var errUploadTooBig = errors.New("chunk runs past the end of the upload")
+
+type uploadOffsetError struct {
+	expected int64
+}
+
+func (e uploadOffsetError) Error() string {
+	return fmt.Sprintf("wrong offset, expected %v", e.expected)
+}
+
+func uploadErrorCode(err error) int {
+	switch err.(type) {
+	case uploadOffsetError:
+		return 409
+	}
+	switch err {
+	case errNotYourUpload:
+		return 403
+	case errUploadBusy:
+		return 409
+	case errUploadTooBig:
+		return 413
+	}
+	return errorCode(err)
+}
+
+// Reads a sequence of blob store URLs as if they were one file.
+type chunkReader struct {
+	urls []string
+	cur  io.ReadCloser
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.urls) == 0 {
+				return 0, io.EOF
+			}
+			res, err := http.Get(c.urls[0])
+			if err != nil {
+				return 0, err
+			}
+			if res.StatusCode != 200 {
+				res.Body.Close()
+				return 0, fmt.Errorf("Error fetching chunk %v: %v",
+					c.urls[0], res.Status)
+			}
+			c.urls = c.urls[1:]
+			c.cur = res.Body
+		}
+
+		n, err := c.cur.Read(b)
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.cur != nil {
+		return c.cur.Close()
+	}
+	return nil
+}
+
+func getUpload(upid string) (Upload, error) {
+	up := Upload{}
+	err := db.Get(upid, &up)
+	if err == nil && up.Type != "upload" {
+		return Upload{}, fmt.Errorf("Expected an upload, got %v", up.Type)
+	}
+	return up, err
+}
+
+func updateUpload(upid string, me User, f func(up *Upload) error) (Upload, error) {
+	up := Upload{}
+	err := db.Update(upid, 0, func(current []byte) ([]byte, error) {
+		if len(current) == 0 {
+			return nil, NotFound
+		}
+		up = Upload{}
+		err := json.Unmarshal(current, &up)
+		if err != nil {
+			return nil, err
+		}
+
+		if up.Type != "upload" {
+			return nil, fmt.Errorf("Expected an upload, got %v",
+				up.Type)
+		}
+
+		if up.User != me.Id {
+			return nil, errNotYourUpload
+		}
+
+		if err := f(&up); err != nil {
+			return nil, err
+		}
+
+		up.ModifiedAt = time.Now().UTC()
+
+		return json.Marshal(up)
+	})
+	return up, err
+}
+
+// Whether a chunk of length bytes (-1 if not known yet) may go at
+// offset.
+func checkChunk(up Upload, offset, length int64) error {
+	if up.Finalizing {
+		return errUploadBusy
+	}
+	if offset != up.Received {
+		return uploadOffsetError{up.Received}
+	}
+	if up.Size > 0 && length > up.Size-offset {
+		return errUploadTooBig
+	}
+	return nil
+}
+
+// Add a stored chunk of n bytes at offset to the upload, unless
+// something else got there first.
+func recordChunk(up *Upload, offset, n int64, dest string) error {
+	if err := checkChunk(*up, offset, n); err != nil {
+		return err
+	}
+	up.Chunks = append(up.Chunks, dest)
+	up.Received += n
+	return nil
+}
+
+// Claim the upload so concurrent chunks, finishes or aborts can't
+// sneak in while it's being assembled or thrown away.  Only complete
+// uploads may be finished.
+func claimUpload(up *Upload, finishing bool) error {
+	if up.Finalizing {
+		return errUploadBusy
+	}
+	if finishing && up.Size > 0 && up.Received != up.Size {
+		return uploadOffsetError{up.Received}
+	}
+	up.Finalizing = true
+	return nil
+}
+
+func releaseUpload(upid string, me User) {
+	_, err := updateUpload(upid, me, func(up *Upload) error {
+		up.Finalizing = false
+		return nil
+	})
+	maybeLog("releasing upload "+upid, err)
+}
+
+func uploadStatus(up Upload) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           up.Id,
+		"filename":     up.Filename,
+		"content_type": up.ContentType,
+		"size":         up.Size,
+		"offset":       up.Received,
+		"modified_at":  up.ModifiedAt,
+	}
+}
+
+func serveNewUpload(w http.ResponseWriter, r *http.Request) {
+	if *cbfsUrl == "" {
+		showError(w, r, "attachment storage is not configured", 500)
+		return
+	}
+
+	bugid := mux.Vars(r)["bugid"]
+	me := whoami(r)
+	if _, err := getBugOrDisplayErr(bugid, me, w, r); err != nil {
+		return
+	}
+
+	filename := r.FormValue("filename")
+	if filename == "" {
+		showError(w, r, "No filename given", 400)
+		return
+	}
+
+	size := int64(0)
+	if s := r.FormValue("size"); s != "" {
+		var err error
+		size, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || size < 0 {
+			showError(w, r, "Invalid size: "+s, 400)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	up := Upload{
+		Id:          "upload-" + bugid + "-" + randstring(8),
+		BugId:       bugid,
+		Type:        "upload",
+		Filename:    filename,
+		ContentType: r.FormValue("content_type"),
+		Size:        size,
+		User:        me.Id,
+		CreatedAt:   now,
+		ModifiedAt:  now,
+	}
+
+	added, err := db.Add(up.Id, 0, up)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+	if !added {
+		showError(w, r, "Upload collision on "+up.Id, 500)
+		return
+	}
+
+	w.WriteHeader(201)
+	mustEncode(w, uploadStatus(up))
+}
+
+func getUploadOrDisplayErr(w http.ResponseWriter, r *http.Request) (Upload, error) {
+	bugid := mux.Vars(r)["bugid"]
+	me := whoami(r)
+	if _, err := getBugOrDisplayErr(bugid, me, w, r); err != nil {
+		return Upload{}, err
+	}
+
+	up, err := getUpload(mux.Vars(r)["upid"])
+	if err == nil && (up.BugId != bugid || up.User != me.Id) {
+		err = errNotYourUpload
+	}
+	if err != nil {
+		showError(w, r, err.Error(), uploadErrorCode(err))
+	}
+	return up, err
+}
+
+func serveUploadStatus(w http.ResponseWriter, r *http.Request) {
+	up, err := getUploadOrDisplayErr(w, r)
+	if err != nil {
+		return
+	}
+
+	mustEncode(w, uploadStatus(up))
+}
+
+func serveUploadChunk(w http.ResponseWriter, r *http.Request) {
+	up, err := getUploadOrDisplayErr(w, r)
+	if err != nil {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	if err != nil {
+		showError(w, r, "Invalid offset: "+r.FormValue("offset"), 400)
+		return
+	}
+
+	// Check early so we don't store a chunk we'd have to throw away.
+	if err := checkChunk(up, offset, r.ContentLength); err != nil {
+		showError(w, r, err.Error(), uploadErrorCode(err))
+		return
+	}
+
+	// Every attempt gets its own chunk, so concurrent writes at the
+	// same offset can't clobber the one that ends up recorded.
+	dest := fmt.Sprintf("%v%v/%v/chunk-%016d-%v", *cbfsUrl,
+		up.BugId, up.Id, offset, randstring(6))
+
+	durl, err := url.Parse(dest)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	cbfsc, err := cbfsclient.New(*cbfsUrl)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	cr := &countingReader{r: r.Body}
+	err = cbfsc.Put(up.Filename, durl.Path, cr,
+		cbfsclient.PutOptions{ContentType: "application/octet-stream"})
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	if r.ContentLength >= 0 && cr.n != r.ContentLength {
+		maybeLog("deleting short chunk", deleteBlobFile(dest))
+		showError(w, r, fmt.Sprintf("Short chunk, got %v of %v bytes",
+			cr.n, r.ContentLength), 400)
+		return
+	}
+
+	if cr.n == 0 {
+		maybeLog("deleting empty chunk", deleteBlobFile(dest))
+		showError(w, r, "Empty chunk", 400)
+		return
+	}
+
+	up, err = updateUpload(up.Id, whoami(r), func(up *Upload) error {
+		return recordChunk(up, offset, cr.n, dest)
+	})
+	if err != nil {
+		maybeLog("deleting unrecorded chunk", deleteBlobFile(dest))
+		showError(w, r, err.Error(), uploadErrorCode(err))
+		return
+	}
+
+	mustEncode(w, uploadStatus(up))
+}
+
+func deleteUploadChunks(up Upload) {
+	for _, u := range up.Chunks {
+		maybeLog("deleting upload chunk", deleteBlobFile(u))
+	}
+}
+
+func serveFinishUpload(w http.ResponseWriter, r *http.Request) {
+	up, err := getUploadOrDisplayErr(w, r)
+	if err != nil {
+		return
+	}
+
+	me := whoami(r)
+
+	up, err = updateUpload(up.Id, me, func(up *Upload) error {
+		return claimUpload(up, true)
+	})
+	if err != nil {
+		showError(w, r, err.Error(), uploadErrorCode(err))
+		return
+	}
+
+	att, err := assembleUpload(up)
+	if err != nil {
+		releaseUpload(up.Id, me)
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	maybeLog("deleting upload "+up.Id, db.Delete(up.Id))
+	go deleteUploadChunks(up)
+
+	log.Printf("Assembled upload %v -> %v", up.Id, att.Url)
+
+	notifyAttachment(att)
+
+	mustEncode(w, attachmentJSON(att))
+}
+
+func assembleUpload(up Upload) (Attachment, error) {
+	chunks := &chunkReader{urls: up.Chunks}
+	defer chunks.Close()
+
+	att := Attachment{
+		BugId:       up.BugId,
+		ContentType: up.ContentType,
+		Filename:    up.Filename,
+		User:        up.User,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	err := putAttachment(&att, chunks, up.Received)
+	return att, err
+}
+
+func serveAbortUpload(w http.ResponseWriter, r *http.Request) {
+	up, err := getUploadOrDisplayErr(w, r)
+	if err != nil {
+		return
+	}
+
+	me := whoami(r)
+	up, err = updateUpload(up.Id, me, func(up *Upload) error {
+		return claimUpload(up, false)
+	})
+	if err != nil {
+		showError(w, r, err.Error(), uploadErrorCode(err))
+		return
+	}
+
+	err = db.Delete(up.Id)
+	if err != nil {
+		releaseUpload(up.Id, me)
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	w.WriteHeader(204)
+
+	go deleteUploadChunks(up)
+}
+
+func expireUploads(t time.Time) error {
+	args := map[string]interface{}{
+		"end_key": t.UTC().Add(-*uploadExpiry),
+		"stale":   false,
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			ID string
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "uploads", args, &viewRes)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range viewRes.Rows {
+		up, err := getUpload(row.ID)
+		if err != nil {
+			maybeLog(row.ID, err)
+			continue
+		}
+		log.Printf("Expiring abandoned upload %v of %v",
+			up.Id, up.Filename)
+		deleteUploadChunks(up)
+		maybeLog(row.ID, db.Delete(row.ID))
+	}
+
+	return nil
+}
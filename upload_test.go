@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestChunkReader(t *testing.T) {
+	chunks := map[string]string{
+		"/a": "hello, ",
+		"/b": "",
+		"/c": "world",
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s, ok := chunks[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(s))
+		}))
+	defer srv.Close()
+
+	tests := []struct {
+		Paths []string
+		Exp   string
+		Err   bool
+	}{
+		{nil, "", false},
+		{[]string{"/a"}, "hello, ", false},
+		{[]string{"/a", "/b", "/c"}, "hello, world", false},
+		{[]string{"/a", "/missing"}, "", true},
+	}
+
+	for _, x := range tests {
+		urls := []string{}
+		for _, p := range x.Paths {
+			urls = append(urls, srv.URL+p)
+		}
+
+		cr := &chunkReader{urls: urls}
+		got, err := ioutil.ReadAll(cr)
+		cr.Close()
+		if x.Err {
+			if err == nil {
+				t.Errorf("Expected error reading %v, got %q",
+					x.Paths, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error reading %v: %v", x.Paths, err)
+			continue
+		}
+		if string(got) != x.Exp {
+			t.Errorf("On %v, expected %q, got %q", x.Paths, x.Exp, got)
+		}
+	}
+}
+
+func TestRecordChunk(t *testing.T) {
+	up := Upload{Size: 10}
+
+	tests := []struct {
+		offset, n int64
+		err       error
+		received  int64
+	}{
+		{0, 4, nil, 4},
+		// A retry of the same chunk is too late.
+		{0, 4, uploadOffsetError{4}, 4},
+		{8, 2, uploadOffsetError{4}, 4},
+		{4, 7, errUploadTooBig, 4},
+		// After a failed chunk, carry on where we left off.
+		{4, 6, nil, 10},
+		{10, 1, errUploadTooBig, 10},
+	}
+
+	for i, x := range tests {
+		err := recordChunk(&up, x.offset, x.n, fmt.Sprintf("chunk-%v", i))
+		if err != x.err {
+			t.Errorf("%v: recordChunk(%v, %v) = %v, expected %v",
+				i, x.offset, x.n, err, x.err)
+		}
+		if up.Received != x.received {
+			t.Errorf("%v: received %v, expected %v", i, up.Received, x.received)
+		}
+	}
+	if !reflect.DeepEqual(up.Chunks, []string{"chunk-0", "chunk-4"}) {
+		t.Errorf("Expected only the good chunks, got %v", up.Chunks)
+	}
+}
+
+func TestCheckChunkUnknownSize(t *testing.T) {
+	up := Upload{Received: 4}
+	if err := checkChunk(up, 4, 1<<30); err != nil {
+		t.Errorf("Expected any length without a size, got %v", err)
+	}
+	if err := checkChunk(up, 4, -1); err != nil {
+		t.Errorf("Expected an unknown length to be let through, got %v", err)
+	}
+	up.Size = 8
+	if err := checkChunk(up, 4, -1); err != nil {
+		t.Errorf("Expected an unknown length to be checked later, got %v", err)
+	}
+}
+
+func TestClaimUpload(t *testing.T) {
+	partial := Upload{Size: 10, Received: 4}
+	if err := claimUpload(&partial, true); err != (uploadOffsetError{4}) {
+		t.Errorf("Expected a partial upload not to finish, got %v", err)
+	}
+	if partial.Finalizing {
+		t.Errorf("Partial upload was claimed")
+	}
+	// It can still be thrown away.
+	if err := claimUpload(&partial, false); err != nil || !partial.Finalizing {
+		t.Errorf("Expected to claim a partial upload to abort, got %v", err)
+	}
+
+	up := Upload{Size: 10, Received: 10}
+	if err := claimUpload(&up, true); err != nil || !up.Finalizing {
+		t.Fatalf("Expected to claim a complete upload, got %v", err)
+	}
+
+	// Nothing else gets in while it's being finished.
+	if err := claimUpload(&up, true); err != errUploadBusy {
+		t.Errorf("Expected a second finish to be busy, got %v", err)
+	}
+	if err := claimUpload(&up, false); err != errUploadBusy {
+		t.Errorf("Expected an abort to be busy, got %v", err)
+	}
+	if err := recordChunk(&up, 10, 1, "late"); err != errUploadBusy {
+		t.Errorf("Expected a chunk to be busy, got %v", err)
+	}
+
+	if uploadErrorCode(errUploadBusy) != 409 ||
+		uploadErrorCode(errUploadTooBig) != 413 ||
+		uploadErrorCode(uploadOffsetError{4}) != 409 {
+		t.Errorf("Unexpected upload error codes")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/couchbaselabs/go-couchbase"
+)
+
+// Where each kind of document names people, as in the user_data view.
+// Audit entries are deliberately missing: the audit log is never
+// rewritten, so it keeps the real address, including in the record of
+// the erasure itself.
+var userFields = map[string][]string{
+	"bug":            {"creator", "owner", "modified_by"},
+	"bughistory":     {"creator", "owner", "modified_by"},
+	"comment":        {"user"},
+	"commenthistory": {"user"},
+	"attachment":     {"user"},
+	"upload":         {"user"},
+	"ping":           {"from", "to"},
+	"reminder":       {"user"},
+	"apitoken":       {"user"},
+	"tag":            {"default_owner"},
+}
+
+// Lists people are on by subscribing or being added.
+var userListFields = map[string][]string{
+	"bug":        {"subscribers", "also_visible_to"},
+	"bughistory": {"subscribers", "also_visible_to"},
+	"tag":        {"subscribers", "maintainers"},
+	"group":      {"members"},
+}
+
+// Documents that are only about the user, and go when they're erased.
+var userOwnedTypes = []string{"user", "reminder", "apitoken", "session"}
+
+// Secrets and storage details left out of exports.
+var exportRedactions = map[string][]string{
+	"user":     {"password_hash", "auth_token", "avatar"},
+	"apitoken": {"hash"},
+	"session":  {"id"},
+}
+
+type userDataDoc struct {
+	Id   string
+	Type string
+	Doc  map[string]interface{}
+}
+
+var findUserData = func(email string) ([]userDataDoc, error) {
+	args := map[string]interface{}{
+		"stale":        false,
+		"include_docs": true,
+		"start_key":    []interface{}{email},
+		"end_key":      []interface{}{email, map[string]string{}},
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Id  string
+			Key []string
+			Doc struct {
+				Json map[string]interface{}
+			}
+		}
+	}{}
+
+	err := db.ViewCustom("cbugg", "user_data", args, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []userDataDoc{}
+	for _, row := range viewRes.Rows {
+		if len(row.Key) < 2 || row.Doc.Json == nil {
+			continue
+		}
+		rv = append(rv, userDataDoc{row.Id, row.Key[1], row.Doc.Json})
+	}
+	return rv, nil
+}
+
+// Put everything held about someone in one document, by type.
+func userDataExport(email string, docs []userDataDoc) map[string]interface{} {
+	byType := map[string][]interface{}{}
+	for _, d := range docs {
+		for _, k := range exportRedactions[d.Type] {
+			delete(d.Doc, k)
+		}
+		byType[d.Type] = append(byType[d.Type], d.Doc)
+	}
+	return map[string]interface{}{
+		"email":       email,
+		"exported_at": time.Now().UTC(),
+		"documents":   byType,
+	}
+}
+
+func serveUserExport(w http.ResponseWriter, r *http.Request) {
+	email := resolvePrincipal(r.FormValue("email"))
+	if email == "" {
+		showError(w, r, "no email given", 400)
+		return
+	}
+
+	docs, err := findUserData(email)
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	audit(r, whoami(r).Id, "user.export", email,
+		map[string]interface{}{"documents": len(docs)})
+
+	export := userDataExport(email, docs)
+	if r.FormValue("format") != "zip" {
+		w.Header().Set("Content-Disposition",
+			`attachment; filename="cbugg-export.json"`)
+		mustEncode(w, export)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="cbugg-export.zip"`)
+
+	z := zip.NewWriter(w)
+	f, err := z.Create("data.json")
+	if err == nil {
+		err = json.NewEncoder(f).Encode(export)
+	}
+	for _, d := range docs {
+		if err != nil {
+			break
+		}
+		if d.Type == "attachment" {
+			err = zipAttachment(z, d.Doc)
+		}
+	}
+	if err == nil {
+		err = z.Close()
+	}
+	// Too late for a proper error, the headers are gone.
+	maybeLog("writing export for "+email, err)
+}
+
+func zipAttachment(z *zip.Writer, doc map[string]interface{}) error {
+	url := maybenil(doc, "url")
+	if url == "" {
+		return nil
+	}
+	res, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		log.Printf("Skipping attachment %v in export: %v", url, res.Status)
+		return nil
+	}
+
+	f, err := z.Create("attachments/" + maybenil(doc, "id") + "/" +
+		maybenil(doc, "filename"))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, res.Body)
+	return err
+}
+
+// Take someone out of a document, leaving alias in their place as
+// author so threads still read sensibly.  Bugs they owned are left
+// unassigned, as are tags they were the default owner of.  Returns
+// whether anything changed.
+func eraseUserFrom(doc map[string]interface{}, typ, email, alias string) bool {
+	changed := false
+	for _, k := range userFields[typ] {
+		if maybenil(doc, k) != email {
+			continue
+		}
+		if (typ == "bug" && k == "owner") ||
+			(typ == "tag" && k == "default_owner") {
+			delete(doc, k)
+		} else {
+			doc[k] = alias
+		}
+		changed = true
+	}
+	for _, k := range userListFields[typ] {
+		l, _ := doc[k].([]interface{})
+		kept := []interface{}{}
+		for _, v := range l {
+			if v != email {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) != len(l) {
+			doc[k] = kept
+			changed = true
+		}
+	}
+	return changed
+}
+
+func eraseUser(email string) (string, int, error) {
+	docs, err := findUserData(email)
+	if err != nil {
+		return "", 0, err
+	}
+
+	alias := "erased-" + randstring(8)
+	n := 0
+	for _, d := range docs {
+		if contains(userOwnedTypes, d.Type) {
+			if a := maybenil(d.Doc, "avatar"); d.Type == "user" && a != "" {
+				go deleteBlobFile(a)
+			}
+			err = db.Delete(d.Id)
+		} else {
+			err = db.Update(d.Id, 0, func(current []byte) ([]byte, error) {
+				if len(current) == 0 {
+					return nil, couchbase.UpdateCancel
+				}
+				doc := map[string]interface{}{}
+				err := json.Unmarshal(current, &doc)
+				if err != nil {
+					return nil, err
+				}
+				if !eraseUserFrom(doc, d.Type, email, alias) {
+					return nil, couchbase.UpdateCancel
+				}
+				return json.Marshal(doc)
+			})
+			if err == couchbase.UpdateCancel {
+				err = nil
+			}
+		}
+		if err != nil {
+			return alias, n, err
+		}
+		n++
+	}
+
+	forgetGroups()
+	forgetDisplayNames()
+	return alias, n, nil
+}
+
+func serveUserErase(w http.ResponseWriter, r *http.Request) {
+	email := resolvePrincipal(r.FormValue("email"))
+	if email == "" || isGroupPrincipal(email) {
+		showError(w, r, "no email given", 400)
+		return
+	}
+
+	alias, n, err := eraseUser(email)
+	// Record partial erasures too, so they can be finished.
+	audit(r, whoami(r).Id, "user.erase", email,
+		map[string]interface{}{"alias": alias, "documents": n})
+	if err != nil {
+		showError(w, r, err.Error(), 500)
+		return
+	}
+
+	mustEncode(w, map[string]interface{}{"alias": alias, "documents": n})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Find users' documents in docs, by address, instead of the database.
+func withUserData(docs map[string][]userDataDoc) func() {
+	origFind := findUserData
+	findUserData = func(email string) ([]userDataDoc, error) {
+		return docs[email], nil
+	}
+	return func() {
+		findUserData = origFind
+	}
+}
+
+func TestEraseUserFrom(t *testing.T) {
+	tests := []struct {
+		typ, in, out string
+		changed      bool
+	}{
+		{"bug",
+			`{"creator":"a@x","owner":"a@x","modified_by":"b@x","subscribers":["a@x","b@x"]}`,
+			`{"creator":"erased-1","modified_by":"b@x","subscribers":["b@x"]}`,
+			true},
+		{"bughistory",
+			`{"owner":"a@x","also_visible_to":["a@x"]}`,
+			`{"owner":"erased-1","also_visible_to":[]}`,
+			true},
+		{"comment",
+			`{"user":"a@x","text":"a@x wrote this"}`,
+			`{"user":"erased-1","text":"a@x wrote this"}`,
+			true},
+		{"ping",
+			`{"from":"b@x","to":"a@x"}`,
+			`{"from":"b@x","to":"erased-1"}`,
+			true},
+		{"tag",
+			`{"name":"t","subscribers":["b@x"]}`,
+			`{"name":"t","subscribers":["b@x"]}`,
+			false},
+		{"tag",
+			`{"name":"t","maintainers":["a@x"],"default_owner":"a@x"}`,
+			`{"name":"t","maintainers":[]}`,
+			true},
+		{"group",
+			`{"name":"g","members":["a@x","b@x"]}`,
+			`{"name":"g","members":["b@x"]}`,
+			true},
+	}
+
+	for _, x := range tests {
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(x.in), &doc); err != nil {
+			t.Fatalf("Error parsing %v: %v", x.in, err)
+		}
+		exp := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(x.out), &exp); err != nil {
+			t.Fatalf("Error parsing %v: %v", x.out, err)
+		}
+
+		changed := eraseUserFrom(doc, x.typ, "a@x", "erased-1")
+		if changed != x.changed {
+			t.Errorf("Erasing from %v %v changed = %v, expected %v",
+				x.typ, x.in, changed, x.changed)
+		}
+		if !reflect.DeepEqual(doc, exp) {
+			t.Errorf("Erasing from %v %v = %v, expected %v",
+				x.typ, x.in, doc, exp)
+		}
+	}
+}
+
+func TestUserDataExportRedacts(t *testing.T) {
+	docs := []userDataDoc{
+		{"u-a@x", "user", map[string]interface{}{
+			"id": "a@x", "password_hash": "secret", "auth_token": "tok"}},
+		{"apitoken-1", "apitoken", map[string]interface{}{
+			"id": "1", "hash": "secret", "name": "cli"}},
+		{"c-1", "comment", map[string]interface{}{
+			"id": "c-1", "user": "a@x"}},
+	}
+
+	export := userDataExport("a@x", docs)
+	exp := map[string][]interface{}{
+		"user":     {map[string]interface{}{"id": "a@x"}},
+		"apitoken": {map[string]interface{}{"id": "1", "name": "cli"}},
+		"comment":  {map[string]interface{}{"id": "c-1", "user": "a@x"}},
+	}
+	if !reflect.DeepEqual(export["documents"], exp) {
+		t.Errorf("Export documents = %v, expected %v",
+			export["documents"], exp)
+	}
+	if export["email"] != "a@x" {
+		t.Errorf("Export email = %v", export["email"])
+	}
+}
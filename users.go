@@ -11,9 +11,9 @@ import (
 
 var NotAUser = errors.New("not a user")
 
-func getUser(email string) (User, error) {
+var getUser = func(email string) (User, error) {
 	rv := User{}
-	k := "u-" + email
+	k := "u-" + canonicalEmail(email)
 	err := db.Get(k, &rv)
 	if err == nil && rv.Type != "user" {
 		return User{}, NotAUser
@@ -21,29 +21,47 @@ func getUser(email string) (User, error) {
 	return rv, err
 }
 
-func emailIsInternal(email string) bool {
+// The user for an email address, whether or not they have a user
+// document.
+func userForEmail(email string) User {
+	email = canonicalEmail(email)
 	u, err := getUser(email)
-	return err == nil && u.Internal
+	if err != nil {
+		u = User{Id: email, Type: "user"}
+	}
+	return u
 }
 
 func serveMe(w http.ResponseWriter, r *http.Request) {
 	me := whoami(r)
 	me.AuthToken = ""
-
-	mustEncode(w, me)
+	me.PasswordHash = ""
+
+	mustEncode(w, map[string]interface{}{
+		"id":          me.Id,
+		"handle":      handleFor(me.Id),
+		"name":        displayNameFor(me.Id),
+		"type":        me.Type,
+		"admin":       me.Admin,
+		"internal":    me.Internal,
+		"prefs":       me.Prefs,
+		"time_zone":   me.TimeZone,
+		"locale":      me.Locale,
+		"roles":       rolesFor(me),
+		"permissions": permissionsOf(me),
+	})
 }
 
 func serveAdminUserMod(w http.ResponseWriter, r *http.Request) {
-	me := whoami(r)
-
-	if !me.Admin {
-		showError(w, r, "Must be admin to do this", 403)
+	email := canonicalEmail(r.FormValue("email"))
+	if email == "" {
+		showError(w, r, "no email given", 400)
 		return
 	}
 
-	email := r.FormValue("email")
-	if email == "" {
-		showError(w, r, "no email given", 400)
+	aliases := splitList(r.FormValue("aliases"))
+	if err := checkAliases(email, aliases); err != nil {
+		showError(w, r, err.Error(), 400)
 		return
 	}
 
@@ -72,14 +90,43 @@ func serveAdminUserMod(w http.ResponseWriter, r *http.Request) {
 			user.Internal = internalVal == "true"
 		}
 
+		if _, ok := r.Form["roles"]; ok {
+			user.Roles = splitList(r.FormValue("roles"))
+		}
+
+		if _, ok := r.Form["aliases"]; ok {
+			user.Aliases = aliases
+		}
+
+		err := updateProfile(&user.Profile, r.Form)
+		if err != nil {
+			return nil, err
+		}
+
 		return json.Marshal(user)
 	})
 
 	if err != nil {
-		showError(w, r, err.Error(), 500)
+		code := 500
+		if isProfileError(err) {
+			code = 400
+		}
+		showError(w, r, err.Error(), code)
 		return
 	}
 
+	forgetDisplayNames()
+	forgetAliases()
+
+	detail := map[string]interface{}{}
+	for _, k := range []string{"admin", "internal", "roles", "display_name",
+		"time_zone", "locale", "aliases"} {
+		if _, ok := r.Form[k]; ok {
+			detail[k] = r.FormValue(k)
+		}
+	}
+	audit(r, whoami(r).Id, "user.mod", email, detail)
+
 	mustEncode(w, Email(email))
 }
 
@@ -124,50 +171,10 @@ func serveSetMyPrefs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user.PasswordHash = ""
 	mustEncode(w, user)
 }
 
-func serveUserAuthToken(w http.ResponseWriter, r *http.Request) {
-	me := whoami(r)
-	// If the user doesn't have an auth token, make one.
-	if me.AuthToken == "" {
-		serveUpdateUserAuthToken(w, r)
-		return
-	}
-
-	mustEncode(w, map[string]string{"token": me.AuthToken})
-}
-
-func serveUpdateUserAuthToken(w http.ResponseWriter, r *http.Request) {
-	me := whoami(r)
-	key := "u-" + me.Id
-	user := User{}
-
-	err := db.Update(key, 0, func(current []byte) ([]byte, error) {
-		if len(current) > 0 {
-			err := json.Unmarshal(current, &user)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		// Common fields
-		user.Id = me.Id
-		user.Type = "user"
-
-		user.AuthToken = randstring(16)
-
-		return json.Marshal(user)
-	})
-
-	if err != nil {
-		showError(w, r, err.Error(), 500)
-		return
-	}
-
-	mustEncode(w, map[string]string{"token": user.AuthToken})
-}
-
 func findEmailByMD5(m string) string {
 	rv := ""
 	if ul, err := listUsers(); err == nil {
@@ -177,6 +184,11 @@ func findEmailByMD5(m string) string {
 			}
 		}
 	}
+	for a, e := range getAliases() {
+		if md5string(a) == m {
+			return e
+		}
+	}
 	return rv
 }
 
@@ -198,7 +210,7 @@ func listUsers() ([]string, error) {
 	}
 
 	for _, r := range viewRes.Rows {
-		if strings.Contains(r.Key, "@") {
+		if strings.Contains(r.Key, "@") && !isAlias(r.Key) {
 			rv = append(rv, r.Key)
 		}
 	}
@@ -206,14 +218,25 @@ func listUsers() ([]string, error) {
 	return rv, nil
 }
 
+// Everyone we know of, for pickers.  Only those who may see user
+// details get addresses; everyone else gets "Name <handle>", which
+// is accepted anywhere an address is.
 func serveUserList(w http.ResponseWriter, r *http.Request) {
 	rv := []string{}
 
-	if whoami(r).Id != "" {
-		var err error
-		rv, err = listUsers()
+	me := whoami(r)
+	if me.Id != "" {
+		users, err := listUsers()
 		if err != nil {
 			showError(w, r, err.Error(), 500)
+			return
+		}
+		if userCan(me, permUsersView) {
+			rv = users
+		} else {
+			for _, u := range users {
+				rv = append(rv, displayNameFor(u)+" <"+handleFor(u)+">")
+			}
 		}
 	}
 
@@ -221,13 +244,6 @@ func serveUserList(w http.ResponseWriter, r *http.Request) {
 }
 
 func serveSpecialUserList(w http.ResponseWriter, r *http.Request) {
-	me := whoami(r)
-
-	if !(me.Admin || me.Internal) {
-		showError(w, r, "You are not allowed to see this list", 403)
-		return
-	}
-
 	args := map[string]interface{}{
 		"reduce": false,
 	}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+// Look users up in users instead of the database.
+func withUsers(users map[string]User) func() {
+	origGet := getUser
+	getUser = func(email string) (User, error) {
+		u, ok := users[email]
+		if !ok {
+			return User{}, NotAUser
+		}
+		return u, nil
+	}
+	return func() {
+		getUser = origGet
+	}
+}
+
+func TestUserForEmail(t *testing.T) {
+	defer withAliases(map[string]string{
+		"dustin@spy.net": "dustin@couchbase.com",
+	})()
+	defer withUsers(map[string]User{
+		"dustin@couchbase.com": {Id: "dustin@couchbase.com", Type: "user",
+			Internal: true},
+	})()
+
+	u := userForEmail("dustin@spy.net")
+	if u.Id != "dustin@couchbase.com" || !u.Internal {
+		t.Errorf("Expected the stored user for an alias, got %+v", u)
+	}
+	u = userForEmail("aaron@crate.im")
+	if u.Id != "aaron@crate.im" || u.Type != "user" || u.Internal {
+		t.Errorf("Expected a plain user for someone unknown, got %+v", u)
+	}
+}
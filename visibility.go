@@ -14,9 +14,8 @@ func isVisible(ob interface{}, u User) bool {
 func filterUnprivelegedEmails(ob interface{}, emails []string) []string {
 	rv := []string{}
 
-	for _, e := range emails {
-		u, _ := getUser(e)
-		if isVisible(ob, u) {
+	for _, e := range expandPrincipals(emails) {
+		if isVisible(ob, userForEmail(e)) {
 			rv = append(rv, e)
 		}
 	}
@@ -5,6 +5,9 @@ import (
 )
 
 func TestBugVisibility(t *testing.T) {
+	defer withRoles(nil)()
+	defer withGroups()()
+
 	internalUser := User{Id: "internal user", Internal: true}
 	externalUser := User{Id: "external user"}
 	specialUser := User{Id: "special user"}
@@ -45,6 +48,9 @@ func TestBugVisibility(t *testing.T) {
 }
 
 func TestCommentVisibility(t *testing.T) {
+	defer withRoles(nil)()
+	defer withGroups()()
+
 	internalUser := User{Id: "internal user", Internal: true}
 	externalUser := User{Id: "external user"}
 